@@ -2,39 +2,73 @@ package cmd
 
 import (
 	"log"
+	"time"
 
+	"github.com/IonBazan/gangplank/internal/api"
 	"github.com/IonBazan/gangplank/internal/types"
 	"github.com/spf13/cobra"
 )
 
 var (
 	name   string
+	expire time.Duration
 	addCmd = &cobra.Command{
 		Use:   "add <external>:<internal>/<protocol>",
 		Short: "Add a single UPnP port mapping",
-		Long:  `Adds a single port mapping rule directly to the UPnP gateway for debugging purposes. Format: <external>:<internal>/<protocol> (e.g., 8080:80/tcp).`,
-		Args:  cobra.ExactArgs(1),
+		Long: `Adds a single port mapping rule directly to the UPnP gateway for debugging purposes. Format: <external>:<internal>/<protocol> (e.g., 8080:80/tcp). Port ranges like 27015-27030/udp add one mapping per port and the "both" protocol adds TCP and UDP mappings.
+With --remote, the mapping is added to a running daemon, which keeps it forwarded until it is deleted or expires (see --expire).`,
+		Args: cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
+			if remote != "" {
+				addRemote(args[0])
+				return
+			}
+			if expire > 0 {
+				log.Fatalf("--expire requires --remote, only the daemon can remove expired port mappings")
+			}
+
 			upnpClient, err := SetupUPnPClient()
 			if err != nil {
 				log.Fatalf("Failed to initialize UPnP client: %v", err)
 			}
 
-			mapping, err := types.ParsePortMapping(args[0])
+			mappings, err := types.ParsePortMappings(args[0])
 			if err != nil {
 				log.Fatalf("Failed to parse port mapping: %v", err)
 			}
-			mapping.Name = name
 
-			if err := upnpClient.ForwardPorts([]types.PortMapping{mapping}); err != nil {
-				log.Printf("Failed to add port mapping %d/%s: %v", mapping.ExternalPort, mapping.Protocol, err)
-			} else {
-				log.Printf("Successfully added port mapping %d/%s for %s", mapping.ExternalPort, mapping.Protocol, mapping.Name)
+			for _, mapping := range mappings {
+				// A name given in the port entry takes precedence, like for mappings added through the API.
+				if mapping.Name == "" {
+					mapping.Name = name
+				}
+				if err := upnpClient.ForwardPorts([]types.PortMapping{mapping}); err != nil {
+					log.Printf("Failed to add port mapping %d/%s: %v", mapping.ExternalPort, mapping.Protocol, err)
+				} else {
+					log.Printf("Successfully added port mapping %d/%s for %s", mapping.ExternalPort, mapping.Protocol, mapping.Name)
+				}
 			}
 		},
 	}
 )
 
+// addRemote adds the mapping to the daemon listening on the --remote address.
+func addRemote(port string) {
+	request := api.AddRequest{Port: port, Name: name}
+	if expire > 0 {
+		request.ExpiresIn = expire.String()
+	}
+	added, err := api.NewClient(remote, apiToken).AddMappings(request)
+	if err != nil {
+		log.Fatalf("Failed to add port mapping: %v", err)
+	}
+	for _, mapping := range added {
+		log.Printf("Successfully added port mapping %d/%s for %s", mapping.ExternalPort, mapping.Protocol, mapping.Name)
+	}
+}
+
 func init() {
 	addCmd.Flags().StringVar(&name, "name", "", "Optional name for the mapping")
+	addCmd.Flags().StringVar(&remote, "remote", "", "Add the mapping to the daemon serving the management API on this address")
+	addCmd.Flags().DurationVar(&expire, "expire", 0, "Remove the mapping after this duration, e.g. 2h (requires --remote)")
 }
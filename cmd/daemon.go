@@ -3,16 +3,36 @@ package cmd
 import (
 	"context"
 	"github.com/IonBazan/gangplank/internal"
+	"github.com/IonBazan/gangplank/internal/api"
+	"github.com/IonBazan/gangplank/internal/config"
+	"github.com/IonBazan/gangplank/internal/metrics"
+	"github.com/IonBazan/gangplank/internal/providers"
 	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
 )
 
+// gatewayProbeInterval is how often the gateway is probed while metrics are served.
+const gatewayProbeInterval = time.Minute
+
 var (
 	cleanupOnStop   bool
+	cleanupOnExit   bool
+	shutdownTimeout time.Duration
 	poll            bool
 	refreshInterval time.Duration
+	renewFraction   float64
+	renewJitter     float64
+	driftInterval   time.Duration
+	apiListen       string
+	metricsListen   string
+	watchConfigFile bool
 	daemonCmd       = &cobra.Command{
 		Use:   "daemon",
 		Short: "Run as a daemon with polling and port refreshing",
@@ -26,46 +46,219 @@ var (
 				log.Printf("UPnP client initialized with local IP: %s", upnpClient.LocalIP)
 			}
 
-			ctx, cancel := context.WithCancel(context.Background())
-			defer cancel()
+			refreshOptions := internal.RefreshOptions{Interval: refreshInterval, RenewFraction: renewFraction, Jitter: renewJitter}
+			if err := refreshOptions.Validate(); err != nil {
+				log.Fatalf("Invalid refresh options: %v", err)
+			}
+			if ttl > 0 && refreshInterval >= ttl {
+				log.Printf("Warning: --refresh-interval (%s) is not shorter than --ttl (%s), new containers and config changes are only picked up after mappings could have expired", refreshInterval, ttl)
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
 
-			gp := internal.NewGangplank(cfg, upnpClient)
+			gp := internal.NewGangplank(cfg, upnpClient, gangplankOptions())
 
 			initialPorts, _ := gp.GetPortMappings()
 
 			listPorts(initialPorts)
-			gp.ForwardPorts(initialPorts)
 
+			var workers sync.WaitGroup
+			workers.Add(1)
 			go func() {
-				ticker := time.NewTicker(refreshInterval)
-				defer ticker.Stop()
-
-				for {
-					select {
-					case <-ctx.Done():
-						return
-					case <-ticker.C:
-						log.Printf("Updating port mappings...")
-						ports, _ := gp.GetPortMappings()
-						if len(ports) > 0 {
-							log.Printf("Refreshing %d port mappings", len(ports))
-							gp.ForwardPorts(ports)
-						}
-					}
-				}
+				defer workers.Done()
+				gp.RefreshPorts(ctx, refreshOptions, initialPorts)
 			}()
 
 			if poll {
-				go gp.PollAndForward(ctx, cleanupOnStop)
+				workers.Add(1)
+				go func() {
+					defer workers.Done()
+					gp.PollAndForward(ctx, cleanupOnStop)
+				}()
+			}
+
+			if driftInterval > 0 && !dryRun {
+				workers.Add(1)
+				go func() {
+					defer workers.Done()
+					gp.WatchDrift(ctx, driftInterval)
+				}()
+			}
+
+			if apiListen != "" {
+				serveAPI(ctx, gp, &workers)
+			}
+
+			if metricsListen != "" {
+				serveMetrics(ctx, gp, &workers)
 			}
 
-			select {}
+			if cfg != nil && len(cfg.WatchPatterns()) > 0 {
+				watchConfig(ctx, gp, cfg)
+			}
+
+			<-ctx.Done()
+			// A second signal terminates the daemon right away.
+			stop()
+			shutdown(gp, &workers)
 		},
 	}
 )
 
+// shutdown waits for the daemon goroutines to stop and deletes the mappings created by this instance if requested,
+// giving up after the shutdown timeout.
+func shutdown(gp *internal.Gangplank, workers *sync.WaitGroup) {
+	log.Printf("Shutting down Gangplank daemon (timeout: %s)...", shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Println("Timed out waiting for the event and refresh loops to stop")
+	}
+
+	if cleanupOnExit {
+		if err := gp.Cleanup(ctx); err != nil {
+			log.Printf("Failed to delete port mappings on exit: %v", err)
+		}
+	}
+	log.Println("Gangplank daemon stopped")
+}
+
+// serveAPI serves the management API and removes the runtime mappings added through it once they expire.
+func serveAPI(ctx context.Context, gp *internal.Gangplank, workers *sync.WaitGroup) {
+	if apiToken == "" && !api.IsUnixSocket(apiListen) {
+		log.Fatalf("Serving the management API on %s requires --api-token", apiListen)
+	}
+
+	workers.Add(2)
+	go func() {
+		defer workers.Done()
+		if err := api.NewServer(gp, apiToken).Serve(ctx, apiListen); err != nil {
+			log.Printf("Management API stopped: %v", err)
+		}
+	}()
+	go func() {
+		defer workers.Done()
+		gp.ExpireRuntimeMappings(ctx, time.Second)
+	}()
+}
+
+// serveMetrics serves the Prometheus metrics and probes the gateway regularly so that its reachability is up to date.
+func serveMetrics(ctx context.Context, gp *internal.Gangplank, workers *sync.WaitGroup) {
+	if err := metrics.RegisterMappings(gp.MappingCounts); err != nil {
+		log.Printf("Failed to register port mapping metrics: %v", err)
+	}
+	for _, provider := range gp.EventPortProviders {
+		if stream, ok := provider.(*providers.DockerEventPortProvider); ok && poll {
+			if err := metrics.RegisterDockerEvents(stream); err != nil {
+				log.Printf("Failed to register Docker event metrics: %v", err)
+			}
+		}
+	}
+
+	workers.Add(2)
+	go func() {
+		defer workers.Done()
+		if err := metrics.Serve(ctx, metricsListen); err != nil {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+	go func() {
+		defer workers.Done()
+		gp.ProbeGateway(ctx, gatewayProbeInterval)
+	}()
+}
+
+// watchConfig reloads the config files when they change on disk (if enabled) or when the daemon receives SIGHUP.
+func watchConfig(ctx context.Context, gp *internal.Gangplank, current *config.Config) {
+	path := current.Path
+	reloadCh := make(chan struct{}, 1)
+	requestReload := func() {
+		select {
+		case reloadCh <- struct{}{}:
+		default:
+		}
+	}
+
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				signal.Stop(hupCh)
+				return
+			case <-hupCh:
+				log.Println("Received SIGHUP, reloading config...")
+				requestReload()
+			}
+		}
+	}()
+
+	// A reload may add config directories or include patterns, so the watch is restarted with the new patterns.
+	patterns := current.WatchPatterns()
+	stopWatch := func() {}
+	watch := func() {
+		stopWatch()
+		if !watchConfigFile {
+			return
+		}
+		var watchCtx context.Context
+		watchCtx, stopWatch = context.WithCancel(ctx)
+		if err := config.Watch(watchCtx, patterns, func() {
+			log.Println("Config files changed, reloading...")
+			requestReload()
+		}); err != nil {
+			log.Printf("Failed to watch config files %v: %v", patterns, err)
+		} else {
+			log.Printf("Watching config files %v for changes", patterns)
+		}
+	}
+	watch()
+
+	go func() {
+		defer stopWatch()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-reloadCh:
+				newCfg, err := config.LoadConfig(path, configDir)
+				if err != nil {
+					log.Printf("Failed to reload config, keeping the current config: %v", err)
+					continue
+				}
+				if err := gp.ReloadConfig(newCfg); err != nil {
+					log.Printf("Failed to apply reloaded config: %v", err)
+				}
+				// Files of a rejected config are watched too, so that fixing them triggers another reload.
+				if !slices.Equal(patterns, newCfg.WatchPatterns()) {
+					patterns = newCfg.WatchPatterns()
+					watch()
+				}
+			}
+		}
+	}()
+}
+
 func init() {
 	daemonCmd.Flags().BoolVarP(&poll, "poll", "p", false, "Listen for container events")
 	daemonCmd.Flags().BoolVar(&cleanupOnStop, "cleanup-on-stop", false, "Delete port mappings on container stop/die")
-	daemonCmd.Flags().DurationVar(&refreshInterval, "refresh-interval", 15*time.Minute, "Interval to refresh port mappings")
+	daemonCmd.Flags().BoolVar(&cleanupOnExit, "cleanup-on-exit", false, "Delete the port mappings created by the daemon when it receives SIGTERM or SIGINT")
+	daemonCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "Maximum time to stop the daemon, including deleting port mappings with --cleanup-on-exit")
+	daemonCmd.Flags().DurationVar(&refreshInterval, "refresh-interval", 15*time.Minute, "Interval to look for new port mappings and to renew mappings with a permanent lease")
+	daemonCmd.Flags().Float64Var(&renewFraction, "renew-fraction", internal.DefaultRenewFraction, "Part of its lease after which a port mapping is renewed, e.g. 0.8")
+	daemonCmd.Flags().Float64Var(&renewJitter, "renew-jitter", internal.DefaultRenewJitter, "Renew port mappings earlier by up to this part of their renewal period, to spread renewals out")
+	daemonCmd.Flags().DurationVar(&driftInterval, "drift-interval", time.Minute, "Interval to check that the gateway still has the port mappings and restore the ones deleted or changed out-of-band (0 disables the check)")
+	daemonCmd.Flags().StringVar(&apiListen, "api-listen", "", "Serve the management API on a unix socket (e.g. unix:///run/gangplank/api.sock) or a TCP address (e.g. 127.0.0.1:8089, requires --api-token) (default: disabled)")
+	daemonCmd.Flags().StringVar(&metricsListen, "metrics-listen", "", "Serve Prometheus metrics on /metrics at this TCP address, e.g. :9101 (default: disabled)")
+	daemonCmd.Flags().BoolVar(&watchConfigFile, "watch-config", true, "Reload the config file when it changes")
 }
@@ -3,6 +3,7 @@ package cmd
 import (
 	"log"
 
+	"github.com/IonBazan/gangplank/internal/api"
 	"github.com/IonBazan/gangplank/internal/types"
 	"github.com/spf13/cobra"
 )
@@ -11,27 +12,53 @@ var (
 	deleteCmd = &cobra.Command{
 		Use:   "delete <external>/<protocol>",
 		Short: "Delete a single UPnP port mapping",
-		Long:  `Deletes a single port mapping rule directly from the UPnP gateway for debugging purposes. Format: <external>:<internal>/<protocol> (e.g., 8080:80/tcp). Note: internal port is ignored for deletion.`,
-		Args:  cobra.ExactArgs(1),
+		Long: `Deletes a single port mapping rule directly from the UPnP gateway for debugging purposes. Format: <external>:<internal>/<protocol> (e.g., 8080:80/tcp). Port ranges like 27015-27030/udp delete one mapping per port and the "both" protocol deletes TCP and UDP mappings. Note: internal port is ignored for deletion.
+With --remote, the mapping is removed from the mappings added to a running daemon with "add --remote".`,
+		Args: cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
+			if remote != "" {
+				deleteRemote(args[0])
+				return
+			}
+
 			upnpClient, err := SetupUPnPClient()
 			if err != nil {
 				log.Fatalf("Failed to initialize UPnP client: %v", err)
 			}
 
-			mapping, err := types.ParsePortMapping(args[0])
+			mappings, err := types.ParsePortMappings(args[0])
 			if err != nil {
 				log.Fatalf("Failed to parse port mapping: %v", err)
 			}
 
-			if err := upnpClient.DeletePortMapping(mapping.ExternalPort, mapping.Protocol); err != nil {
-				log.Printf("Failed to delete port mapping %d/%s: %v", mapping.ExternalPort, mapping.Protocol, err)
-			} else {
-				log.Printf("Successfully deleted port mapping %d/%s", mapping.ExternalPort, mapping.Protocol)
+			for _, mapping := range mappings {
+				if err := upnpClient.DeleteMapping(mapping); err != nil {
+					log.Printf("Failed to delete port mapping %d/%s: %v", mapping.ExternalPort, mapping.Protocol, err)
+				} else {
+					log.Printf("Successfully deleted port mapping %d/%s", mapping.ExternalPort, mapping.Protocol)
+				}
 			}
 		},
 	}
 )
 
+// deleteRemote removes the mapping from the daemon listening on the --remote address.
+func deleteRemote(port string) {
+	mappings, err := types.ParsePortMappings(port)
+	if err != nil {
+		log.Fatalf("Failed to parse port mapping: %v", err)
+	}
+
+	client := api.NewClient(remote, apiToken)
+	for _, mapping := range mappings {
+		if err := client.DeleteMapping(mapping); err != nil {
+			log.Printf("Failed to delete port mapping %d/%s: %v", mapping.ExternalPort, mapping.Protocol, err)
+		} else {
+			log.Printf("Successfully deleted port mapping %d/%s", mapping.ExternalPort, mapping.Protocol)
+		}
+	}
+}
+
 func init() {
+	deleteCmd.Flags().StringVar(&remote, "remote", "", "Delete the mapping from the daemon serving the management API on this address")
 }
@@ -21,12 +21,12 @@ var (
 				log.Printf("UPnP client initialized with local IP: %s", upnpClient.LocalIP)
 			}
 
-			gp := internal.NewGangplank(cfg, upnpClient)
+			gp := internal.NewGangplank(cfg, upnpClient, gangplankOptions())
 
 			initialPorts, _ := gp.GetPortMappings()
 
 			listPorts(initialPorts)
-			gp.ForwardPorts(initialPorts)
+			gp.ForwardPorts(gp.ResolveClaims(initialPorts))
 		},
 	}
 )
@@ -4,25 +4,34 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"slices"
+	"strings"
 	"text/tabwriter"
 
+	"github.com/IonBazan/gangplank/internal/api"
+	"github.com/IonBazan/gangplank/internal/providers"
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/IonBazan/gangplank/internal/upnp"
+	"github.com/docker/docker/client"
 	"github.com/spf13/cobra"
 )
 
+var listProject string
+
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List all active UPnP port mappings",
-	Long:  `Retrieves and displays all active UPnP port mappings from the gateway, including external port, internal port, protocol, internal IP, description, and lease duration.`,
-	Args:  cobra.NoArgs, // No arguments required
+	Long: `Retrieves and displays all active UPnP port mappings from the gateway, including external port, internal port, protocol, internal IP, description, and lease duration.
+Use --project to only show the mappings of the services of a Docker Compose project, and --remote to ask the gateway of a running daemon.`,
+	Args: cobra.NoArgs, // No arguments required
 	Run: func(cmd *cobra.Command, args []string) {
-		upnpClient, err := SetupUPnPClient()
-		if err != nil {
-			log.Fatalf("Failed to initialize UPnP client: %v", err)
-		}
-		mappings, err := upnpClient.ListPortMappings()
+		mappings, err := listEntries()
 		if err != nil {
 			log.Fatalf("Failed to list port mappings: %v", err)
 		}
+		if listProject != "" {
+			mappings = projectEntries(mappings, listProject)
+		}
 
 		if len(mappings) == 0 {
 			log.Println("No active UPnP port mappings found.")
@@ -53,4 +62,46 @@ var listCmd = &cobra.Command{
 }
 
 func init() {
+	listCmd.Flags().StringVar(&listProject, "project", "", "Only show mappings of the given Docker Compose project")
+	listCmd.Flags().StringVar(&remote, "remote", "", "List the mappings of the gateway used by the daemon serving the management API on this address")
+}
+
+// listEntries lists the router entries, through the daemon when --remote is set.
+func listEntries() ([]upnp.PortMappingEntry, error) {
+	if remote != "" {
+		return api.NewClient(remote, apiToken).RouterMappings()
+	}
+
+	upnpClient, err := SetupUPnPClient()
+	if err != nil {
+		log.Fatalf("Failed to initialize UPnP client: %v", err)
+	}
+	return upnpClient.ListPortMappings()
+}
+
+// projectEntries keeps the router entries forwarding the ports of the project's running containers, and the ones
+// described with the project name by a previous run.
+func projectEntries(entries []upnp.PortMappingEntry, project string) []upnp.PortMappingEntry {
+	var ports []types.PortMapping
+	if docker {
+		dockerCli, err := client.NewClientWithOpts(client.WithAPIVersionNegotiation())
+		if err != nil {
+			log.Fatalf("Failed to create Docker client: %v", err)
+		}
+		selector := gangplankOptions().Containers
+		selector.Projects = []string{project}
+		ports, err = providers.NewDockerPortProvider(dockerCli, selector).GetPortMappings()
+		if err != nil {
+			log.Fatalf("Failed to read port mappings of project %s: %v", project, err)
+		}
+	}
+
+	prefix := upnp.Description(types.PortMapping{Name: project + "/"})
+	var filtered []upnp.PortMappingEntry
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Description, prefix) || slices.ContainsFunc(ports, entry.Forwards) {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
 }
@@ -2,7 +2,10 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/IonBazan/gangplank/internal"
 	"github.com/IonBazan/gangplank/internal/config"
+	"github.com/IonBazan/gangplank/internal/providers"
+	"github.com/IonBazan/gangplank/internal/state"
 	"github.com/IonBazan/gangplank/internal/upnp"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -31,6 +34,7 @@ var (
 
 var (
 	configFile string
+	configDir  string
 	cfg        *config.Config
 )
 
@@ -39,12 +43,35 @@ var (
 	localIP         string
 	gateway         string
 	ttl             time.Duration
+	ttlFromFlag     bool
+	docker          bool
+	containerdAddr  string
+	containerdNs    string
+	nomadAddr       string
+	nomadToken      string
+	procRoot        string
+	listenerPoll    time.Duration
+	forwardPolicy   string
+	forwardProjects []string
+	forwardImages   []string
+	forwardNetworks []string
+	closePaused     bool
+	dataDir         string
+	apiToken        string
+	remote          string
 	SetupUPnPClient = func() (*upnp.Client, error) {
 		if dryRun {
 			return upnp.NewDummyClient(ttl), nil
 		}
 
-		return upnp.NewClient(localIP, gateway, ttl)
+		client, err := upnp.NewClient(localIP, gateway, ttl)
+		if err != nil {
+			return nil, err
+		}
+		if dataDir != "" {
+			useStateStore(client)
+		}
+		return client, nil
 	}
 	rootCmd = &cobra.Command{
 		Use:     "gangplank",
@@ -68,10 +95,25 @@ func init() {
 	cobra.OnInitialize(initConfig)
 
 	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "", "config file path")
+	rootCmd.PersistentFlags().StringVar(&configDir, "config-dir", "", "directory of YAML, JSON or TOML files with additional port mappings")
 	rootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "Do not apply changes - only list the ports")
 	rootCmd.PersistentFlags().StringVar(&localIP, "local-ip", "", "Local IP address to use for UPnP (default: auto-detected)")
 	rootCmd.PersistentFlags().StringVar(&gateway, "gateway", "", "UPnP gateway location URL (default: auto-detected)")
 	rootCmd.PersistentFlags().DurationVar(&ttl, "ttl", upnp.DefaultLeaseDuration, "UPnP lease duration")
+	rootCmd.PersistentFlags().BoolVar(&docker, "docker", true, "Read port mappings from the Docker daemon")
+	rootCmd.PersistentFlags().StringVar(&containerdAddr, "containerd-address", "", "containerd socket to read port mappings from, e.g. /run/containerd/containerd.sock (default: disabled)")
+	rootCmd.PersistentFlags().StringVar(&containerdNs, "containerd-namespace", providers.DefaultContainerdNamespace, "containerd namespace to watch")
+	rootCmd.PersistentFlags().StringVar(&nomadAddr, "nomad-address", "", "Nomad HTTP API to read allocation port mappings from, e.g. "+providers.DefaultNomadAddress+" (default: disabled)")
+	rootCmd.PersistentFlags().StringVar(&nomadToken, "nomad-token", "", "Nomad ACL token")
+	rootCmd.PersistentFlags().StringVar(&procRoot, "proc-root", providers.DefaultProcRoot, "Host procfs mount used to find listening sockets for the listeners config")
+	rootCmd.PersistentFlags().DurationVar(&listenerPoll, "listener-poll-interval", providers.DefaultListenerPollInterval, "Interval to check host listeners for changes")
+	rootCmd.PersistentFlags().StringVar(&forwardPolicy, "forward-policy", string(providers.ForwardPolicyLabel), "Which Docker containers to forward: label (only labeled containers), all-published (every published port unless gangplank.enabled=false) or none")
+	rootCmd.PersistentFlags().StringSliceVar(&forwardProjects, "forward-project", nil, "Only forward Docker containers of these compose projects")
+	rootCmd.PersistentFlags().StringSliceVar(&forwardImages, "forward-image", nil, "Only forward Docker containers whose image matches one of these patterns, e.g. 'ghcr.io/me/*'")
+	rootCmd.PersistentFlags().BoolVar(&closePaused, "close-paused", false, "Remove port mappings of paused Docker containers until they are unpaused")
+	rootCmd.PersistentFlags().StringSliceVar(&forwardNetworks, "forward-network", nil, "Only forward Docker containers attached to one of these networks")
+	rootCmd.PersistentFlags().StringVar(&apiToken, "api-token", "", "Token required by the management API of the daemon, and sent to it with --remote")
+	rootCmd.PersistentFlags().StringVar(&dataDir, "data-dir", "", "Directory to keep track of the created port mappings in, across restarts (default: disabled)")
 
 	rootCmd.AddCommand(forwardCmd)
 	rootCmd.AddCommand(addCmd)
@@ -80,6 +122,53 @@ func init() {
 	rootCmd.AddCommand(listCmd)
 }
 
+// useStateStore records the mappings created by the client in the state file of the data directory, and takes over
+// the mappings recorded for the same gateway by previous runs.
+func useStateStore(client *upnp.Client) {
+	store, err := state.Open(dataDir)
+	if err != nil {
+		log.Printf("Failed to open state in %s, not keeping track of port mappings: %v", dataDir, err)
+		return
+	}
+	entries, err := store.Entries(client.Gateway())
+	if err != nil {
+		log.Printf("Failed to read %s, not keeping track of port mappings: %v", store.Path(), err)
+		return
+	}
+	for _, e := range entries {
+		client.Adopt(e.Mapping(), e.AssignedPort)
+	}
+	if len(entries) > 0 {
+		log.Printf("Found %d port mapping(s) created by a previous run in %s", len(entries), store.Path())
+	}
+	client.SetRecorder(store)
+}
+
+func gangplankOptions() internal.Options {
+	policy, err := providers.ParseForwardPolicy(forwardPolicy)
+	if err != nil {
+		log.Fatalf("Failed to parse forwarding policy: %v", err)
+	}
+
+	return internal.Options{
+		Docker:               docker,
+		ContainerdAddress:    containerdAddr,
+		ContainerdNamespace:  containerdNs,
+		NomadAddress:         nomadAddr,
+		NomadToken:           nomadToken,
+		ProcRoot:             procRoot,
+		ListenerPollInterval: listenerPoll,
+		Containers: providers.ContainerSelector{
+			Policy:   policy,
+			Projects: forwardProjects,
+			Images:   forwardImages,
+			Networks: forwardNetworks,
+		},
+		ClosePaused: closePaused,
+		FixedTTL:    ttlFromFlag,
+	}
+}
+
 // bindFlags binds each cobra flag to its associated viper configuration
 func bindFlags(cmd *cobra.Command) {
 	cmd.Flags().VisitAll(func(f *pflag.Flag) {
@@ -98,11 +187,19 @@ func initConfig() {
 	viper.AutomaticEnv()
 	viper.SetEnvPrefix(envPrefix)
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	// bindFlags marks flags set from the config file as changed too, so check the command line first.
+	ttlFromFlag = rootCmd.PersistentFlags().Changed("ttl")
 
-	cfg, err := config.LoadConfig(configFile)
-	if err != nil && configFile != "" {
+	var err error
+	cfg, err = config.LoadConfig(configFile, configDir)
+	if err != nil && (configFile != "" || configDir != "") {
 		log.Fatalf("error loading config file: %v", err)
 	}
+	if cfg != nil {
+		if err := cfg.Validate(); err != nil {
+			log.Fatalf("invalid config: %v", err)
+		}
+	}
 
 	if cfg != nil {
 		if cfg.RefreshInterval > 0 {
@@ -0,0 +1,105 @@
+// Package api serves the management API of the daemon and talks to it from the other commands.
+package api
+
+import (
+	"strings"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal"
+)
+
+// Mapping is a port mapping the daemon keeps forwarded.
+type Mapping struct {
+	ExternalPort     int    `json:"externalPort"`
+	InternalPort     int    `json:"internalPort"`
+	Protocol         string `json:"protocol"`
+	Name             string `json:"name,omitempty"`
+	RemoteHost       string `json:"remoteHost,omitempty"`
+	AutoExternalPort bool   `json:"autoExternalPort,omitempty"`
+	// AssignedPort is the external port the gateway picked for a mapping with an automatic external port.
+	AssignedPort int    `json:"assignedPort,omitempty"`
+	Priority     int    `json:"priority,omitempty"`
+	Source       string `json:"source,omitempty"`
+	ContainerID  string `json:"containerId,omitempty"`
+	// Forwarded tells whether the daemon forwarded the mapping and did not delete it since.
+	Forwarded bool `json:"forwarded"`
+	// ExpiresAt is when a runtime mapping is removed.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+func newMapping(status internal.MappingStatus) Mapping {
+	m := Mapping{
+		ExternalPort:     status.ExternalPort,
+		InternalPort:     status.InternalPort,
+		Protocol:         status.Protocol,
+		Name:             status.Name,
+		RemoteHost:       status.RemoteHost,
+		AutoExternalPort: status.AutoExternalPort,
+		AssignedPort:     status.AssignedPort,
+		Priority:         status.Priority,
+		Source:           status.Source,
+		ContainerID:      status.ContainerID,
+		Forwarded:        status.Forwarded,
+	}
+	if !status.ExpiresAt.IsZero() {
+		m.ExpiresAt = &status.ExpiresAt
+	}
+	return m
+}
+
+// AddRequest adds runtime port mappings.
+type AddRequest struct {
+	// Port is a port entry like "8080:80/tcp;name=web", see types.ParsePortEntry.
+	Port string `json:"port"`
+	// Name names the mappings, unless the port entry does.
+	Name string `json:"name,omitempty"`
+	// ExpiresIn removes the mappings after the given duration, e.g. "30m". Empty keeps them until they are removed.
+	ExpiresIn string `json:"expiresIn,omitempty"`
+}
+
+// DriftEvent is a mapping that drifted on the gateway and was forwarded again.
+type DriftEvent struct {
+	Mapping Mapping `json:"mapping"`
+	Kind    string  `json:"kind"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// Health reports whether the daemon can reach its gateway. The external IP is only reported to clients sending the API
+// token.
+type Health struct {
+	Status     string `json:"status"`
+	Uptime     string `json:"uptime"`
+	ExternalIP string `json:"externalIP,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Health statuses.
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// parseAddress splits an API address into a network and an address to listen on or dial. Addresses starting with
+// "unix:" or "/" are unix sockets, others are TCP host:port pairs, with an optional "http://" prefix.
+func parseAddress(address string) (network, addr string) {
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		return "unix", strings.TrimPrefix(address, "unix://")
+	case strings.HasPrefix(address, "unix:"):
+		return "unix", strings.TrimPrefix(address, "unix:")
+	case strings.HasPrefix(address, "/"):
+		return "unix", address
+	default:
+		return "tcp", strings.TrimSuffix(strings.TrimPrefix(address, "http://"), "/")
+	}
+}
+
+// IsUnixSocket reports whether an API address is a unix socket.
+func IsUnixSocket(address string) bool {
+	network, _ := parseAddress(address)
+	return network == "unix"
+}
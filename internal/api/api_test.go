@@ -0,0 +1,165 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal"
+	"github.com/IonBazan/gangplank/internal/providers"
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/IonBazan/gangplank/internal/upnp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	g := internal.NewGangplank(nil, upnp.NewDummyClient(upnp.DefaultLeaseDuration), internal.Options{})
+	ts := httptest.NewServer(NewServer(g, "secret").Handler())
+	defer ts.Close()
+	client := NewClient(ts.URL, "secret")
+
+	_, err := NewClient(ts.URL, "wrong").Mappings()
+	assert.ErrorContains(t, err, "401 Unauthorized: missing or invalid API token")
+
+	added, err := client.AddMappings(AddRequest{Port: "8080:80/tcp", Name: "web", ExpiresIn: "1h"})
+	require.NoError(t, err)
+	require.Len(t, added, 1)
+	assert.Equal(t, "web", added[0].Name)
+	assert.Equal(t, providers.RuntimeSource, added[0].Source)
+	assert.True(t, added[0].Forwarded)
+	require.NotNil(t, added[0].ExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *added[0].ExpiresAt, time.Minute)
+
+	_, err = client.AddMappings(AddRequest{Port: "8080:80/tcp", ExpiresIn: "soon"})
+	assert.ErrorContains(t, err, "400 Bad Request: invalid expiry")
+	_, err = client.AddMappings(AddRequest{Port: "http"})
+	assert.ErrorContains(t, err, "400 Bad Request: invalid port mapping")
+
+	mappings, err := client.Mappings()
+	require.NoError(t, err)
+	assert.Equal(t, added, mappings)
+
+	entries, err := client.RouterMappings()
+	require.NoError(t, err)
+	assert.Equal(t, []upnp.PortMappingEntry{
+		{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", InternalIP: "192.168.1.100", Description: "Test Mapping", LeaseDuration: 3600, Enabled: true},
+	}, entries)
+
+	assert.NoError(t, client.Refresh())
+	events, err := client.Reconcile()
+	require.NoError(t, err)
+	assert.Empty(t, events, "the dummy gateway lists the mapping")
+
+	web := types.PortMapping{ExternalPort: 8080, Protocol: "tcp"}
+	assert.NoError(t, client.DeleteMapping(web))
+	assert.ErrorContains(t, client.DeleteMapping(web), "404 Not Found: no runtime port mapping 8080/TCP")
+
+	mappings, err = client.Mappings()
+	require.NoError(t, err)
+	assert.Empty(t, mappings)
+}
+
+func TestServer_Health(t *testing.T) {
+	tests := []struct {
+		name       string
+		client     *upnp.Client
+		token      string
+		wantCode   int
+		wantHealth Health
+	}{
+		{
+			name:       "Gateway reachable",
+			client:     upnp.NewDummyClient(upnp.DefaultLeaseDuration),
+			token:      "secret",
+			wantCode:   http.StatusOK,
+			wantHealth: Health{Status: StatusOK, Uptime: "0s", ExternalIP: "203.0.113.1"},
+		},
+		{
+			name:       "External IP hidden without the token",
+			client:     upnp.NewDummyClient(upnp.DefaultLeaseDuration),
+			wantCode:   http.StatusOK,
+			wantHealth: Health{Status: StatusOK, Uptime: "0s"},
+		},
+		{
+			name:       "External IP hidden with a wrong token",
+			client:     upnp.NewDummyClient(upnp.DefaultLeaseDuration),
+			token:      "wrong",
+			wantCode:   http.StatusOK,
+			wantHealth: Health{Status: StatusOK, Uptime: "0s"},
+		},
+		{
+			name:       "No gateway",
+			wantCode:   http.StatusServiceUnavailable,
+			wantHealth: Health{Status: StatusUnavailable, Uptime: "0s", Error: "UPnP client is not initialized"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := internal.NewGangplank(nil, tt.client, internal.Options{})
+			ts := httptest.NewServer(NewServer(g, "secret").Handler())
+			defer ts.Close()
+
+			// Health checks do not need the token.
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/healthz", nil)
+			require.NoError(t, err)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			var health Health
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&health))
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+			assert.Equal(t, tt.wantHealth, health)
+		})
+	}
+}
+
+func TestServer_ServeUnixSocket(t *testing.T) {
+	g := internal.NewGangplank(nil, upnp.NewDummyClient(upnp.DefaultLeaseDuration), internal.Options{})
+	socket := "unix://" + filepath.Join(t.TempDir(), "gangplank.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- NewServer(g, "").Serve(ctx, socket) }()
+
+	client := NewClient(socket, "")
+	assert.Eventually(t, func() bool {
+		_, err := client.Mappings()
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.NoError(t, <-served)
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		address     string
+		wantNetwork string
+		wantAddr    string
+	}{
+		{address: "unix:///run/gangplank.sock", wantNetwork: "unix", wantAddr: "/run/gangplank.sock"},
+		{address: "unix:gangplank.sock", wantNetwork: "unix", wantAddr: "gangplank.sock"},
+		{address: "/run/gangplank.sock", wantNetwork: "unix", wantAddr: "/run/gangplank.sock"},
+		{address: "127.0.0.1:8089", wantNetwork: "tcp", wantAddr: "127.0.0.1:8089"},
+		{address: "http://nas.local:8089/", wantNetwork: "tcp", wantAddr: "nas.local:8089"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			network, addr := parseAddress(tt.address)
+			assert.Equal(t, tt.wantNetwork, network)
+			assert.Equal(t, tt.wantAddr, addr)
+			assert.Equal(t, tt.wantNetwork == "unix", IsUnixSocket(tt.address))
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/IonBazan/gangplank/internal/upnp"
+)
+
+// clientTimeout bounds every request, including the gateway calls the daemon makes to answer it.
+const clientTimeout = 30 * time.Second
+
+// Client talks to the management API of a running daemon.
+type Client struct {
+	http    *http.Client
+	baseURL string
+	token   string
+}
+
+// NewClient creates a client for the API served on the address, a unix socket or a TCP host:port pair.
+func NewClient(address, token string) *Client {
+	network, addr := parseAddress(address)
+	c := &Client{http: &http.Client{Timeout: clientTimeout}, baseURL: "http://" + addr, token: token}
+	if network == "unix" {
+		c.baseURL = "http://gangplank"
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", addr)
+			},
+		}
+	}
+	return c
+}
+
+// Mappings lists the mappings the daemon keeps forwarded.
+func (c *Client) Mappings() ([]Mapping, error) {
+	var mappings []Mapping
+	return mappings, c.do(http.MethodGet, "/v1/mappings", nil, &mappings)
+}
+
+// AddMappings adds runtime mappings and returns the ones forwarded.
+func (c *Client) AddMappings(request AddRequest) ([]Mapping, error) {
+	var mappings []Mapping
+	return mappings, c.do(http.MethodPost, "/v1/mappings", request, &mappings)
+}
+
+// DeleteMapping removes the runtime mapping of the external port, protocol and remote host of m.
+func (c *Client) DeleteMapping(m types.PortMapping) error {
+	path := "/v1/mappings/" + strconv.Itoa(m.ExternalPort) + "/" + url.PathEscape(m.Protocol)
+	if m.RemoteHost != "" {
+		path += "?remoteHost=" + url.QueryEscape(m.RemoteHost)
+	}
+	return c.do(http.MethodDelete, path, nil, nil)
+}
+
+// RouterMappings lists every port mapping on the gateway of the daemon.
+func (c *Client) RouterMappings() ([]upnp.PortMappingEntry, error) {
+	var entries []upnp.PortMappingEntry
+	return entries, c.do(http.MethodGet, "/v1/router", nil, &entries)
+}
+
+// Refresh asks the daemon to poll its providers and renew every mapping.
+func (c *Client) Refresh() error {
+	return c.do(http.MethodPost, "/v1/refresh", nil, nil)
+}
+
+// Reconcile asks the daemon to restore the mappings that drifted on the gateway.
+func (c *Client) Reconcile() ([]DriftEvent, error) {
+	var events []DriftEvent
+	return events, c.do(http.MethodPost, "/v1/reconcile", nil, &events)
+}
+
+func (c *Client) do(method, path string, body, result any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the Gangplank daemon: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var apiErr errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+			return fmt.Errorf("daemon responded with %s", resp.Status)
+		}
+		return fmt.Errorf("daemon responded with %s: %s", resp.Status, apiErr.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to parse the response of the daemon: %w", err)
+	}
+	return nil
+}
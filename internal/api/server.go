@@ -0,0 +1,237 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal"
+	"github.com/IonBazan/gangplank/internal/providers"
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/IonBazan/gangplank/internal/upnp"
+)
+
+// shutdownTimeout is how long in-flight requests may take once the daemon stops.
+const shutdownTimeout = 5 * time.Second
+
+// Server serves the management API of a running daemon.
+type Server struct {
+	gangplank *internal.Gangplank
+	token     string
+	started   time.Time
+}
+
+// NewServer creates a server managing the given Gangplank instance. Every endpoint but /healthz requires the token as
+// a bearer token, unless it is empty, and /healthz only reports the external IP with the token.
+func NewServer(g *internal.Gangplank, token string) *Server {
+	return &Server{gangplank: g, token: token, started: time.Now()}
+}
+
+// Handler returns the HTTP handler of the API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.health)
+	mux.Handle("GET /v1/mappings", s.authorize(s.listMappings))
+	mux.Handle("POST /v1/mappings", s.authorize(s.addMappings))
+	mux.Handle("DELETE /v1/mappings/{port}/{protocol}", s.authorize(s.deleteMapping))
+	mux.Handle("GET /v1/router", s.authorize(s.listRouter))
+	mux.Handle("POST /v1/refresh", s.authorize(s.refresh))
+	mux.Handle("POST /v1/reconcile", s.authorize(s.reconcile))
+	return mux
+}
+
+// Serve listens on the address, a unix socket or a TCP host:port pair, until the context is done.
+func (s *Server) Serve(ctx context.Context, address string) error {
+	network, addr := parseAddress(address)
+	if network == "unix" {
+		// A socket left behind by a daemon that did not stop cleanly would make listening fail.
+		if info, err := os.Stat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+	if network == "unix" {
+		if err := os.Chmod(addr, 0o660); err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to restrict access to %s: %w", addr, err)
+		}
+	}
+
+	server := &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving the management API on %s", address)
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// authorized reports whether the request carries the bearer token, or no token is required.
+func (s *Server) authorized(r *http.Request) bool {
+	return s.token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.token)) == 1
+}
+
+// authorize rejects requests without the bearer token.
+func (s *Server) authorize(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid API token"))
+			return
+		}
+		handler(w, r)
+	})
+}
+
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	health := Health{Status: StatusOK, Uptime: time.Since(s.started).Round(time.Second).String()}
+	ip, err := s.gangplank.ExternalIP()
+	if err != nil {
+		health.Status = StatusUnavailable
+		health.Error = err.Error()
+		writeJSON(w, http.StatusServiceUnavailable, health)
+		return
+	}
+	// Health checks do not need the token, so the WAN address is only reported to authorized clients.
+	if s.authorized(r) {
+		health.ExternalIP = ip
+	}
+	writeJSON(w, http.StatusOK, health)
+}
+
+func (s *Server) listMappings(w http.ResponseWriter, r *http.Request) {
+	statuses := s.gangplank.Mappings()
+	mappings := make([]Mapping, 0, len(statuses))
+	for _, status := range statuses {
+		mappings = append(mappings, newMapping(status))
+	}
+	writeJSON(w, http.StatusOK, mappings)
+}
+
+func (s *Server) addMappings(w http.ResponseWriter, r *http.Request) {
+	var request AddRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	mappings, err := types.ParsePortMappings(request.Port)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid port mapping %q: %w", request.Port, err))
+		return
+	}
+	var expiresAt time.Time
+	if request.ExpiresIn != "" {
+		expiresIn, err := time.ParseDuration(request.ExpiresIn)
+		if err != nil || expiresIn <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid expiry %q: expected a positive duration like 30m", request.ExpiresIn))
+			return
+		}
+		expiresAt = time.Now().Add(expiresIn)
+	}
+	for i := range mappings {
+		if mappings[i].Name == "" {
+			mappings[i].Name = request.Name
+		}
+	}
+
+	log.Printf("Adding %d runtime port mapping(s) for %s through the API", len(mappings), request.Port)
+	err = s.gangplank.AddRuntimeMappings(mappings, expiresAt)
+
+	// Mappings that lost their port to a source with a higher priority are kept, but neither forwarded nor listed.
+	added := make([]Mapping, 0, len(mappings))
+	for _, status := range s.gangplank.Mappings() {
+		for _, m := range mappings {
+			if status.Source == providers.RuntimeSource && status.Key() == m.Key() {
+				added = append(added, newMapping(status))
+			}
+		}
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, added)
+}
+
+func (s *Server) deleteMapping(w http.ResponseWriter, r *http.Request) {
+	port, err := strconv.Atoi(r.PathValue("port"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid port %q", r.PathValue("port")))
+		return
+	}
+	m := types.PortMapping{ExternalPort: port, Protocol: r.PathValue("protocol"), RemoteHost: r.URL.Query().Get("remoteHost")}
+
+	removed, err := s.gangplank.RemoveRuntimeMapping(m)
+	switch {
+	case !removed:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no runtime port mapping %s", m.Key()))
+	case err != nil:
+		writeError(w, http.StatusBadGateway, err)
+	default:
+		log.Printf("Removed runtime port mapping %s through the API", m.Key())
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) listRouter(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.gangplank.RouterMappings()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	if entries == nil {
+		entries = []upnp.PortMappingEntry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (s *Server) refresh(w http.ResponseWriter, r *http.Request) {
+	s.gangplank.RequestRefresh()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) reconcile(w http.ResponseWriter, r *http.Request) {
+	events, err := s.gangplank.CheckDrift()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	drifted := make([]DriftEvent, 0, len(events))
+	for _, e := range events {
+		event := DriftEvent{Mapping: newMapping(internal.MappingStatus{PortMapping: e.Mapping, Forwarded: e.Err == nil}), Kind: string(e.Kind)}
+		if e.Err != nil {
+			event.Error = e.Err.Error()
+		}
+		drifted = append(drifted, event)
+	}
+	writeJSON(w, http.StatusOK, drifted)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write API response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
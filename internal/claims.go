@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/IonBazan/gangplank/internal/types"
+)
+
+// ClaimRegistry tracks the sources claiming each external port and protocol and decides which one of them is
+// forwarded, since the router only keeps the last mapping written for a port. A claim with a higher priority wins,
+// static mappings win over the others at the same priority, and otherwise the current winner is kept, so that the
+// mapping does not flip between sources. The zero value is ready to use.
+type ClaimRegistry struct {
+	mu      sync.Mutex
+	claims  map[string][]types.PortMapping
+	winners map[string]types.PortMapping
+	// conflicts holds the claimants last reported for each contested port, so that a conflict is only logged once.
+	conflicts map[string]string
+}
+
+// Sync replaces all claims with the given mappings, as reported by a full poll of the providers, and returns the
+// winning mappings in the order they were given.
+func (r *ClaimRegistry) Sync(ports []types.PortMapping) []types.PortMapping {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	claims := map[string][]types.PortMapping{}
+	var keys []string
+	for _, m := range ports {
+		key := m.Key()
+		if _, ok := claims[key]; !ok {
+			keys = append(keys, key)
+		}
+		if !slices.Contains(claims[key], m) {
+			claims[key] = append(claims[key], m)
+		}
+	}
+	r.claims = claims
+
+	winners := map[string]types.PortMapping{}
+	result := make([]types.PortMapping, 0, len(keys))
+	for _, key := range keys {
+		winners[key] = r.elect(key)
+		result = append(result, winners[key])
+	}
+	r.winners = winners
+	for key := range r.conflicts {
+		if len(claims[key]) < 2 {
+			delete(r.conflicts, key)
+		}
+	}
+
+	return result
+}
+
+// Claim adds a claim and reports whether it won its port, i.e. whether it has to be forwarded.
+func (r *ClaimRegistry) Claim(m types.PortMapping) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.claims == nil {
+		r.claims = map[string][]types.PortMapping{}
+		r.winners = map[string]types.PortMapping{}
+	}
+	key := m.Key()
+	if !slices.Contains(r.claims[key], m) {
+		r.claims[key] = append(r.claims[key], m)
+	}
+	r.winners[key] = r.elect(key)
+
+	return r.winners[key] == m
+}
+
+// Release removes a claim. won reports whether the released claim was the one forwarded, in which case next is the
+// claim that takes over the port, if any is left. Releasing a claim that is unknown counts as releasing the winner,
+// unless another claim holds the port.
+func (r *ClaimRegistry) Release(m types.PortMapping) (next types.PortMapping, won, hasNext bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := m.Key()
+	winner, claimed := r.winners[key]
+	if !claimed {
+		return types.PortMapping{}, true, false
+	}
+	if !slices.Contains(r.claims[key], m) {
+		return types.PortMapping{}, false, false
+	}
+	won = winner == m
+
+	r.claims[key] = slices.DeleteFunc(r.claims[key], func(claim types.PortMapping) bool { return claim == m })
+	if len(r.claims[key]) == 0 {
+		delete(r.claims, key)
+		delete(r.winners, key)
+		delete(r.conflicts, key)
+		return types.PortMapping{}, won, false
+	}
+	r.winners[key] = r.elect(key)
+
+	return r.winners[key], won, won
+}
+
+// Winners returns the claims currently forwarded, ordered by their key.
+func (r *ClaimRegistry) Winners() []types.PortMapping {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	winners := make([]types.PortMapping, 0, len(r.winners))
+	for _, m := range r.winners {
+		winners = append(winners, m)
+	}
+	slices.SortFunc(winners, func(a, b types.PortMapping) int { return strings.Compare(a.Key(), b.Key()) })
+	return winners
+}
+
+// elect picks the winner among the claims of a port and logs the conflict if the claimants changed. The caller must
+// hold the lock.
+func (r *ClaimRegistry) elect(key string) types.PortMapping {
+	claims := r.claims[key]
+	winner := claims[0]
+	if current, ok := r.winners[key]; ok && slices.Contains(claims, current) {
+		winner = current
+	}
+	for _, claim := range claims {
+		if outranks(claim, winner) {
+			winner = claim
+		}
+	}
+
+	if len(claims) > 1 {
+		others := make([]string, 0, len(claims)-1)
+		for _, claim := range claims {
+			if claim != winner {
+				others = append(others, claimant(claim))
+			}
+		}
+		summary := fmt.Sprintf("forwarding %s instead of %s", claimant(winner), strings.Join(others, ", "))
+		if r.conflicts == nil {
+			r.conflicts = map[string]string{}
+		}
+		if r.conflicts[key] != summary {
+			r.conflicts[key] = summary
+			log.Printf("Port %s is claimed by %d sources, %s", key, len(claims), summary)
+		}
+	}
+
+	return winner
+}
+
+// outranks reports whether claim a takes the port over from claim b.
+func outranks(a, b types.PortMapping) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.Source != "" && b.Source == ""
+}
+
+// claimant describes the source of a claim for log messages.
+func claimant(m types.PortMapping) string {
+	name := m.Name
+	if name == "" {
+		name = fmt.Sprintf("internal port %d", m.InternalPort)
+	}
+	if m.Source != "" {
+		name += " (" + m.Source + ")"
+	}
+	if m.Priority != 0 {
+		name += fmt.Sprintf(" [priority %d]", m.Priority)
+	}
+	return name
+}
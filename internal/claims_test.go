@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimRegistry_Sync(t *testing.T) {
+	static := types.PortMapping{ExternalPort: 443, InternalPort: 443, Protocol: "TCP", Name: "proxy", Source: "gangplank.yaml"}
+	web := types.PortMapping{ExternalPort: 443, InternalPort: 8443, Protocol: "TCP", Name: "web"}
+	api := types.PortMapping{ExternalPort: 443, InternalPort: 9443, Protocol: "TCP", Name: "api"}
+	important := types.PortMapping{ExternalPort: 443, InternalPort: 7443, Protocol: "TCP", Name: "important", Priority: 10}
+	dns := types.PortMapping{ExternalPort: 53, InternalPort: 53, Protocol: "UDP", Name: "dns"}
+	dnsTCP := types.PortMapping{ExternalPort: 53, InternalPort: 53, Protocol: "TCP", Name: "dns"}
+
+	tests := []struct {
+		name  string
+		ports []types.PortMapping
+		want  []types.PortMapping
+	}{
+		{
+			name:  "No conflicts",
+			ports: []types.PortMapping{web, dns, dnsTCP},
+			want:  []types.PortMapping{web, dns, dnsTCP},
+		},
+		{
+			name:  "Static mapping wins over containers",
+			ports: []types.PortMapping{web, dns, static},
+			want:  []types.PortMapping{static, dns},
+		},
+		{
+			name:  "Higher priority wins over static mappings",
+			ports: []types.PortMapping{static, important, web},
+			want:  []types.PortMapping{important},
+		},
+		{
+			name:  "First claim wins a tie",
+			ports: []types.PortMapping{web, api, web},
+			want:  []types.PortMapping{web},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var registry ClaimRegistry
+			assert.Equal(t, tt.want, registry.Sync(tt.ports))
+		})
+	}
+}
+
+func TestClaimRegistry_SyncKeepsWinner(t *testing.T) {
+	web := types.PortMapping{ExternalPort: 443, InternalPort: 8443, Protocol: "TCP", Name: "web"}
+	api := types.PortMapping{ExternalPort: 443, InternalPort: 9443, Protocol: "TCP", Name: "api"}
+
+	var registry ClaimRegistry
+	assert.Equal(t, []types.PortMapping{web}, registry.Sync([]types.PortMapping{web, api}))
+	assert.Equal(t, []types.PortMapping{web}, registry.Sync([]types.PortMapping{api, web}), "tie keeps the current winner")
+	assert.Equal(t, []types.PortMapping{api}, registry.Sync([]types.PortMapping{api}), "gone claims are dropped")
+	assert.Equal(t, []types.PortMapping{api}, registry.Winners())
+}
+
+func TestClaimRegistry_ClaimAndRelease(t *testing.T) {
+	static := types.PortMapping{ExternalPort: 443, InternalPort: 443, Protocol: "TCP", Name: "proxy", Source: "gangplank.yaml"}
+	web := types.PortMapping{ExternalPort: 443, InternalPort: 8443, Protocol: "TCP", Name: "web"}
+	api := types.PortMapping{ExternalPort: 443, InternalPort: 9443, Protocol: "TCP", Name: "api", Priority: 5}
+	unknown := types.PortMapping{ExternalPort: 443, InternalPort: 10443, Protocol: "TCP", Name: "unknown"}
+	dns := types.PortMapping{ExternalPort: 53, InternalPort: 53, Protocol: "UDP", Name: "dns"}
+
+	var registry ClaimRegistry
+	assert.True(t, registry.Claim(web))
+	assert.True(t, registry.Claim(web), "repeated claims are counted once")
+	assert.True(t, registry.Claim(static), "static mapping takes the port over")
+	assert.False(t, registry.Claim(web))
+	assert.True(t, registry.Claim(api), "higher priority takes the port over")
+
+	_, won, _ := registry.Release(unknown)
+	assert.False(t, won, "unknown claim must not delete the winner")
+
+	_, won, hasNext := registry.Release(web)
+	assert.False(t, won)
+	assert.False(t, hasNext)
+
+	next, won, hasNext := registry.Release(api)
+	assert.True(t, won)
+	assert.True(t, hasNext)
+	assert.Equal(t, static, next, "port is handed over to the next claim")
+
+	_, won, hasNext = registry.Release(static)
+	assert.True(t, won)
+	assert.False(t, hasNext, "last claim deletes the port")
+
+	_, won, hasNext = registry.Release(dns)
+	assert.True(t, won, "port that was never claimed is deleted")
+	assert.False(t, hasNext)
+}
@@ -1,20 +1,75 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/spf13/viper"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"time"
 )
 
+// fragmentExtensions are the formats accepted for files in a config directory.
+var fragmentExtensions = []string{".yaml", ".yml", ".json", ".toml"}
+
 type Config struct {
 	Ttl             time.Duration       `mapstructure:"ttl" yaml:"ttl"`
 	Gateway         string              `mapstructure:"gateway" yaml:"gateway"`
 	LocalIP         string              `mapstructure:"localIp" yaml:"localIp"`
 	RefreshInterval time.Duration       `mapstructure:"refreshInterval" yaml:"refreshInterval"`
 	Ports           []types.PortMapping `mapstructure:"ports" yaml:"ports"`
+	Listeners       []ListenerRule      `mapstructure:"listeners" yaml:"listeners"`
+	// Include lists glob patterns of fragment files whose ports are merged into this config.
+	// Relative patterns are resolved against the directory of the config file.
+	Include []string `mapstructure:"include" yaml:"include"`
+
+	// Path is the file the configuration was loaded from.
+	Path string `mapstructure:"-" yaml:"-"`
+	// Fragments lists the fragment files the ports were merged from, in load order.
+	Fragments []string `mapstructure:"-" yaml:"-"`
+
+	patterns []string
 }
 
-func LoadConfig(configPath string) (*Config, error) {
+// fragment is the subset of the configuration a fragment file may define.
+type fragment struct {
+	Ports []types.PortMapping `mapstructure:"ports" yaml:"ports"`
+}
+
+// decodeHook extends viper's default hooks so that port mappings can also be written as port entries, e.g.
+// "443:443/tcp;name=https", which behave exactly like the gangplank.forward label.
+var decodeHook = viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+	mapstructure.StringToTimeDurationHookFunc(),
+	mapstructure.StringToSliceHookFunc(","),
+	portEntryHook,
+))
+
+func portEntryHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() != reflect.String || to != reflect.TypeOf(types.PortMapping{}) {
+		return data, nil
+	}
+	return types.ParsePortMapping(data.(string))
+}
+
+// ListenerRule allows a host socket to be forwarded while it is listening.
+// Every criterion that is set must match; Port and Protocol narrow down which sockets of a matching process are used.
+type ListenerRule struct {
+	Name         string `mapstructure:"name" yaml:"name"`
+	Process      string `mapstructure:"process" yaml:"process"`
+	Unit         string `mapstructure:"unit" yaml:"unit"`
+	Port         int    `mapstructure:"port" yaml:"port"`
+	Protocol     string `mapstructure:"protocol" yaml:"protocol"`
+	ExternalPort int    `mapstructure:"externalPort" yaml:"externalPort"`
+}
+
+// LoadConfig reads the config file and merges the ports of every fragment matched by its include patterns and
+// of every YAML, JSON or TOML file in configDir. If configDir is set, the config file itself is optional.
+func LoadConfig(configPath, configDir string) (*Config, error) {
 	v := viper.New()
 
 	if configPath != "" {
@@ -26,14 +81,147 @@ func LoadConfig(configPath string) (*Config, error) {
 		v.AddConfigPath(".")
 	}
 
+	var config Config
 	if err := v.ReadInConfig(); err != nil {
-		return nil, err
+		var notFound viper.ConfigFileNotFoundError
+		if configDir == "" || configPath != "" || !errors.As(err, &notFound) {
+			return nil, err
+		}
+	} else {
+		if err := v.Unmarshal(&config, decodeHook); err != nil {
+			return nil, err
+		}
+		config.Path = v.ConfigFileUsed()
+		config.patterns = append(config.patterns, config.Path)
+		setSource(config.Ports, config.Path)
 	}
 
-	var config Config
-	if err := v.Unmarshal(&config); err != nil {
-		return nil, err
+	for _, pattern := range config.Include {
+		if !filepath.IsAbs(pattern) && config.Path != "" {
+			pattern = filepath.Join(filepath.Dir(config.Path), pattern)
+		}
+		config.patterns = append(config.patterns, pattern)
+		if err := config.mergeFragments(pattern); err != nil {
+			return nil, err
+		}
+	}
+	if configDir != "" {
+		pattern := filepath.Join(configDir, "*")
+		config.patterns = append(config.patterns, pattern)
+		if err := config.mergeFragments(pattern); err != nil {
+			return nil, err
+		}
 	}
 
 	return &config, nil
 }
+
+// WatchPatterns returns the config file and fragment glob patterns the configuration depends on.
+func (c *Config) WatchPatterns() []string {
+	return c.patterns
+}
+
+func (c *Config) mergeFragments(pattern string) error {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid include pattern %q: %v", pattern, err)
+	}
+
+	// Glob returns matches in lexical order, so fragments are merged deterministically.
+	for _, path := range matches {
+		if !slices.Contains(fragmentExtensions, strings.ToLower(filepath.Ext(path))) {
+			continue
+		}
+		if info, err := os.Stat(path); err != nil || info.IsDir() || path == c.Path || slices.Contains(c.Fragments, path) {
+			continue
+		}
+
+		v := viper.New()
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return fmt.Errorf("failed to read config fragment %s: %v", path, err)
+		}
+		var f fragment
+		if err := v.Unmarshal(&f, decodeHook); err != nil {
+			return fmt.Errorf("failed to parse config fragment %s: %v", path, err)
+		}
+
+		setSource(f.Ports, path)
+		c.Ports = append(c.Ports, f.Ports...)
+		c.Fragments = append(c.Fragments, path)
+	}
+
+	return nil
+}
+
+func setSource(ports []types.PortMapping, source string) {
+	for i := range ports {
+		ports[i].Source = source
+	}
+}
+
+// Validate checks the static port mappings and makes sure no external port/protocol is defined twice.
+func (c *Config) Validate() error {
+	defined := map[string]types.PortMapping{}
+	for i, p := range c.Ports {
+		if err := p.Validate(); err != nil {
+			if p.Source != "" {
+				return fmt.Errorf("invalid port mapping at index %d in %s: %v", i, p.Source, err)
+			}
+			return fmt.Errorf("invalid port mapping at index %d: %v", i, err)
+		}
+
+		// Validate succeeded, so the range is known to expand.
+		expanded, _ := p.Expand()
+		for _, single := range expanded {
+			key := single.Key()
+			if first, ok := defined[key]; ok {
+				return fmt.Errorf("duplicate port mapping %s: defined in %s and %s", key, describeSource(first), describeSource(p))
+			}
+			defined[key] = p
+		}
+	}
+
+	for i, rule := range c.Listeners {
+		if err := rule.validate(); err != nil {
+			if c.Path != "" {
+				return fmt.Errorf("invalid listener rule at index %d in %s: %v", i, c.Path, err)
+			}
+			return fmt.Errorf("invalid listener rule at index %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (r ListenerRule) validate() error {
+	// Listeners are an allowlist: a rule without any of these would forward every socket on the host.
+	if r.Process == "" && r.Unit == "" && r.Port == 0 {
+		return errors.New("listener rule must set process, unit or port")
+	}
+	// The external port of a rule matching several sockets would be claimed by all of them.
+	if r.ExternalPort != 0 && r.Port == 0 {
+		return errors.New("externalPort requires port")
+	}
+	return nil
+}
+
+// PortMappings validates the configured ports and returns them with port ranges expanded into single ports.
+func (c *Config) PortMappings() ([]types.PortMapping, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return types.ExpandPortMappings(c.Ports)
+}
+
+func describeSource(p types.PortMapping) string {
+	source := p.Source
+	if source == "" {
+		source = "config"
+	}
+	if p.Name != "" {
+		return fmt.Sprintf("%s (%s)", source, p.Name)
+	}
+	return source
+}
@@ -0,0 +1,275 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`ttl: 30m
+ports:
+  - externalPort: 8080
+    internalPort: 80
+    protocol: TCP
+    name: web
+`), 0o644))
+
+	cfg, err := LoadConfig(path, "")
+	require.NoError(t, err)
+	assert.Equal(t, path, cfg.Path)
+	assert.Equal(t, 30*time.Minute, cfg.Ttl)
+	assert.Equal(t, []types.PortMapping{{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web", Source: path}}, cfg.Ports)
+	assert.Equal(t, []string{path}, cfg.WatchPatterns())
+}
+
+func TestLoadConfig_MappingOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`ports:
+  - externalPort: 25565
+    internalPort: 25565
+    protocol: TCP
+    ttl: 2h
+    description: Minecraft for friends
+  - externalPort: 8080
+    internalPort: 80
+    protocol: TCP
+    enabled: false
+`), 0o644))
+
+	cfg, err := LoadConfig(path, "")
+	require.NoError(t, err)
+	require.Len(t, cfg.Ports, 2)
+	assert.False(t, cfg.Ports[1].IsEnabled())
+
+	mappings, err := cfg.PortMappings()
+	require.NoError(t, err)
+	assert.Equal(t, []types.PortMapping{
+		{ExternalPort: 25565, InternalPort: 25565, Protocol: "TCP", TTL: 2 * time.Hour, Description: "Minecraft for friends", Source: path},
+	}, mappings)
+}
+
+func TestLoadConfig_PortEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`ports:
+  - "443:443/tcp;name=https;ttl=2h"
+  - 27015-27016/udp;name=game
+  - externalPort: 8080
+    internalPort: 80
+    protocol: TCP
+`), 0o644))
+
+	cfg, err := LoadConfig(path, "")
+	require.NoError(t, err)
+	mappings, err := cfg.PortMappings()
+	require.NoError(t, err)
+	assert.Equal(t, []types.PortMapping{
+		{ExternalPort: 443, InternalPort: 443, Protocol: "TCP", Name: "https", TTL: 2 * time.Hour, Source: path},
+		{ExternalPort: 27015, InternalPort: 27015, Protocol: "UDP", Name: "game", Source: path},
+		{ExternalPort: 27016, InternalPort: 27016, Protocol: "UDP", Name: "game", Source: path},
+		{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Source: path},
+	}, mappings)
+
+	require.NoError(t, os.WriteFile(path, []byte("ports:\n  - 443;color=blue\n"), 0o644))
+	_, err = LoadConfig(path, "")
+	assert.ErrorContains(t, err, `Unknown option "color"`)
+}
+
+func TestLoadConfig_Fragments(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "teams"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "conf.d"), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte(`include:
+  - teams/*.yaml
+ports:
+  - externalPort: 8080
+    internalPort: 80
+    protocol: TCP
+    name: web
+`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "teams", "games.yaml"), []byte(`ports:
+  - externalPort: 25565
+    internalPort: 25565
+    protocol: TCP
+    name: minecraft
+`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "conf.d", "dns.json"), []byte(`{"ports": [{"externalPort": 53, "internalPort": 53, "protocol": "UDP", "name": "dns"}]}`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "conf.d", "voip.toml"), []byte(`[[ports]]
+externalPort = 5060
+internalPort = 5060
+protocol = "UDP"
+name = "sip"
+`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "conf.d", "README.md"), []byte("not a fragment"), 0o644))
+
+	cfg, err := LoadConfig(path, filepath.Join(dir, "conf.d"))
+	require.NoError(t, err)
+	assert.NoError(t, cfg.Validate())
+	assert.Equal(t, []types.PortMapping{
+		{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web", Source: path},
+		{ExternalPort: 25565, InternalPort: 25565, Protocol: "TCP", Name: "minecraft", Source: filepath.Join(dir, "teams", "games.yaml")},
+		{ExternalPort: 53, InternalPort: 53, Protocol: "UDP", Name: "dns", Source: filepath.Join(dir, "conf.d", "dns.json")},
+		{ExternalPort: 5060, InternalPort: 5060, Protocol: "UDP", Name: "sip", Source: filepath.Join(dir, "conf.d", "voip.toml")},
+	}, cfg.Ports)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "teams", "games.yaml"),
+		filepath.Join(dir, "conf.d", "dns.json"),
+		filepath.Join(dir, "conf.d", "voip.toml"),
+	}, cfg.Fragments)
+
+	// The config file is optional when a config directory is used.
+	cfg, err = LoadConfig("", filepath.Join(dir, "conf.d"))
+	require.NoError(t, err)
+	assert.Empty(t, cfg.Path)
+	assert.Len(t, cfg.Ports, 2)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "conf.d", "broken.yaml"), []byte("ports: [\n"), 0o644))
+	_, err = LoadConfig(path, filepath.Join(dir, "conf.d"))
+	assert.ErrorContains(t, err, "broken.yaml")
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      Config
+		errContains string
+	}{
+		{
+			name:   "Valid ports",
+			config: Config{Ports: []types.PortMapping{{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP"}}},
+		},
+		{
+			name: "Duplicate port in another fragment",
+			config: Config{Ports: []types.PortMapping{
+				{ExternalPort: 443, InternalPort: 443, Protocol: "TCP", Name: "proxy", Source: "conf.d/web.yaml"},
+				{ExternalPort: 53, InternalPort: 53, Protocol: "TCP", Source: "conf.d/dns.yaml"},
+				{ExternalPort: 443, InternalPort: 8443, Protocol: "tcp", Name: "admin", Source: "conf.d/admin.yaml"},
+			}},
+			errContains: "duplicate port mapping 443/TCP: defined in conf.d/web.yaml (proxy) and conf.d/admin.yaml (admin)",
+		},
+		{
+			name: "Same port with different protocols",
+			config: Config{Ports: []types.PortMapping{
+				{ExternalPort: 53, InternalPort: 53, Protocol: "TCP"},
+				{ExternalPort: 53, InternalPort: 53, Protocol: "UDP"},
+			}},
+		},
+		{
+			name: "Port overlapping a range",
+			config: Config{Ports: []types.PortMapping{
+				{ExternalPort: 27015, ExternalPortEnd: 27030, InternalPort: 27015, Protocol: "UDP", Name: "game"},
+				{ExternalPort: 27020, InternalPort: 27020, Protocol: "UDP", Name: "rcon"},
+			}},
+			errContains: "duplicate port mapping 27020/UDP: defined in config (game) and config (rcon)",
+		},
+		{
+			name: "Both protocols overlapping a single protocol",
+			config: Config{Ports: []types.PortMapping{
+				{ExternalPort: 53, InternalPort: 53, Protocol: "both", Name: "dns"},
+				{ExternalPort: 53, InternalPort: 5353, Protocol: "UDP", Name: "mdns"},
+			}},
+			errContains: "duplicate port mapping 53/UDP: defined in config (dns) and config (mdns)",
+		},
+		{
+			name: "Same port for different remote hosts",
+			config: Config{Ports: []types.PortMapping{
+				{ExternalPort: 8443, InternalPort: 443, Protocol: "TCP", RemoteHost: "203.0.113.10"},
+				{ExternalPort: 8443, InternalPort: 443, Protocol: "TCP", RemoteHost: "203.0.113.11"},
+			}},
+		},
+		{
+			name: "Invalid second port",
+			config: Config{Ports: []types.PortMapping{
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP"},
+				{ExternalPort: 8081, InternalPort: 80, Protocol: "SCTP"},
+			}},
+			errContains: "invalid port mapping at index 1",
+		},
+		{
+			name: "Listener rule with an external port",
+			config: Config{Listeners: []ListenerRule{
+				{Name: "ssh", Unit: "ssh.service", Port: 22, ExternalPort: 2222},
+			}},
+		},
+		{
+			name: "Listener rule with an external port but no port",
+			config: Config{Path: "/etc/gangplank/config.yaml", Listeners: []ListenerRule{
+				{Name: "plex", Process: "Plex Media Server"},
+				{Name: "ssh", Unit: "ssh.service", ExternalPort: 2222},
+			}},
+			errContains: "invalid listener rule at index 1 in /etc/gangplank/config.yaml: externalPort requires port",
+		},
+		{
+			name:        "Listener rule with only a name",
+			config:      Config{Listeners: []ListenerRule{{Name: "foo"}}},
+			errContains: "invalid listener rule at index 0: listener rule must set process, unit or port",
+		},
+		{
+			name: "Listener rule with only a protocol",
+			config: Config{Path: "/etc/gangplank/config.yaml", Listeners: []ListenerRule{
+				{Name: "plex", Process: "Plex Media Server"},
+				{Protocol: "udp"},
+			}},
+			errContains: "invalid listener rule at index 1 in /etc/gangplank/config.yaml: listener rule must set process, unit or port",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.errContains != "" {
+				assert.ErrorContains(t, err, tt.errContains)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("ttl: 30m\n"), 0o644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "conf.d"), 0o755))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := make(chan struct{}, 10)
+	require.NoError(t, Watch(ctx, []string{path, filepath.Join(dir, "conf.d", "*")}, func() { changes <- struct{}{} }))
+
+	// Unrelated files and rewrites with the same content are ignored.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other.yaml"), []byte("ttl: 1m\n"), 0o644))
+	require.NoError(t, os.WriteFile(path, []byte("ttl: 30m\n"), 0o644))
+	select {
+	case <-changes:
+		t.Fatal("unexpected change notification")
+	case <-time.After(2 * watchDebounce):
+	}
+
+	// Atomic replacement, as done by most editors.
+	tmp := filepath.Join(dir, "config.yaml.tmp")
+	require.NoError(t, os.WriteFile(tmp, []byte("ttl: 45m\n"), 0o644))
+	require.NoError(t, os.Rename(tmp, path))
+	select {
+	case <-changes:
+	case <-time.After(4 * watchDebounce):
+		t.Fatal("timed out waiting for change notification")
+	}
+
+	// New fragment in a watched directory.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "conf.d", "games.yaml"), []byte("ports: []\n"), 0o644))
+	select {
+	case <-changes:
+	case <-time.After(4 * watchDebounce):
+		t.Fatal("timed out waiting for change notification")
+	}
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce groups the bursts of events editors and config management tools produce when saving a file.
+const watchDebounce = 500 * time.Millisecond
+
+// Watch calls onChange whenever the files matched by the given paths or glob patterns are changed, added or removed,
+// until ctx is cancelled. Parent directories are watched rather than the files themselves, so atomic replacements
+// (rename over the file, or Kubernetes ConfigMap symlink swaps) are detected too.
+func Watch(ctx context.Context, patterns []string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	dirs := map[string]bool{}
+	for _, pattern := range patterns {
+		dir := filepath.Dir(pattern)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if err := watcher.Add(dir); err != nil {
+			// Include patterns may point at directories that do not exist (yet).
+			if os.IsNotExist(err) {
+				log.Printf("Not watching %s for config changes: directory does not exist", dir)
+				continue
+			}
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		last := snapshot(patterns)
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Error watching config files: %v", err)
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				debounce = time.After(watchDebounce)
+			case <-debounce:
+				current := snapshot(patterns)
+				if bytes.Equal(current, last) {
+					continue
+				}
+				last = current
+				onChange()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// snapshot captures the names and contents of the watched files, so that only actual changes trigger a reload.
+func snapshot(patterns []string) []byte {
+	var buf bytes.Buffer
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			buf.WriteString(path)
+			buf.WriteByte(0)
+			buf.Write(content)
+			buf.WriteByte(0)
+		}
+	}
+	return buf.Bytes()
+}
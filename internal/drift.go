@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/IonBazan/gangplank/internal/upnp"
+)
+
+// DriftKind tells how a mapping drifted on the gateway.
+type DriftKind string
+
+const (
+	// DriftMissing means the gateway lost the mapping, e.g. after a reboot or when it was deleted in its admin UI.
+	DriftMissing DriftKind = "missing"
+	// DriftModified means the gateway entry forwards somewhere else or was disabled.
+	DriftModified DriftKind = "modified"
+)
+
+// DriftEvent reports a mapping that drifted on the gateway and whether it could be restored.
+type DriftEvent struct {
+	Mapping types.PortMapping
+	Kind    DriftKind
+	// Err is the error restoring the mapping, if any.
+	Err error
+}
+
+// CheckDrift compares the mappings this instance forwarded with the gateway entries and forwards again the ones that
+// went missing or were changed out-of-band. Mappings that lost their port to another claim are left alone.
+func (g *Gangplank) CheckDrift() ([]DriftEvent, error) {
+	if g.upnpClient == nil {
+		return nil, nil
+	}
+
+	created := map[string]bool{}
+	for _, m := range g.upnpClient.Created() {
+		created[m.Key()] = true
+	}
+	var mappings []types.PortMapping
+	for _, m := range g.claims.Winners() {
+		if created[m.Key()] {
+			mappings = append(mappings, m)
+		}
+	}
+	if len(mappings) == 0 {
+		return nil, nil
+	}
+
+	results, err := g.upnpClient.VerifyMappings(mappings)
+	if err != nil {
+		return nil, err
+	}
+	var events []DriftEvent
+	for i, m := range mappings {
+		var kind DriftKind
+		switch {
+		case errors.Is(results[i], upnp.ErrMappingMissing):
+			kind = DriftMissing
+		case errors.Is(results[i], upnp.ErrMappingModified):
+			kind = DriftModified
+		default:
+			continue
+		}
+		events = append(events, DriftEvent{Mapping: m, Kind: kind, Err: g.ForwardPorts([]types.PortMapping{m})})
+	}
+	return events, nil
+}
+
+// WatchDrift checks the gateway for drifted mappings at the given interval until the context is done.
+func (g *Gangplank) WatchDrift(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		events, err := g.CheckDrift()
+		if err != nil {
+			log.Printf("Failed to check port mappings on the gateway: %v", err)
+			continue
+		}
+		for _, e := range events {
+			if e.Err != nil {
+				log.Printf("Failed to restore %s port mapping %d/%s for %s: %v", e.Kind, e.Mapping.ExternalPort, e.Mapping.Protocol, e.Mapping.Name, e.Err)
+			} else {
+				log.Printf("Restored %s port mapping %d/%s for %s", e.Kind, e.Mapping.ExternalPort, e.Mapping.Protocol, e.Mapping.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/IonBazan/gangplank/internal/upnp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGangplank_CheckDrift(t *testing.T) {
+	web := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web"}
+	game := types.PortMapping{ExternalPort: 25565, InternalPort: 25565, Protocol: "TCP", Name: "minecraft"}
+	ssh := types.PortMapping{ExternalPort: 2222, InternalPort: 22, Protocol: "TCP", Name: "ssh"}
+
+	connection := &leaseConnection{}
+	g := &Gangplank{upnpClient: upnp.NewClientWithConnection(connection, "192.168.1.100", upnp.DefaultLeaseDuration)}
+	g.claims.Sync([]types.PortMapping{web, game, ssh})
+	require.NoError(t, g.ForwardPorts([]types.PortMapping{web, game}))
+
+	events, err := g.CheckDrift()
+	require.NoError(t, err)
+	assert.Empty(t, events, "mappings in place did not drift")
+
+	// The router lost the game mapping and someone pointed the web mapping at another port.
+	connection.Forwarded = []types.PortMapping{{ExternalPort: 8080, InternalPort: 8000, Protocol: "TCP"}}
+
+	events, err = g.CheckDrift()
+	require.NoError(t, err)
+	assert.Equal(t, []DriftEvent{
+		{Mapping: game, Kind: DriftMissing},
+		{Mapping: web, Kind: DriftModified},
+	}, events, "ssh is not checked since this instance did not forward it")
+	assert.Len(t, connection.Forwarded, 3, "drifted mappings are forwarded again")
+
+	events, err = (&Gangplank{}).CheckDrift()
+	assert.NoError(t, err)
+	assert.Empty(t, events, "no gateway to check")
+}
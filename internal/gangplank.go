@@ -2,6 +2,7 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/IonBazan/gangplank/internal/config"
 	"github.com/IonBazan/gangplank/internal/providers"
@@ -9,47 +10,134 @@ import (
 	"github.com/IonBazan/gangplank/internal/upnp"
 	"github.com/docker/docker/client"
 	"log"
+	"slices"
+	"sync"
+	"time"
 )
 
+// Options selects the sources Gangplank reads port mappings from.
+type Options struct {
+	Docker               bool
+	ContainerdAddress    string
+	ContainerdNamespace  string
+	NomadAddress         string
+	NomadToken           string
+	ProcRoot             string
+	ListenerPollInterval time.Duration
+	// Containers selects the Docker containers to forward.
+	Containers providers.ContainerSelector
+	// ClosePaused removes the mappings of paused Docker containers until they are unpaused.
+	ClosePaused bool
+	// FixedTTL keeps the lease duration set with --ttl when a reloaded config file changes its ttl.
+	FixedTTL bool
+}
+
+// errNoGateway is returned by the methods that need a UPnP gateway when the client could not be initialized.
+var errNoGateway = errors.New("UPnP client is not initialized")
+
 type Gangplank struct {
 	PortProviders      []providers.PortProvider
 	EventPortProviders []providers.EventPortProvider
 	upnpClient         *upnp.Client
+	configProvider     *providers.CofingPortProvider
+	runtimeProvider    *providers.RuntimePortProvider
+	listenerProvider   *providers.ListenerPortProvider
+	fixedTTL           bool
+	claims             ClaimRegistry
+	// lastPorts holds the mappings each provider last reported, used while it fails.
+	lastPorts   map[providers.PortProvider][]types.PortMapping
+	lastPortsMu sync.Mutex
+	// refreshRequests wakes RefreshPorts up to renew every mapping right away.
+	refreshRequests chan struct{}
 }
 
-func NewGangplank(cfg *config.Config, upnpClient *upnp.Client) *Gangplank {
-	dockerCli, err := client.NewClientWithOpts(client.WithAPIVersionNegotiation())
-	if err != nil {
-		log.Fatalf("Failed to create Docker client: %v", err)
+func NewGangplank(cfg *config.Config, upnpClient *upnp.Client, opts Options) *Gangplank {
+	configProvider := providers.NewConfigPortProvider(cfg)
+	runtimeProvider := providers.NewRuntimePortProvider()
+	g := &Gangplank{
+		PortProviders:   []providers.PortProvider{configProvider, runtimeProvider},
+		upnpClient:      upnpClient,
+		configProvider:  configProvider,
+		runtimeProvider: runtimeProvider,
+		fixedTTL:        opts.FixedTTL,
+		refreshRequests: make(chan struct{}, 1),
+	}
+
+	if opts.Docker {
+		dockerCli, err := client.NewClientWithOpts(client.WithAPIVersionNegotiation())
+		if err != nil {
+			log.Fatalf("Failed to create Docker client: %v", err)
+		}
+
+		log.Printf("Connected to Docker daemon via %s (forwarding policy: %s)", dockerCli.DaemonHost(), opts.Containers.Policy)
+
+		g.PortProviders = append(g.PortProviders, providers.NewDockerPortProvider(dockerCli, opts.Containers))
+		g.EventPortProviders = append(g.EventPortProviders, providers.NewDockerEventPortProvider(dockerCli, opts.Containers, opts.ClosePaused))
+	}
+
+	if opts.ContainerdAddress != "" {
+		conn, err := providers.NewContainerdConnection(opts.ContainerdAddress)
+		if err != nil {
+			log.Fatalf("Failed to create containerd client: %v", err)
+		}
+
+		log.Printf("Connected to containerd via %s (namespace: %s)", opts.ContainerdAddress, opts.ContainerdNamespace)
+
+		containerdProvider := providers.NewContainerdPortProvider(conn, opts.ContainerdNamespace)
+		g.PortProviders = append(g.PortProviders, containerdProvider)
+		g.EventPortProviders = append(g.EventPortProviders, containerdProvider)
 	}
 
-	log.Printf("Connected to Docker daemon via %s", dockerCli.DaemonHost())
+	if opts.NomadAddress != "" {
+		log.Printf("Watching Nomad allocations via %s", opts.NomadAddress)
 
-	return &Gangplank{
-		PortProviders: []providers.PortProvider{
-			providers.NewConfigPortProvider(cfg),
-			providers.NewDockerPortProvider(dockerCli),
-		},
-		EventPortProviders: []providers.EventPortProvider{
-			providers.NewDockerEventPortProvider(dockerCli),
-		},
-		upnpClient: upnpClient,
+		nomadProvider := providers.NewNomadPortProvider(opts.NomadAddress, opts.NomadToken)
+		g.PortProviders = append(g.PortProviders, nomadProvider)
+		g.EventPortProviders = append(g.EventPortProviders, nomadProvider)
 	}
+
+	if cfg != nil && len(cfg.Listeners) > 0 {
+		log.Printf("Watching %d host listener rule(s) in %s", len(cfg.Listeners), opts.ProcRoot)
+
+		g.listenerProvider = providers.NewListenerPortProvider(opts.ProcRoot, cfg.Listeners, opts.ListenerPollInterval)
+		g.PortProviders = append(g.PortProviders, g.listenerProvider)
+		g.EventPortProviders = append(g.EventPortProviders, g.listenerProvider)
+	}
+
+	return g
 }
 
+// GetPortMappings returns the mappings of every provider. A provider that fails does not block the others: the
+// mappings it reported last, if any, are used in its place and its error is returned along with the mappings.
 func (g *Gangplank) GetPortMappings() ([]types.PortMapping, error) {
 	log.Println("Fetching port mappings...")
+	g.lastPortsMu.Lock()
+	defer g.lastPortsMu.Unlock()
+	if g.lastPorts == nil {
+		g.lastPorts = map[providers.PortProvider][]types.PortMapping{}
+	}
+
 	allPorts := []types.PortMapping{}
+	var errs []error
 	for _, portProvider := range g.PortProviders {
 		ports, err := portProvider.GetPortMappings()
 		if err != nil {
-			log.Printf("Error occurred: %s", err)
-			return nil, err
+			ports = g.lastPorts[portProvider]
+			log.Printf("Error occurred: %s, using %d previously fetched port mappings", err, len(ports))
+			errs = append(errs, err)
+		} else {
+			g.lastPorts[portProvider] = ports
 		}
 		allPorts = append(allPorts, ports...)
 	}
 	log.Printf("Fetched %d port mappings", len(allPorts))
-	return allPorts, nil
+	return allPorts, errors.Join(errs...)
+}
+
+// ResolveClaims registers the mappings reported by a full poll of the providers and returns the ones to forward, one
+// per external port and protocol.
+func (g *Gangplank) ResolveClaims(ports []types.PortMapping) []types.PortMapping {
+	return g.claims.Sync(ports)
 }
 
 func (g *Gangplank) ForwardPorts(ports []types.PortMapping) error {
@@ -61,32 +149,333 @@ func (g *Gangplank) ForwardPorts(ports []types.PortMapping) error {
 	return g.upnpClient.ForwardPorts(ports)
 }
 
+// ReloadConfig switches to a new configuration. Static mappings that were added or changed are forwarded and the
+// removed ones are deleted from the gateway, or handed over to the next source claiming their port, while mappings
+// from other providers are left untouched.
+func (g *Gangplank) ReloadConfig(cfg *config.Config) error {
+	newPorts, err := cfg.PortMappings()
+	if err != nil {
+		return err
+	}
+	if g.configProvider == nil {
+		return fmt.Errorf("static port mappings are not enabled")
+	}
+
+	var oldPorts []types.PortMapping
+	var oldListeners []config.ListenerRule
+	oldTtl := time.Duration(0)
+	if old := g.configProvider.Config(); old != nil {
+		// The previous config was validated when it was loaded.
+		oldPorts, _ = types.ExpandPortMappings(old.Ports)
+		oldListeners = old.Listeners
+		oldTtl = old.Ttl
+	}
+	g.configProvider.SetConfig(cfg)
+	g.reloadListeners(oldListeners, cfg.Listeners)
+
+	added, removed := diffPortMappings(oldPorts, newPorts)
+	log.Printf("Reloaded config: %d static port mapping(s) added or changed, %d removed", len(added), len(removed))
+
+	// Changed mappings replace their old claim.
+	oldByKey := map[string]types.PortMapping{}
+	for _, m := range oldPorts {
+		oldByKey[m.Key()] = m
+	}
+	var forward, remove []types.PortMapping
+	for _, m := range added {
+		if old, ok := oldByKey[m.Key()]; ok {
+			g.claims.Release(old)
+		}
+		if g.claims.Claim(m) {
+			forward = append(forward, m)
+		}
+	}
+	for _, m := range removed {
+		next, won, hasNext := g.claims.Release(m)
+		switch {
+		case hasNext:
+			forward = append(forward, next)
+		case won:
+			remove = append(remove, m)
+		}
+	}
+
+	if g.upnpClient == nil {
+		return nil
+	}
+
+	if cfg.Ttl > 0 && cfg.Ttl != oldTtl {
+		if g.fixedTTL {
+			log.Printf("Keeping the UPnP lease duration set with --ttl instead of %s from the config", cfg.Ttl)
+		} else {
+			log.Printf("Changing UPnP lease duration to %s", cfg.Ttl)
+			g.upnpClient.SetLeaseDuration(cfg.Ttl)
+		}
+	}
+
+	var errs []error
+	for _, m := range remove {
+		if err := g.upnpClient.DeleteMapping(m); err != nil {
+			log.Printf("Failed to delete port mapping %d/%s for %s: %v", m.ExternalPort, m.Protocol, m.Name, err)
+			errs = append(errs, err)
+		} else {
+			log.Printf("Deleted port mapping %d/%s for %s", m.ExternalPort, m.Protocol, m.Name)
+		}
+	}
+	if err := g.upnpClient.ForwardPorts(forward); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// reloadListeners hands changed listener rules over to the listener provider, which applies them on its next poll.
+// The provider is only started with the daemon, so rules added to a config that had none need a restart.
+func (g *Gangplank) reloadListeners(oldRules, newRules []config.ListenerRule) {
+	if slices.Equal(oldRules, newRules) {
+		return
+	}
+	if g.listenerProvider == nil {
+		log.Printf("Listener rules changed, restart Gangplank to watch host listeners")
+		return
+	}
+	log.Printf("Reloaded config: watching %d host listener rule(s)", len(newRules))
+	g.listenerProvider.SetRules(newRules)
+}
+
+// diffPortMappings compares two sets of mappings keyed by remote host, external port and protocol.
+// Mappings whose other fields changed are reported as added, since forwarding them again overwrites the old entry.
+func diffPortMappings(oldPorts, newPorts []types.PortMapping) (added, removed []types.PortMapping) {
+	key := types.PortMapping.Key
+	oldByKey := map[string]types.PortMapping{}
+	for _, m := range oldPorts {
+		oldByKey[key(m)] = m
+	}
+	newKeys := map[string]bool{}
+	for _, m := range newPorts {
+		newKeys[key(m)] = true
+		if old, ok := oldByKey[key(m)]; !ok || old != m {
+			added = append(added, m)
+		}
+	}
+	for _, m := range oldPorts {
+		if !newKeys[key(m)] {
+			removed = append(removed, m)
+		}
+	}
+	return added, removed
+}
+
+// PollAndForward forwards the mappings announced by the event providers until the context is cancelled, and returns
+// once every provider stopped listening.
 func (g *Gangplank) PollAndForward(ctx context.Context, cleanup bool) {
 	addCh := make(chan types.PortMapping)
 	deleteCh := make(chan types.PortMapping)
 
+	var listeners sync.WaitGroup
 	for _, provider := range g.EventPortProviders {
-		go provider.Listen(ctx, providers.PortEventChannels{Add: addCh, Delete: deleteCh})
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			provider.Listen(ctx, providers.PortEventChannels{Add: addCh, Delete: deleteCh})
+		}()
 	}
+	stopped := make(chan struct{})
+	go func() {
+		listeners.Wait()
+		close(stopped)
+	}()
 
-	if g.upnpClient != nil && cleanup {
-		go func() {
-			for m := range deleteCh {
-				if err := g.upnpClient.DeletePortMapping(m.ExternalPort, m.Protocol); err != nil {
-					log.Printf("Failed to delete port mapping %d/%s for %s: %v", m.ExternalPort, m.Protocol, m.Name, err)
-				} else {
-					log.Printf("Deleted port mapping %d/%s for %s", m.ExternalPort, m.Protocol, m.Name)
+	// Adds and deletes are handled in the order they were sent, so a container that starts and stops right away does
+	// not end up forwarded. Deletes are drained even without cleanup, so that providers never block on them. A port
+	// claimed by several sources is only forwarded for the winning claim, and handed over to the next claim when the
+	// winner goes away.
+	for {
+		select {
+		case p := <-addCh:
+			fmt.Printf("New Container Port Mapping (Container: %s): External=%d, Internal=%d, Protocol=%s\n", p.Name, p.ExternalPort, p.InternalPort, p.Protocol)
+			if !g.claims.Claim(p) {
+				continue
+			}
+			if g.upnpClient != nil {
+				if err := g.upnpClient.ForwardPorts([]types.PortMapping{p}); err != nil {
+					log.Printf("Error forwarding new port: %v", err)
 				}
 			}
-		}()
+		case m := <-deleteCh:
+			g.release(m, cleanup)
+		case <-ctx.Done():
+			// Providers may be blocked sending an event, so the channels are drained until they all return.
+			for {
+				select {
+				case <-addCh:
+				case <-deleteCh:
+				case <-stopped:
+					return
+				}
+			}
+		}
 	}
+}
 
-	for p := range addCh {
-		fmt.Printf("New Container Port Mapping (Container: %s): External=%d, Internal=%d, Protocol=%s\n", p.Name, p.ExternalPort, p.InternalPort, p.Protocol)
-		if g.upnpClient != nil {
-			if err := g.upnpClient.ForwardPorts([]types.PortMapping{p}); err != nil {
-				log.Printf("Error forwarding new port: %v", err)
-			}
+// release drops the claim of a mapping that went away. If it was forwarded, its port is handed over to the next claim,
+// or the mapping is deleted from the gateway when cleanup is enabled. Errors are logged and returned.
+func (g *Gangplank) release(m types.PortMapping, cleanup bool) error {
+	next, won, hasNext := g.claims.Release(m)
+	if g.upnpClient == nil || !won {
+		return nil
+	}
+	if hasNext {
+		log.Printf("Handing port %s over from %s to %s", m.Key(), claimant(m), claimant(next))
+		if err := g.upnpClient.ForwardPorts([]types.PortMapping{next}); err != nil {
+			log.Printf("Error forwarding port: %v", err)
+			return err
+		}
+		return nil
+	}
+	if !cleanup {
+		return nil
+	}
+	if err := g.upnpClient.DeleteMapping(m); err != nil {
+		log.Printf("Failed to delete port mapping %d/%s for %s: %v", m.ExternalPort, m.Protocol, m.Name, err)
+		return err
+	}
+	log.Printf("Deleted port mapping %d/%s for %s", m.ExternalPort, m.Protocol, m.Name)
+	return nil
+}
+
+// Cleanup deletes every mapping this instance forwarded, giving up once the context is done.
+func (g *Gangplank) Cleanup(ctx context.Context) error {
+	if g.upnpClient == nil {
+		return nil
+	}
+
+	created := g.upnpClient.Created()
+	log.Printf("Deleting %d port mapping(s) created by this instance", len(created))
+	var errs []error
+	for i, m := range created {
+		if err := ctx.Err(); err != nil {
+			return errors.Join(append(errs, fmt.Errorf("%d port mapping(s) left on the gateway: %w", len(created)-i, err))...)
+		}
+		if err := g.upnpClient.DeleteMapping(m); err != nil {
+			log.Printf("Failed to delete port mapping %d/%s for %s: %v", m.ExternalPort, m.Protocol, m.Name, err)
+			errs = append(errs, err)
+		} else {
+			log.Printf("Deleted port mapping %d/%s for %s", m.ExternalPort, m.Protocol, m.Name)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// MappingStatus describes a mapping Gangplank keeps forwarded.
+type MappingStatus struct {
+	types.PortMapping
+	// Forwarded tells whether this instance forwarded the mapping and did not delete it since.
+	Forwarded bool
+	// AssignedPort is the external port the gateway picked for a mapping with an automatic external port.
+	AssignedPort int
+	// ExpiresAt is when a runtime mapping is removed. Zero for other mappings.
+	ExpiresAt time.Time
+}
+
+// Mappings returns the status of the winning claim of every external port, ordered by key.
+func (g *Gangplank) Mappings() []MappingStatus {
+	forwarded := map[string]bool{}
+	if g.upnpClient != nil {
+		for _, m := range g.upnpClient.Created() {
+			forwarded[m.Key()] = true
+		}
+	}
+	expiries := map[string]time.Time{}
+	for _, m := range g.RuntimeMappings() {
+		expiries[m.Key()] = m.ExpiresAt
+	}
+
+	winners := g.claims.Winners()
+	statuses := make([]MappingStatus, 0, len(winners))
+	for _, m := range winners {
+		status := MappingStatus{PortMapping: m, Forwarded: forwarded[m.Key()]}
+		if m.Source == providers.RuntimeSource {
+			status.ExpiresAt = expiries[m.Key()]
+		}
+		if g.upnpClient != nil && m.AutoExternalPort {
+			status.AssignedPort, _ = g.upnpClient.ReservedPort(m)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// RouterMappings lists every port mapping on the gateway, including the ones not created by Gangplank.
+func (g *Gangplank) RouterMappings() ([]upnp.PortMappingEntry, error) {
+	if g.upnpClient == nil {
+		return nil, errNoGateway
+	}
+	return g.upnpClient.ListPortMappings()
+}
+
+// ExternalIP asks the gateway for its external IP address.
+func (g *Gangplank) ExternalIP() (string, error) {
+	if g.upnpClient == nil {
+		return "", errNoGateway
+	}
+	return g.upnpClient.ExternalIP()
+}
+
+// Sources of the mappings counted by MappingCounts.
+const (
+	metricSourceConfig    = "config"
+	metricSourceContainer = "container"
+	metricSourceListener  = "listener"
+	metricSourceRuntime   = "runtime"
+)
+
+// MappingCounts counts the mappings Gangplank keeps forwarded and the ones it forwarded on the gateway, by the kind
+// of source they come from. Config file paths and container IDs are not used, so that the metrics keep few series.
+func (g *Gangplank) MappingCounts() (desired, applied map[string]int) {
+	desired = map[string]int{metricSourceConfig: 0, metricSourceContainer: 0, metricSourceListener: 0, metricSourceRuntime: 0}
+	applied = map[string]int{metricSourceConfig: 0, metricSourceContainer: 0, metricSourceListener: 0, metricSourceRuntime: 0}
+	for _, status := range g.Mappings() {
+		source := metricSource(status.PortMapping)
+		desired[source]++
+		if status.Forwarded {
+			applied[source]++
+		}
+	}
+	return desired, applied
+}
+
+func metricSource(m types.PortMapping) string {
+	switch {
+	case m.Source == providers.RuntimeSource:
+		return metricSourceRuntime
+	case m.Source != "":
+		return metricSourceConfig
+	case m.ContainerID != "":
+		return metricSourceContainer
+	default:
+		return metricSourceListener
+	}
+}
+
+// ProbeGateway asks the gateway for its external IP address at the given interval until the context is done, so that
+// its reachability and address are known even while no mapping changes.
+func (g *Gangplank) ProbeGateway(ctx context.Context, interval time.Duration) {
+	if g.upnpClient == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := g.upnpClient.ExternalIP(); err != nil {
+			log.Printf("Failed to reach the gateway: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
 	}
 }
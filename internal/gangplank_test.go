@@ -3,6 +3,7 @@ package internal
 import (
 	"context"
 	"errors"
+	"github.com/IonBazan/gangplank/internal/config"
 	"github.com/IonBazan/gangplank/internal/providers"
 	"testing"
 	"time"
@@ -69,6 +70,20 @@ func TestGangplank_GetPortMappings(t *testing.T) {
 			portProviders: []providers.PortProvider{
 				&MockPortProvider{Err: errors.New("Get port mappings error")},
 			},
+			wantPorts: []types.PortMapping{},
+			wantErr:   true,
+		},
+		{
+			name: "Failing provider does not block the others",
+			portProviders: []providers.PortProvider{
+				&MockPortProvider{Ports: []types.PortMapping{{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web"}}},
+				&MockPortProvider{Err: errors.New("nomad agent unreachable")},
+				&MockPortProvider{Ports: []types.PortMapping{{ExternalPort: 5432, InternalPort: 5432, Protocol: "TCP", Name: "db"}}},
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web"},
+				{ExternalPort: 5432, InternalPort: 5432, Protocol: "TCP", Name: "db"},
+			},
 			wantErr: true,
 		},
 	}
@@ -83,12 +98,28 @@ func TestGangplank_GetPortMappings(t *testing.T) {
 				assert.Error(t, err)
 			} else {
 				assert.NoError(t, err)
-				assert.Equal(t, tt.wantPorts, ports)
 			}
+			assert.Equal(t, tt.wantPorts, ports)
 		})
 	}
 }
 
+func TestGangplank_GetPortMappingsKeepsFailingProvider(t *testing.T) {
+	web := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web"}
+	db := types.PortMapping{ExternalPort: 5432, InternalPort: 5432, Protocol: "TCP", Name: "db"}
+	flaky := &MockPortProvider{Ports: []types.PortMapping{db}}
+	g := &Gangplank{PortProviders: []providers.PortProvider{&MockPortProvider{Ports: []types.PortMapping{web}}, flaky}}
+
+	ports, err := g.GetPortMappings()
+	assert.NoError(t, err)
+	assert.Equal(t, []types.PortMapping{web, db}, ports)
+
+	flaky.Ports, flaky.Err = nil, errors.New("containerd socket unavailable")
+	ports, err = g.GetPortMappings()
+	assert.ErrorContains(t, err, "containerd socket unavailable")
+	assert.Equal(t, []types.PortMapping{web, db}, ports, "the mappings fetched last are kept while the provider fails")
+}
+
 func TestGangplank_ForwardPorts(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -148,6 +179,7 @@ func TestGangplank_PollAndForward(t *testing.T) {
 		name        string
 		upnpClient  *upnp.Client
 		cleanup     bool
+		claims      []types.PortMapping
 		addEvents   []types.PortMapping
 		delEvents   []types.PortMapping
 		wantAdded   []types.PortMapping
@@ -165,6 +197,12 @@ func TestGangplank_PollAndForward(t *testing.T) {
 			addEvents: []types.PortMapping{{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web"}},
 			wantAdded: []types.PortMapping{{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "Gangplank UPnP: web"}},
 		},
+		{
+			name:      "Deletes without cleanup do not block adds",
+			addEvents: []types.PortMapping{{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web"}, {ExternalPort: 8081, InternalPort: 80, Protocol: "TCP", Name: "api"}},
+			delEvents: []types.PortMapping{{ExternalPort: 25565, InternalPort: 25565, Protocol: "TCP", Name: "minecraft"}, {ExternalPort: 25566, InternalPort: 25565, Protocol: "TCP", Name: "minecraft"}},
+			wantAdded: []types.PortMapping{{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "Gangplank UPnP: web"}, {ExternalPort: 8081, InternalPort: 80, Protocol: "TCP", Name: "Gangplank UPnP: api"}},
+		},
 		{
 			name:      "Poll with cleanup",
 			cleanup:   true,
@@ -174,6 +212,28 @@ func TestGangplank_PollAndForward(t *testing.T) {
 				Protocol string
 			}{{ExtPort: 25565, Protocol: "TCP"}},
 		},
+		{
+			name:      "Port claimed by a static mapping is not taken over",
+			claims:    []types.PortMapping{{ExternalPort: 443, InternalPort: 443, Protocol: "TCP", Name: "proxy", Source: "gangplank.yaml"}},
+			addEvents: []types.PortMapping{{ExternalPort: 443, InternalPort: 8443, Protocol: "TCP", Name: "web"}},
+		},
+		{
+			name:    "Deleted winner hands the port over to the next claim",
+			cleanup: true,
+			claims: []types.PortMapping{
+				{ExternalPort: 443, InternalPort: 8443, Protocol: "TCP", Name: "web", Priority: 10},
+				{ExternalPort: 443, InternalPort: 443, Protocol: "TCP", Name: "proxy", Source: "gangplank.yaml"},
+			},
+			delEvents: []types.PortMapping{
+				{ExternalPort: 443, InternalPort: 8443, Protocol: "TCP", Name: "web", Priority: 10},
+				{ExternalPort: 8080, InternalPort: 8443, Protocol: "TCP", Name: "web", Priority: 10},
+			},
+			wantAdded: []types.PortMapping{{ExternalPort: 443, InternalPort: 443, Protocol: "TCP", Name: "Gangplank UPnP: proxy"}},
+			wantDeleted: []struct {
+				ExtPort  uint16
+				Protocol string
+			}{{ExtPort: 8080, Protocol: "TCP"}},
+		},
 	}
 
 	for _, tt := range tests {
@@ -203,17 +263,202 @@ func TestGangplank_PollAndForward(t *testing.T) {
 				EventPortProviders: []providers.EventPortProvider{eventPortProvider},
 				upnpClient:         upnpClient,
 			}
+			g.claims.Sync(tt.claims)
 
-			go g.PollAndForward(ctx, tt.cleanup)
+			done := make(chan struct{})
+			go func() {
+				g.PollAndForward(ctx, tt.cleanup)
+				close(done)
+			}()
 
 			time.Sleep(500 * time.Millisecond)
 
 			cancel()
+			<-done
 
-			if tt.upnpClient != nil {
+			if upnpClient != nil {
 				assert.Equal(t, tt.wantAdded, mockConnection.Forwarded)
 				assert.Equal(t, tt.wantDeleted, mockConnection.Deleted)
 			}
 		})
 	}
 }
+
+// blockingEventPortProvider keeps announcing a mapping without watching the context while sending, like providers that
+// block on the event channels.
+type blockingEventPortProvider struct{}
+
+func (blockingEventPortProvider) Listen(ctx context.Context, events providers.PortEventChannels) {
+	for ctx.Err() == nil {
+		events.Add <- types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web"}
+	}
+}
+
+func TestGangplank_PollAndForwardDrainsProviders(t *testing.T) {
+	g := &Gangplank{EventPortProviders: []providers.EventPortProvider{blockingEventPortProvider{}, blockingEventPortProvider{}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		g.PollAndForward(ctx, false)
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("PollAndForward did not return after the providers stopped")
+	}
+}
+
+func TestGangplank_Cleanup(t *testing.T) {
+	web := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web"}
+	dns := types.PortMapping{ExternalPort: 53, InternalPort: 53, Protocol: "UDP", Name: "dns"}
+
+	assert.NoError(t, (&Gangplank{}).Cleanup(context.Background()), "no UPnP client")
+
+	mockConnection := &upnp.DummyConnection{}
+	g := &Gangplank{upnpClient: upnp.NewClientWithConnection(mockConnection, "192.168.1.100", upnp.DefaultLeaseDuration)}
+	assert.NoError(t, g.ForwardPorts([]types.PortMapping{web, dns}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorContains(t, g.Cleanup(ctx), "2 port mapping(s) left on the gateway")
+	assert.Empty(t, mockConnection.Deleted)
+
+	assert.NoError(t, g.Cleanup(context.Background()))
+	assert.Equal(t, []struct {
+		ExtPort  uint16
+		Protocol string
+	}{{ExtPort: 53, Protocol: "UDP"}, {ExtPort: 8080, Protocol: "TCP"}}, mockConnection.Deleted)
+	assert.NoError(t, g.Cleanup(context.Background()))
+	assert.Len(t, mockConnection.Deleted, 2, "deleted mappings are forgotten")
+}
+
+func TestGangplank_ReloadConfig(t *testing.T) {
+	web := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web"}
+	dns := types.PortMapping{ExternalPort: 53, InternalPort: 53, Protocol: "UDP", Name: "dns"}
+	game := types.PortMapping{ExternalPort: 25565, InternalPort: 25565, Protocol: "TCP", Name: "minecraft"}
+
+	tests := []struct {
+		name        string
+		oldConfig   *config.Config
+		newConfig   *config.Config
+		wantErr     bool
+		wantAdded   []types.PortMapping
+		wantDeleted []struct {
+			ExtPort  uint16
+			Protocol string
+		}
+		fixedTTL bool
+		wantTtl  time.Duration
+	}{
+		{
+			name:      "Added, changed and removed mappings",
+			oldConfig: &config.Config{Ports: []types.PortMapping{web, dns}},
+			newConfig: &config.Config{Ports: []types.PortMapping{
+				{ExternalPort: 8080, InternalPort: 8081, Protocol: "TCP", Name: "web"},
+				game,
+			}},
+			wantAdded: []types.PortMapping{
+				{ExternalPort: 8080, InternalPort: 8081, Protocol: "TCP", Name: "Gangplank UPnP: web"},
+				{ExternalPort: 25565, InternalPort: 25565, Protocol: "TCP", Name: "Gangplank UPnP: minecraft"},
+			},
+			wantDeleted: []struct {
+				ExtPort  uint16
+				Protocol string
+			}{{ExtPort: 53, Protocol: "UDP"}},
+			wantTtl: upnp.DefaultLeaseDuration,
+		},
+		{
+			name:      "Unchanged mappings with new TTL",
+			oldConfig: &config.Config{Ports: []types.PortMapping{web}},
+			newConfig: &config.Config{Ports: []types.PortMapping{web}, Ttl: 2 * time.Hour},
+			wantTtl:   2 * time.Hour,
+		},
+		{
+			name:      "New TTL with --ttl set",
+			oldConfig: &config.Config{Ports: []types.PortMapping{web}},
+			newConfig: &config.Config{Ports: []types.PortMapping{web}, Ttl: 2 * time.Hour},
+			fixedTTL:  true,
+			wantTtl:   upnp.DefaultLeaseDuration,
+		},
+		{
+			name:      "From no config",
+			newConfig: &config.Config{Ports: []types.PortMapping{dns}},
+			wantAdded: []types.PortMapping{{ExternalPort: 53, InternalPort: 53, Protocol: "UDP", Name: "Gangplank UPnP: dns"}},
+			wantTtl:   upnp.DefaultLeaseDuration,
+		},
+		{
+			name:      "Invalid config is rejected",
+			oldConfig: &config.Config{Ports: []types.PortMapping{web}},
+			newConfig: &config.Config{Ports: []types.PortMapping{{ExternalPort: 0, InternalPort: 80, Protocol: "TCP"}}},
+			wantErr:   true,
+			wantTtl:   upnp.DefaultLeaseDuration,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockConnection := &upnp.DummyConnection{}
+			upnpClient := upnp.NewClientWithConnection(mockConnection, "192.168.1.100", upnp.DefaultLeaseDuration)
+			configProvider := providers.NewConfigPortProvider(tt.oldConfig)
+			g := &Gangplank{
+				PortProviders:  []providers.PortProvider{configProvider},
+				upnpClient:     upnpClient,
+				configProvider: configProvider,
+				fixedTTL:       tt.fixedTTL,
+			}
+
+			err := g.ReloadConfig(tt.newConfig)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Same(t, tt.oldConfig, configProvider.Config())
+			} else {
+				assert.NoError(t, err)
+				assert.Same(t, tt.newConfig, configProvider.Config())
+			}
+			assert.Equal(t, tt.wantAdded, mockConnection.Forwarded)
+			assert.Equal(t, tt.wantDeleted, mockConnection.Deleted)
+			assert.Equal(t, tt.wantTtl, upnpClient.LeaseDuration())
+		})
+	}
+}
+
+func TestGangplank_ReloadConfigListeners(t *testing.T) {
+	plex := config.ListenerRule{Name: "plex", Process: "Plex Media Server", Port: 32400}
+	ssh := config.ListenerRule{Name: "ssh", Unit: "ssh.service", Port: 22, ExternalPort: 2222}
+
+	oldConfig := &config.Config{Listeners: []config.ListenerRule{plex}}
+	configProvider := providers.NewConfigPortProvider(oldConfig)
+	listenerProvider := providers.NewListenerPortProvider(t.TempDir(), oldConfig.Listeners, 0)
+	g := &Gangplank{configProvider: configProvider, listenerProvider: listenerProvider}
+
+	assert.NoError(t, g.ReloadConfig(&config.Config{Listeners: []config.ListenerRule{plex, ssh}}))
+	assert.Equal(t, []config.ListenerRule{plex, ssh}, listenerProvider.Rules())
+
+	assert.NoError(t, g.ReloadConfig(&config.Config{}))
+	assert.Empty(t, listenerProvider.Rules())
+
+	// Without a listener provider the rules only take effect after a restart.
+	g = &Gangplank{configProvider: providers.NewConfigPortProvider(nil)}
+	assert.NoError(t, g.ReloadConfig(&config.Config{Listeners: []config.ListenerRule{ssh}}))
+}
+
+func TestGangplank_MappingCounts(t *testing.T) {
+	g := NewGangplank(nil, upnp.NewDummyClient(upnp.DefaultLeaseDuration), Options{})
+	static := types.PortMapping{ExternalPort: 443, InternalPort: 443, Protocol: "TCP", Name: "proxy", Source: "gangplank.yaml"}
+	web := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web", ContainerID: "web1234567890"}
+	db := types.PortMapping{ExternalPort: 5432, InternalPort: 5432, Protocol: "TCP", Name: "db", ContainerID: "db1234567890"}
+	ssh := types.PortMapping{ExternalPort: 2222, InternalPort: 22, Protocol: "TCP", Name: "sshd"}
+
+	g.claims.Sync([]types.PortMapping{static, web, db, ssh})
+	assert.NoError(t, g.ForwardPorts([]types.PortMapping{static, web, ssh}))
+	assert.NoError(t, g.AddRuntimeMappings([]types.PortMapping{{ExternalPort: 25565, InternalPort: 25565, Protocol: "TCP"}}, time.Time{}))
+
+	desired, applied := g.MappingCounts()
+	assert.Equal(t, map[string]int{"config": 1, "container": 2, "listener": 1, "runtime": 1}, desired)
+	assert.Equal(t, map[string]int{"config": 1, "container": 1, "listener": 1, "runtime": 1}, applied)
+}
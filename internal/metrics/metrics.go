@@ -0,0 +1,205 @@
+// Package metrics exposes the state of Gangplank to Prometheus.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gangplank"
+
+// Operations counted by Operations.
+const (
+	OperationAdd     = "add"
+	OperationDelete  = "delete"
+	OperationRefresh = "refresh"
+)
+
+// Results of the operations counted by Operations.
+const (
+	ResultSuccess = "success"
+	ResultError   = "error"
+)
+
+// Registry holds every Gangplank metric, along with the Go runtime and process metrics.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// Operations counts the port mappings added, deleted and refreshed by result.
+	Operations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "port_mapping_operations_total",
+		Help:      "Port mappings added, deleted and refreshed on the gateway, by result.",
+	}, []string{"operation", "result"})
+
+	// SOAPDuration observes how long the gateway takes to answer each UPnP action.
+	SOAPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upnp_request_duration_seconds",
+		Help:      "Time the gateway took to answer UPnP requests, by action.",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"action"})
+
+	// GatewayUp tells whether the gateway answered the last UPnP request.
+	GatewayUp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "gateway_up",
+		Help:      "Whether the gateway answered the last UPnP request (1) or could not be reached (0).",
+	})
+
+	// LastRefresh is when all mappings due for renewal were last renewed successfully.
+	LastRefresh = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_successful_refresh_timestamp_seconds",
+		Help:      "Unix time of the last refresh that renewed every port mapping due.",
+	})
+
+	externalIP = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "external_ip_info",
+		Help:      "External IP address reported by the gateway.",
+	}, []string{"ip"})
+	externalIPMu sync.Mutex
+	lastIP       string
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Operations,
+		SOAPDuration,
+		GatewayUp,
+		LastRefresh,
+		externalIP,
+	)
+}
+
+// ObserveOperation counts an operation on a port mapping.
+func ObserveOperation(operation string, err error) {
+	result := ResultSuccess
+	if err != nil {
+		result = ResultError
+	}
+	Operations.WithLabelValues(operation, result).Inc()
+}
+
+// SetExternalIP records the external IP address of the gateway, replacing the previous one.
+func SetExternalIP(ip string) {
+	externalIPMu.Lock()
+	defer externalIPMu.Unlock()
+
+	if ip == lastIP {
+		return
+	}
+	externalIP.Reset()
+	externalIP.WithLabelValues(ip).Set(1)
+	lastIP = ip
+}
+
+// MappingCounts returns the number of desired mappings and of the ones applied on the gateway, by source.
+type MappingCounts func() (desired, applied map[string]int)
+
+// RegisterMappings exposes the mappings counted by the function, which is called on every scrape.
+func RegisterMappings(counts MappingCounts) error {
+	return Registry.Register(&mappingCollector{counts: counts})
+}
+
+var (
+	mappingsDesiredDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "mappings_desired"),
+		"Port mappings Gangplank keeps forwarded, by source.",
+		[]string{"source"}, nil,
+	)
+	mappingsAppliedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "mappings_applied"),
+		"Port mappings forwarded on the gateway, by source.",
+		[]string{"source"}, nil,
+	)
+)
+
+type mappingCollector struct {
+	counts MappingCounts
+}
+
+func (c *mappingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- mappingsDesiredDesc
+	ch <- mappingsAppliedDesc
+}
+
+func (c *mappingCollector) Collect(ch chan<- prometheus.Metric) {
+	desired, applied := c.counts()
+	for source, count := range desired {
+		ch <- prometheus.MustNewConstMetric(mappingsDesiredDesc, prometheus.GaugeValue, float64(count), source)
+	}
+	for source, count := range applied {
+		ch <- prometheus.MustNewConstMetric(mappingsAppliedDesc, prometheus.GaugeValue, float64(count), source)
+	}
+}
+
+// EventStream is an event stream whose connection is monitored, e.g. the Docker event stream.
+type EventStream interface {
+	Connected() bool
+	Reconnects() uint64
+}
+
+// RegisterDockerEvents exposes the connection status of the Docker event stream.
+func RegisterDockerEvents(stream EventStream) error {
+	connected := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "docker_events_connected",
+		Help:      "Whether the Docker event stream is connected (1) or reconnecting (0).",
+	}, func() float64 {
+		if stream.Connected() {
+			return 1
+		}
+		return 0
+	})
+	reconnects := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "docker_events_reconnects_total",
+		Help:      "Times the Docker event stream had to be reconnected.",
+	}, func() float64 {
+		return float64(stream.Reconnects())
+	})
+	return errors.Join(Registry.Register(connected), Registry.Register(reconnects))
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// Serve serves the metrics on /metrics at the TCP address until the context is done.
+func Serve(ctx context.Context, address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", Handler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving metrics on http://%s/metrics", listener.Addr())
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
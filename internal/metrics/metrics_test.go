@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeStream struct {
+	connected  bool
+	reconnects uint64
+}
+
+func (s *fakeStream) Connected() bool    { return s.connected }
+func (s *fakeStream) Reconnects() uint64 { return s.reconnects }
+
+func TestRegister(t *testing.T) {
+	desired := map[string]int{"config": 2, "container": 1}
+	applied := map[string]int{"config": 2, "container": 0}
+	require.NoError(t, RegisterMappings(func() (map[string]int, map[string]int) { return desired, applied }))
+
+	stream := &fakeStream{connected: true, reconnects: 3}
+	require.NoError(t, RegisterDockerEvents(stream))
+	assert.Error(t, RegisterDockerEvents(stream), "metrics are registered once")
+
+	expected := `
+# HELP gangplank_docker_events_connected Whether the Docker event stream is connected (1) or reconnecting (0).
+# TYPE gangplank_docker_events_connected gauge
+gangplank_docker_events_connected 1
+# HELP gangplank_docker_events_reconnects_total Times the Docker event stream had to be reconnected.
+# TYPE gangplank_docker_events_reconnects_total counter
+gangplank_docker_events_reconnects_total 3
+# HELP gangplank_mappings_applied Port mappings forwarded on the gateway, by source.
+# TYPE gangplank_mappings_applied gauge
+gangplank_mappings_applied{source="config"} 2
+gangplank_mappings_applied{source="container"} 0
+# HELP gangplank_mappings_desired Port mappings Gangplank keeps forwarded, by source.
+# TYPE gangplank_mappings_desired gauge
+gangplank_mappings_desired{source="config"} 2
+gangplank_mappings_desired{source="container"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(Registry, strings.NewReader(expected),
+		"gangplank_docker_events_connected", "gangplank_docker_events_reconnects_total",
+		"gangplank_mappings_applied", "gangplank_mappings_desired",
+	))
+}
+
+func TestSetExternalIP(t *testing.T) {
+	SetExternalIP("203.0.113.1")
+	SetExternalIP("203.0.113.2")
+
+	expected := `
+# HELP gangplank_external_ip_info External IP address reported by the gateway.
+# TYPE gangplank_external_ip_info gauge
+gangplank_external_ip_info{ip="203.0.113.2"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(Registry, strings.NewReader(expected), "gangplank_external_ip_info"))
+}
+
+func TestObserveOperation(t *testing.T) {
+	successes := testutil.ToFloat64(Operations.WithLabelValues(OperationRefresh, ResultSuccess))
+	errs := testutil.ToFloat64(Operations.WithLabelValues(OperationRefresh, ResultError))
+
+	ObserveOperation(OperationRefresh, nil)
+	ObserveOperation(OperationRefresh, nil)
+	ObserveOperation(OperationRefresh, errors.New("ConflictInMappingEntry"))
+
+	assert.Equal(t, successes+2, testutil.ToFloat64(Operations.WithLabelValues(OperationRefresh, ResultSuccess)))
+	assert.Equal(t, errs+1, testutil.ToFloat64(Operations.WithLabelValues(OperationRefresh, ResultError)))
+}
+
+func TestHandler(t *testing.T) {
+	GatewayUp.Set(1)
+	ts := httptest.NewServer(Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), "gangplank_gateway_up 1")
+	assert.Contains(t, string(body), "go_goroutines")
+}
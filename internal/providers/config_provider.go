@@ -1,29 +1,39 @@
 package providers
 
 import (
-	"fmt"
 	"github.com/IonBazan/gangplank/internal/config"
 	"github.com/IonBazan/gangplank/internal/types"
+	"sync"
 )
 
 type CofingPortProvider struct {
+	mu     sync.RWMutex
 	config *config.Config
 }
 
 func NewConfigPortProvider(config *config.Config) *CofingPortProvider {
-	return &CofingPortProvider{config}
+	return &CofingPortProvider{config: config}
 }
 
 func (f *CofingPortProvider) GetPortMappings() ([]types.PortMapping, error) {
-	if f.config == nil {
+	cfg := f.Config()
+	if cfg == nil {
 		return []types.PortMapping{}, nil
 	}
 
-	for i, p := range f.config.Ports {
-		if err := p.Validate(); err != nil {
-			return nil, fmt.Errorf("invalid port mapping at index %d: %v", i, err)
-		}
-	}
+	return cfg.PortMappings()
+}
+
+// Config returns the configuration the provider currently serves.
+func (f *CofingPortProvider) Config() *config.Config {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.config
+}
 
-	return f.config.Ports, nil
+// SetConfig replaces the configuration, e.g. after the config file was reloaded.
+func (f *CofingPortProvider) SetConfig(config *config.Config) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.config = config
 }
@@ -31,6 +31,20 @@ func TestConfigPortProvider_GetPortMappings(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "Port range is expanded",
+			config: &config.Config{
+				Ports: []types.PortMapping{
+					{ExternalPort: 27015, ExternalPortEnd: 27017, InternalPort: 27015, Protocol: "UDP", Name: "game"},
+				},
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 27015, InternalPort: 27015, Protocol: "UDP", Name: "game"},
+				{ExternalPort: 27016, InternalPort: 27016, Protocol: "UDP", Name: "game"},
+				{ExternalPort: 27017, InternalPort: 27017, Protocol: "UDP", Name: "game"},
+			},
+			wantErr: false,
+		},
 		{
 			name: "Invalid external port",
 			config: &config.Config{
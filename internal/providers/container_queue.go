@@ -0,0 +1,42 @@
+package providers
+
+import "sync"
+
+// containerQueue runs the tasks of each container one after another, in the order they were queued, while tasks of
+// different containers run concurrently.
+type containerQueue struct {
+	mu      sync.Mutex
+	pending map[string][]func()
+}
+
+func newContainerQueue() *containerQueue {
+	return &containerQueue{pending: map[string][]func(){}}
+}
+
+// run queues a task for a container and starts a worker for the container if none is running.
+func (q *containerQueue) run(containerID string, task func()) {
+	q.mu.Lock()
+	if tasks, busy := q.pending[containerID]; busy {
+		q.pending[containerID] = append(tasks, task)
+		q.mu.Unlock()
+		return
+	}
+	q.pending[containerID] = nil
+	q.mu.Unlock()
+
+	go func() {
+		for {
+			task()
+
+			q.mu.Lock()
+			tasks := q.pending[containerID]
+			if len(tasks) == 0 {
+				delete(q.pending, containerID)
+				q.mu.Unlock()
+				return
+			}
+			task, q.pending[containerID] = tasks[0], tasks[1:]
+			q.mu.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,45 @@
+package providers
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContainerQueue(t *testing.T) {
+	queue := newContainerQueue()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	order := map[string][]int{}
+	for i := 0; i < 50; i++ {
+		for _, containerID := range []string{"web", "db"} {
+			wg.Add(1)
+			queue.run(containerID, func() {
+				defer wg.Done()
+				if i == 0 {
+					// A slow first task must not let the following ones overtake it.
+					time.Sleep(10 * time.Millisecond)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				order[containerID] = append(order[containerID], i)
+			})
+		}
+	}
+	wg.Wait()
+
+	want := make([]int, 50)
+	for i := range want {
+		want[i] = i
+	}
+	assert.Equal(t, want, order["web"])
+	assert.Equal(t, want, order["db"])
+	assert.Eventually(t, func() bool {
+		queue.mu.Lock()
+		defer queue.mu.Unlock()
+		return len(queue.pending) == 0
+	}, time.Second, 10*time.Millisecond)
+}
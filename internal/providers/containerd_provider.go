@@ -0,0 +1,347 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/types"
+	eventtypes "github.com/containerd/containerd/api/events"
+	containersapi "github.com/containerd/containerd/api/services/containers/v1"
+	eventsapi "github.com/containerd/containerd/api/services/events/v1"
+	tasksapi "github.com/containerd/containerd/api/services/tasks/v1"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/docker/docker/api/types/container"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+const DefaultContainerdNamespace = "default"
+
+const (
+	containerdNamespaceHeader = "containerd-namespace"
+	topicTaskStart            = "/tasks/start"
+	topicTaskExit             = "/tasks/exit"
+	labelNerdctlName          = "nerdctl/name"
+	labelNerdctlPorts         = "nerdctl/ports"
+)
+
+// nerdctlPort is a single entry of the JSON list nerdctl stores in the nerdctl/ports label.
+type nerdctlPort struct {
+	HostPort      int    `json:"HostPort"`
+	ContainerPort int    `json:"ContainerPort"`
+	Protocol      string `json:"Protocol"`
+	HostIP        string `json:"HostIP"`
+}
+
+// ContainerdPortProvider reads port mappings from containers managed by containerd (e.g. via nerdctl).
+type ContainerdPortProvider struct {
+	containers containersapi.ContainersClient
+	tasks      tasksapi.TasksClient
+	events     eventsapi.EventsClient
+	namespace  string
+
+	reconnectDelay    time.Duration
+	maxReconnectDelay time.Duration
+
+	// queue handles the task events of each container in order, so an exit is handled after the start before it.
+	queue *containerQueue
+	mu    sync.Mutex
+	// announced holds the mappings of each running container, so they can be deleted once the container is gone,
+	// e.g. when it was started with nerdctl run --rm.
+	announced map[string][]types.PortMapping
+}
+
+// NewContainerdConnection opens a gRPC connection to the containerd socket at the given address.
+func NewContainerdConnection(address string) (*grpc.ClientConn, error) {
+	if !strings.Contains(address, "://") {
+		address = "unix://" + address
+	}
+
+	return grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+}
+
+func NewContainerdPortProvider(conn grpc.ClientConnInterface, namespace string) *ContainerdPortProvider {
+	if namespace == "" {
+		namespace = DefaultContainerdNamespace
+	}
+
+	return &ContainerdPortProvider{
+		containers:        containersapi.NewContainersClient(conn),
+		tasks:             tasksapi.NewTasksClient(conn),
+		events:            eventsapi.NewEventsClient(conn),
+		namespace:         namespace,
+		reconnectDelay:    defaultReconnectDelay,
+		maxReconnectDelay: defaultMaxReconnectDelay,
+		queue:             newContainerQueue(),
+		announced:         map[string][]types.PortMapping{},
+	}
+}
+
+func (c *ContainerdPortProvider) GetPortMappings() ([]types.PortMapping, error) {
+	byContainer, err := c.mappingsByContainer(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	var mappings []types.PortMapping
+	for _, containerMappings := range byContainer {
+		mappings = append(mappings, containerMappings...)
+	}
+	return mappings, nil
+}
+
+// mappingsByContainer returns the port mappings of the containers with a running task, keyed by container ID.
+func (c *ContainerdPortProvider) mappingsByContainer(ctx context.Context) (map[string][]types.PortMapping, error) {
+	ctx = c.withNamespace(ctx)
+
+	resp, err := c.tasks.List(ctx, &tasksapi.ListTasksRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containerd tasks: %v", err)
+	}
+
+	mappings := map[string][]types.PortMapping{}
+	for _, t := range resp.Tasks {
+		if t.Status != task.Status_RUNNING {
+			continue
+		}
+		ctr, err := c.getContainer(ctx, t.ContainerID)
+		if err != nil {
+			log.Printf("Failed to get containerd container %s: %v", shortID(t.ContainerID), err)
+			continue
+		}
+		if containerMappings := extractPortsFromContainer(ctr); len(containerMappings) > 0 {
+			mappings[t.ContainerID] = containerMappings
+		}
+	}
+	return mappings, nil
+}
+
+// prime remembers the mappings of the running containers as announced.
+func (c *ContainerdPortProvider) prime(ctx context.Context) error {
+	byContainer, err := c.mappingsByContainer(ctx)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for containerID, ports := range byContainer {
+		c.announced[containerID] = ports
+	}
+	return nil
+}
+
+// resync announces the containers whose task started while disconnected and withdraws the ones whose task exited,
+// as containerd does not replay missed events.
+func (c *ContainerdPortProvider) resync(ctx context.Context, events PortEventChannels) error {
+	byContainer, err := c.mappingsByContainer(ctx)
+	if err != nil {
+		return err
+	}
+	for containerID, ports := range byContainer {
+		c.queue.run(containerID, func() { c.announce(containerID, ports, events.Add) })
+	}
+	for _, containerID := range c.announcedContainers() {
+		if _, running := byContainer[containerID]; running {
+			continue
+		}
+		c.queue.run(containerID, func() { c.withdraw(containerID, events.Delete) })
+	}
+	return nil
+}
+
+// Listen follows task events until the context is cancelled. When the event stream fails, e.g. because containerd
+// restarted, it reconnects with an increasing delay and resyncs the running containers.
+func (c *ContainerdPortProvider) Listen(ctx context.Context, events PortEventChannels) {
+	// Containers running before Gangplank started were forwarded from the task list, remember their mappings.
+	if err := c.prime(ctx); err != nil {
+		log.Printf("Failed to list containerd tasks: %v", err)
+	}
+	delay := c.reconnectDelay
+	for {
+		err := c.follow(ctx, events)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Error receiving containerd events: %v, reconnecting in %s", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay = min(delay*2, c.maxReconnectDelay)
+
+		// containerd is back once tasks can be listed again.
+		if err := c.resync(ctx, events); err != nil {
+			log.Printf("Failed to resync containerd tasks: %v", err)
+			continue
+		}
+		log.Printf("Reconnected to containerd events")
+		delay = c.reconnectDelay
+	}
+}
+
+// follow handles task events until the stream fails.
+func (c *ContainerdPortProvider) follow(ctx context.Context, events PortEventChannels) error {
+	stream, err := c.events.Subscribe(c.withNamespace(ctx), &eventsapi.SubscribeRequest{
+		Filters: []string{
+			fmt.Sprintf(`namespace==%s,topic==%q`, c.namespace, topicTaskStart),
+			fmt.Sprintf(`namespace==%s,topic==%q`, c.namespace, topicTaskExit),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		envelope, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return errors.New("event stream closed")
+			}
+			return err
+		}
+		if envelope.Event == nil {
+			continue
+		}
+
+		switch envelope.Topic {
+		case topicTaskStart:
+			var start eventtypes.TaskStart
+			if err := envelope.Event.UnmarshalTo(&start); err != nil {
+				log.Printf("Failed to decode containerd %s event: %v", envelope.Topic, err)
+				continue
+			}
+			c.queue.run(start.ContainerID, func() { c.handleTaskStart(ctx, start.ContainerID, events.Add) })
+		case topicTaskExit:
+			var exit eventtypes.TaskExit
+			if err := envelope.Event.UnmarshalTo(&exit); err != nil {
+				log.Printf("Failed to decode containerd %s event: %v", envelope.Topic, err)
+				continue
+			}
+			// Exec'd processes emit their own exit events; only the init process ends the container.
+			if exit.ID != "" && exit.ID != exit.ContainerID {
+				continue
+			}
+			c.queue.run(exit.ContainerID, func() { c.handleTaskExit(ctx, exit.ContainerID, events.Delete) })
+		}
+	}
+}
+
+// handleTaskStart announces the mappings of a container whose task started and remembers them.
+func (c *ContainerdPortProvider) handleTaskStart(ctx context.Context, containerID string, ch chan<- types.PortMapping) {
+	ctr, err := c.getContainer(c.withNamespace(ctx), containerID)
+	if err != nil {
+		log.Printf("Failed to get containerd container %s: %v", shortID(containerID), err)
+		return
+	}
+
+	ports := extractPortsFromContainer(ctr)
+	c.mu.Lock()
+	c.announced[containerID] = ports
+	c.mu.Unlock()
+	send(ch, ports)
+}
+
+// handleTaskExit withdraws the mappings announced for a container. The container is only looked up when it is not
+// known to this provider, as it may already be removed by then.
+func (c *ContainerdPortProvider) handleTaskExit(ctx context.Context, containerID string, ch chan<- types.PortMapping) {
+	if c.withdraw(containerID, ch) {
+		return
+	}
+	ctr, err := c.getContainer(c.withNamespace(ctx), containerID)
+	if err != nil {
+		log.Printf("Failed to get containerd container %s: %v", shortID(containerID), err)
+		return
+	}
+	send(ch, extractPortsFromContainer(ctr))
+}
+
+// announce sends the mappings of a running container unless they were announced already.
+func (c *ContainerdPortProvider) announce(containerID string, ports []types.PortMapping, ch chan<- types.PortMapping) {
+	c.mu.Lock()
+	_, known := c.announced[containerID]
+	if !known {
+		c.announced[containerID] = ports
+	}
+	c.mu.Unlock()
+	if !known {
+		send(ch, ports)
+	}
+}
+
+// withdraw sends the deletes of the mappings announced for a container and forgets them. It returns false if the
+// container is not known to this provider.
+func (c *ContainerdPortProvider) withdraw(containerID string, ch chan<- types.PortMapping) bool {
+	c.mu.Lock()
+	ports, known := c.announced[containerID]
+	delete(c.announced, containerID)
+	c.mu.Unlock()
+	if known {
+		send(ch, ports)
+	}
+	return known
+}
+
+// announcedContainers returns the IDs of the containers whose mappings are announced.
+func (c *ContainerdPortProvider) announcedContainers() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]string, 0, len(c.announced))
+	for containerID := range c.announced {
+		ids = append(ids, containerID)
+	}
+	return ids
+}
+
+func (c *ContainerdPortProvider) getContainer(ctx context.Context, containerID string) (container.Summary, error) {
+	resp, err := c.containers.Get(ctx, &containersapi.GetContainerRequest{ID: containerID})
+	if err != nil {
+		return container.Summary{}, err
+	}
+
+	return containerdToSummary(resp.Container), nil
+}
+
+func (c *ContainerdPortProvider) withNamespace(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, containerdNamespaceHeader, c.namespace)
+}
+
+// containerdToSummary converts a containerd container into the Docker summary shape understood by the label parser.
+func containerdToSummary(ctr *containersapi.Container) container.Summary {
+	summary := container.Summary{
+		ID:     ctr.ID,
+		Image:  ctr.Image,
+		Labels: ctr.Labels,
+	}
+	if name := ctr.Labels[labelNerdctlName]; name != "" {
+		summary.Names = []string{"/" + name}
+	}
+
+	if raw := ctr.Labels[labelNerdctlPorts]; raw != "" {
+		var ports []nerdctlPort
+		if err := json.Unmarshal([]byte(raw), &ports); err != nil {
+			log.Printf("Invalid %s label for container %s: %v", labelNerdctlPorts, shortID(ctr.ID), err)
+		}
+		for _, p := range ports {
+			if p.HostPort == 0 {
+				continue
+			}
+			summary.Ports = append(summary.Ports, container.Port{
+				IP:          p.HostIP,
+				PrivatePort: uint16(p.ContainerPort),
+				PublicPort:  uint16(p.HostPort),
+				Type:        strings.ToLower(p.Protocol),
+			})
+		}
+	}
+
+	return summary
+}
@@ -0,0 +1,340 @@
+package providers
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/types"
+	eventtypes "github.com/containerd/containerd/api/events"
+	containersapi "github.com/containerd/containerd/api/services/containers/v1"
+	eventsapi "github.com/containerd/containerd/api/services/events/v1"
+	tasksapi "github.com/containerd/containerd/api/services/tasks/v1"
+	apitypes "github.com/containerd/containerd/api/types"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+type fakeContainerd struct {
+	namespace  string
+	containers map[string]*containersapi.Container
+	tasks      []*task.Process
+	events     []*apitypes.Envelope
+	// autoRemove lists the containers removed after they were first looked up, like with nerdctl run --rm.
+	autoRemove map[string]bool
+	// restartTasks, if set, makes the first subscription fail, like a containerd restart, and replaces the tasks.
+	restartTasks  []*task.Process
+	subscriptions int
+	mu            sync.Mutex
+}
+
+func (f *fakeContainerd) checkNamespace(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if ns := md.Get(containerdNamespaceHeader); len(ns) != 1 || ns[0] != f.namespace {
+		return status.Errorf(codes.FailedPrecondition, "unexpected namespace %v", ns)
+	}
+	return nil
+}
+
+type fakeContainersService struct {
+	containersapi.UnimplementedContainersServer
+	*fakeContainerd
+}
+
+type fakeTasksService struct {
+	tasksapi.UnimplementedTasksServer
+	*fakeContainerd
+}
+
+type fakeEventsService struct {
+	eventsapi.UnimplementedEventsServer
+	*fakeContainerd
+}
+
+func (f *fakeContainersService) Get(ctx context.Context, req *containersapi.GetContainerRequest) (*containersapi.GetContainerResponse, error) {
+	if err := f.checkNamespace(ctx); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ctr, ok := f.containers[req.ID]; ok {
+		if f.autoRemove[req.ID] {
+			delete(f.containers, req.ID)
+		}
+		return &containersapi.GetContainerResponse{Container: ctr}, nil
+	}
+	return nil, status.Errorf(codes.NotFound, "container %q not found", req.ID)
+}
+
+func (f *fakeTasksService) List(ctx context.Context, req *tasksapi.ListTasksRequest) (*tasksapi.ListTasksResponse, error) {
+	if err := f.checkNamespace(ctx); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &tasksapi.ListTasksResponse{Tasks: f.tasks}, nil
+}
+
+func (f *fakeEventsService) Subscribe(req *eventsapi.SubscribeRequest, stream eventsapi.Events_SubscribeServer) error {
+	if err := f.checkNamespace(stream.Context()); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.subscriptions++
+	restarted := f.subscriptions == 1 && f.restartTasks != nil
+	if restarted {
+		f.tasks = f.restartTasks
+	}
+	f.mu.Unlock()
+	if restarted {
+		return status.Error(codes.Unavailable, "containerd is restarting")
+	}
+	for _, e := range f.events {
+		if err := stream.Send(e); err != nil {
+			return err
+		}
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+func startFakeContainerd(t *testing.T, fake *fakeContainerd) *grpc.ClientConn {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	containersapi.RegisterContainersServer(server, &fakeContainersService{fakeContainerd: fake})
+	tasksapi.RegisterTasksServer(server, &fakeTasksService{fakeContainerd: fake})
+	eventsapi.RegisterEventsServer(server, &fakeEventsService{fakeContainerd: fake})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func taskEnvelope(t *testing.T, topic string, event proto.Message) *apitypes.Envelope {
+	payload, err := anypb.New(event)
+	require.NoError(t, err)
+	return &apitypes.Envelope{Namespace: DefaultContainerdNamespace, Topic: topic, Event: payload}
+}
+
+func nerdctlContainers() map[string]*containersapi.Container {
+	return map[string]*containersapi.Container{
+		"nginx1234567890": {
+			ID: "nginx1234567890",
+			Labels: map[string]string{
+				labelNerdctlName:  "nginx",
+				labelNerdctlPorts: `[{"HostPort":8080,"ContainerPort":80,"Protocol":"tcp","HostIP":"0.0.0.0"}]`,
+				labelForward:      "published",
+			},
+		},
+		"dns4567890123456": {
+			ID: "dns4567890123456",
+			Labels: map[string]string{
+				labelNerdctlPorts:     `[{"HostPort":5353,"ContainerPort":53,"Protocol":"udp","HostIP":"0.0.0.0"}]`,
+				labelForwardContainer: "53/udp",
+			},
+		},
+		"unlabeled7890123": {
+			ID: "unlabeled7890123",
+			Labels: map[string]string{
+				labelNerdctlName:  "unlabeled",
+				labelNerdctlPorts: `[{"HostPort":9000,"ContainerPort":9000,"Protocol":"tcp","HostIP":"0.0.0.0"}]`,
+			},
+		},
+	}
+}
+
+func TestContainerdPortProvider_GetPortMappings(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		tasks     []*task.Process
+		wantPorts []types.PortMapping
+		wantErr   bool
+	}{
+		{
+			name: "Running nerdctl containers",
+			tasks: []*task.Process{
+				{ContainerID: "nginx1234567890", Status: task.Status_RUNNING},
+				{ContainerID: "dns4567890123456", Status: task.Status_RUNNING},
+				{ContainerID: "unlabeled7890123", Status: task.Status_RUNNING},
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "nginx", ContainerID: "nginx1234567890"},
+				{ExternalPort: 5353, InternalPort: 53, Protocol: "UDP", Name: "dns456789012", ContainerID: "dns4567890123456"},
+			},
+		},
+		{
+			name: "Stopped and missing containers are skipped",
+			tasks: []*task.Process{
+				{ContainerID: "nginx1234567890", Status: task.Status_STOPPED},
+				{ContainerID: "missing12345678", Status: task.Status_RUNNING},
+			},
+			wantPorts: []types.PortMapping{},
+		},
+		{
+			name:      "Wrong namespace",
+			namespace: "k8s.io",
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := startFakeContainerd(t, &fakeContainerd{
+				namespace:  DefaultContainerdNamespace,
+				containers: nerdctlContainers(),
+				tasks:      tt.tasks,
+			})
+			portProvider := NewContainerdPortProvider(conn, tt.namespace)
+
+			gotPorts, err := portProvider.GetPortMappings()
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Nil(t, gotPorts)
+			} else {
+				assert.NoError(t, err)
+				assert.ElementsMatch(t, tt.wantPorts, gotPorts)
+			}
+		})
+	}
+}
+
+func TestContainerdPortProvider_Listen(t *testing.T) {
+	fake := &fakeContainerd{
+		namespace:  DefaultContainerdNamespace,
+		containers: nerdctlContainers(),
+		events: []*apitypes.Envelope{
+			taskEnvelope(t, topicTaskStart, &eventtypes.TaskStart{ContainerID: "nginx1234567890", Pid: 42}),
+			taskEnvelope(t, topicTaskExit, &eventtypes.TaskExit{ContainerID: "nginx1234567890", ID: "exec-1", Pid: 43}),
+			taskEnvelope(t, topicTaskExit, &eventtypes.TaskExit{ContainerID: "nginx1234567890", ID: "nginx1234567890", Pid: 42}),
+		},
+	}
+	conn := startFakeContainerd(t, fake)
+	portProvider := NewContainerdPortProvider(conn, "")
+
+	addCh := make(chan types.PortMapping, 10)
+	deleteCh := make(chan types.PortMapping, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go portProvider.Listen(ctx, PortEventChannels{Add: addCh, Delete: deleteCh})
+
+	var gotAdd, gotDelete []types.PortMapping
+	timeout := time.After(1 * time.Second)
+
+collect:
+	for {
+		select {
+		case m := <-addCh:
+			gotAdd = append(gotAdd, m)
+		case m := <-deleteCh:
+			gotDelete = append(gotDelete, m)
+		case <-timeout:
+			break collect
+		}
+	}
+
+	want := []types.PortMapping{{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "nginx", ContainerID: "nginx1234567890"}}
+	assert.Equal(t, want, gotAdd)
+	assert.Equal(t, want, gotDelete)
+}
+
+func TestContainerdPortProvider_ListenRemovedContainer(t *testing.T) {
+	fake := &fakeContainerd{
+		namespace:  DefaultContainerdNamespace,
+		containers: nerdctlContainers(),
+		tasks:      []*task.Process{{ID: "dns4567890123456", ContainerID: "dns4567890123456", Status: task.Status_RUNNING}},
+		events: []*apitypes.Envelope{
+			taskEnvelope(t, topicTaskStart, &eventtypes.TaskStart{ContainerID: "nginx1234567890", Pid: 42}),
+			taskEnvelope(t, topicTaskExit, &eventtypes.TaskExit{ContainerID: "nginx1234567890", ID: "nginx1234567890", Pid: 42}),
+			taskEnvelope(t, topicTaskExit, &eventtypes.TaskExit{ContainerID: "dns4567890123456", ID: "dns4567890123456", Pid: 7}),
+		},
+		autoRemove: map[string]bool{"nginx1234567890": true, "dns4567890123456": true},
+	}
+	conn := startFakeContainerd(t, fake)
+	portProvider := NewContainerdPortProvider(conn, "")
+
+	addCh := make(chan types.PortMapping, 10)
+	deleteCh := make(chan types.PortMapping, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go portProvider.Listen(ctx, PortEventChannels{Add: addCh, Delete: deleteCh})
+
+	var gotAdd, gotDelete []types.PortMapping
+	timeout := time.After(1 * time.Second)
+
+collect:
+	for {
+		select {
+		case m := <-addCh:
+			gotAdd = append(gotAdd, m)
+		case m := <-deleteCh:
+			gotDelete = append(gotDelete, m)
+		case <-timeout:
+			break collect
+		}
+	}
+
+	nginx := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "nginx", ContainerID: "nginx1234567890"}
+	dns := types.PortMapping{ExternalPort: 5353, InternalPort: 53, Protocol: "UDP", Name: "dns456789012", ContainerID: "dns4567890123456"}
+	assert.Equal(t, []types.PortMapping{nginx}, gotAdd)
+	assert.ElementsMatch(t, []types.PortMapping{nginx, dns}, gotDelete, "removed containers are deleted from the announced mappings")
+}
+
+func TestContainerdPortProvider_ListenReconnect(t *testing.T) {
+	fake := &fakeContainerd{
+		namespace:    DefaultContainerdNamespace,
+		containers:   nerdctlContainers(),
+		tasks:        []*task.Process{{ContainerID: "nginx1234567890", Status: task.Status_RUNNING}},
+		restartTasks: []*task.Process{{ContainerID: "dns4567890123456", Status: task.Status_RUNNING}},
+	}
+	conn := startFakeContainerd(t, fake)
+	portProvider := NewContainerdPortProvider(conn, "")
+	portProvider.reconnectDelay = 10 * time.Millisecond
+
+	addCh := make(chan types.PortMapping, 10)
+	deleteCh := make(chan types.PortMapping, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go portProvider.Listen(ctx, PortEventChannels{Add: addCh, Delete: deleteCh})
+
+	select {
+	case m := <-deleteCh:
+		assert.Equal(t, types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "nginx", ContainerID: "nginx1234567890"}, m)
+	case <-time.After(time.Second):
+		t.Fatal("container exited while disconnected was not withdrawn")
+	}
+	select {
+	case m := <-addCh:
+		assert.Equal(t, types.PortMapping{ExternalPort: 5353, InternalPort: 53, Protocol: "UDP", Name: "dns456789012", ContainerID: "dns4567890123456"}, m)
+	case <-time.After(time.Second):
+		t.Fatal("container started while disconnected was not announced")
+	}
+	assert.Eventually(t, func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return fake.subscriptions == 2
+	}, time.Second, 10*time.Millisecond, "events are followed again")
+}
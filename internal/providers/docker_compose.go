@@ -0,0 +1,198 @@
+package providers
+
+import (
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+const labelComposeContainerNumber = "com.docker.compose.container-number"
+
+// labelProjectPrefix starts the labels declaring defaults for every service of a compose project, e.g.
+// gangplank.project.ttl=2h on any one service of the stack.
+const labelProjectPrefix = "gangplank.project."
+
+// projectDefaultLabels are the container labels that can be set for a whole project.
+var projectDefaultLabels = []string{labelTTL, labelDescription, labelRemoteHost, labelEnabled}
+
+// composeName returns "<project>/<service>" for containers started by Docker Compose.
+func composeName(labels map[string]string) (string, bool) {
+	project, service := labels[labelComposeProject], labels[labelComposeService]
+	if project == "" || service == "" {
+		return "", false
+	}
+	return project + "/" + service, true
+}
+
+// composeReplica returns the index of a scaled service replica, starting at 0 for the first one.
+func composeReplica(labels map[string]string) int {
+	number, err := strconv.Atoi(labels[labelComposeContainerNumber])
+	if err != nil || number < 1 {
+		return 0
+	}
+	return number - 1
+}
+
+// shiftForReplica moves the explicit external port (or range) of a mapping past the ones used by the previous
+// replicas of the service, so that "8080:80" becomes 8081 for the second replica.
+func shiftForReplica(m *types.PortMapping, replica int) {
+	if replica == 0 || m.AutoExternalPort {
+		return
+	}
+	size := 1
+	if m.ExternalPortEnd != 0 {
+		size = m.ExternalPortEnd - m.ExternalPort + 1
+		m.ExternalPortEnd += replica * size
+	}
+	m.ExternalPort += replica * size
+}
+
+// projectDefaults are the gangplank.project.* labels of each compose project.
+type projectDefaults map[string]map[string]string
+
+// collectProjectDefaults reads the gangplank.project.* labels of the given containers. When services of the same
+// project disagree, the value of the container with the lowest ID is kept, so that the result does not depend on the
+// order the containers were listed in.
+func collectProjectDefaults(containers []container.Summary) projectDefaults {
+	containers = slices.SortedFunc(slices.Values(containers), func(a, b container.Summary) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	defaults := projectDefaults{}
+	for _, ctr := range containers {
+		project := ctr.Labels[labelComposeProject]
+		if project == "" {
+			continue
+		}
+		for _, label := range projectDefaultLabels {
+			value, ok := ctr.Labels[projectLabel(label)]
+			if !ok {
+				continue
+			}
+			if defaults[project] == nil {
+				defaults[project] = map[string]string{}
+			}
+			if first, ok := defaults[project][label]; ok {
+				if first != value {
+					log.Printf("Conflicting %s labels in compose project %s, using %q", projectLabel(label), project, first)
+				}
+				continue
+			}
+			defaults[project][label] = value
+		}
+	}
+	return defaults
+}
+
+// projectLabel returns the project-wide variant of a container label, e.g. gangplank.project.ttl for gangplank.ttl.
+func projectLabel(label string) string {
+	return labelProjectPrefix + strings.TrimPrefix(label, "gangplank.")
+}
+
+// apply sets the project defaults on a container that does not set the labels itself.
+func (d projectDefaults) apply(ctr container.Summary) container.Summary {
+	defaults := d[ctr.Labels[labelComposeProject]]
+	if len(defaults) == 0 {
+		return ctr
+	}
+	labels := make(map[string]string, len(ctr.Labels)+len(defaults))
+	for key, value := range ctr.Labels {
+		labels[key] = value
+	}
+	for label, value := range defaults {
+		if _, _, ok := enabledLabel(labels); ok && label == labelEnabled {
+			continue
+		}
+		if _, ok := labels[label]; !ok {
+			labels[label] = value
+		}
+	}
+	ctr.Labels = labels
+	return ctr
+}
+
+// projectMembers tracks the labels of the running containers of each compose project, so that container events get
+// the same project defaults as a listing of the running containers, without listing the project on every event.
+type projectMembers struct {
+	mu sync.Mutex
+	// complete is set once all running containers were listed, so projects without members are known to have none.
+	complete bool
+	projects map[string]map[string]container.Summary
+}
+
+func newProjectMembers() *projectMembers {
+	return &projectMembers{projects: map[string]map[string]container.Summary{}}
+}
+
+// reset replaces the members of every project with the given running containers.
+func (p *projectMembers) reset(containers []container.Summary) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.projects = map[string]map[string]container.Summary{}
+	for _, ctr := range containers {
+		p.add(ctr)
+	}
+	p.complete = true
+}
+
+// tracked returns whether the members of a project are known.
+func (p *projectMembers) tracked(project string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.projects[project]
+	return ok || p.complete
+}
+
+// setProject replaces the members of a project with its running containers.
+func (p *projectMembers) setProject(project string, containers []container.Summary) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.projects[project] = map[string]container.Summary{}
+	for _, ctr := range containers {
+		p.add(ctr)
+	}
+}
+
+// update adds a running container to its project, or removes a container that is no longer running.
+func (p *projectMembers) update(ctr container.Summary, running bool) {
+	if !running {
+		p.remove(ctr.ID)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.add(ctr)
+}
+
+// remove drops a container from its project.
+func (p *projectMembers) remove(containerID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, members := range p.projects {
+		delete(members, containerID)
+	}
+}
+
+// defaults returns the project defaults of a tracked project.
+func (p *projectMembers) defaults(project string) projectDefaults {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return collectProjectDefaults(slices.Collect(maps.Values(p.projects[project])))
+}
+
+func (p *projectMembers) add(ctr container.Summary) {
+	project := ctr.Labels[labelComposeProject]
+	if project == "" {
+		return
+	}
+	if p.projects[project] == nil {
+		p.projects[project] = map[string]container.Summary{}
+	}
+	// Only the labels are needed to collect the defaults.
+	p.projects[project][ctr.ID] = container.Summary{ID: ctr.ID, Labels: ctr.Labels}
+}
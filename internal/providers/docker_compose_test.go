@@ -0,0 +1,166 @@
+package providers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/assert"
+)
+
+func composeLabels(project, service, number string, labels map[string]string) map[string]string {
+	all := map[string]string{
+		labelComposeProject:         project,
+		labelComposeService:         service,
+		labelComposeContainerNumber: number,
+	}
+	for key, value := range labels {
+		all[key] = value
+	}
+	return all
+}
+
+func TestDockerPortProvider_ComposeProjects(t *testing.T) {
+	tests := []struct {
+		name       string
+		containers []container.Summary
+		wantPorts  []types.PortMapping
+	}{
+		{
+			name: "Project and service name",
+			containers: []container.Summary{
+				{
+					ID:     "web1234567890",
+					Names:  []string{"/shop-web-1"},
+					Ports:  []container.Port{{PublicPort: 8080, PrivatePort: 80, Type: "tcp"}},
+					Labels: composeLabels("shop", "web", "1", map[string]string{labelForward: "published"}),
+				},
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "shop/web", ContainerID: "web1234567890"},
+			},
+		},
+		{
+			name: "Replicas get their own external ports",
+			containers: []container.Summary{
+				{
+					ID:    "web1234567890",
+					Names: []string{"/shop-web-1"},
+					Ports: []container.Port{
+						{PublicPort: 32768, PrivatePort: 80, Type: "tcp"},
+						{PublicPort: 32769, PrivatePort: 27015, Type: "udp"},
+						{PublicPort: 32770, PrivatePort: 27016, Type: "udp"},
+					},
+					Labels: composeLabels("shop", "web", "1", map[string]string{
+						labelForwardContainer:         "8080:80/tcp, 37015-37016:27015-27016/udp",
+						labelForward:                  "9000-9001:9000-9001/tcp",
+						"gangplank.ports.ws.external": "7000",
+					}),
+				},
+				{
+					ID:    "web2345678901",
+					Names: []string{"/shop-web-2"},
+					Ports: []container.Port{
+						{PublicPort: 32771, PrivatePort: 80, Type: "tcp"},
+						{PublicPort: 32772, PrivatePort: 27015, Type: "udp"},
+						{PublicPort: 32773, PrivatePort: 27016, Type: "udp"},
+					},
+					Labels: composeLabels("shop", "web", "2", map[string]string{
+						labelForwardContainer:         "8080:80/tcp, 37015-37016:27015-27016/udp",
+						labelForward:                  "9000-9001:9000-9001/tcp",
+						"gangplank.ports.ws.external": "7000",
+					}),
+				},
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 8080, InternalPort: 32768, Protocol: "TCP", Name: "shop/web", ContainerID: "web1234567890"},
+				{ExternalPort: 37015, InternalPort: 32769, Protocol: "UDP", Name: "shop/web", ContainerID: "web1234567890"},
+				{ExternalPort: 37016, InternalPort: 32770, Protocol: "UDP", Name: "shop/web", ContainerID: "web1234567890"},
+				{ExternalPort: 9000, InternalPort: 9000, Protocol: "TCP", Name: "shop/web", ContainerID: "web1234567890"},
+				{ExternalPort: 9001, InternalPort: 9001, Protocol: "TCP", Name: "shop/web", ContainerID: "web1234567890"},
+				{ExternalPort: 7000, InternalPort: 7000, Protocol: "TCP", Name: "ws", ContainerID: "web1234567890"},
+				{ExternalPort: 8081, InternalPort: 32771, Protocol: "TCP", Name: "shop/web", ContainerID: "web2345678901"},
+				{ExternalPort: 37017, InternalPort: 32772, Protocol: "UDP", Name: "shop/web", ContainerID: "web2345678901"},
+				{ExternalPort: 37018, InternalPort: 32773, Protocol: "UDP", Name: "shop/web", ContainerID: "web2345678901"},
+				{ExternalPort: 9002, InternalPort: 9000, Protocol: "TCP", Name: "shop/web", ContainerID: "web2345678901"},
+				{ExternalPort: 9003, InternalPort: 9001, Protocol: "TCP", Name: "shop/web", ContainerID: "web2345678901"},
+				{ExternalPort: 7001, InternalPort: 7000, Protocol: "TCP", Name: "ws", ContainerID: "web2345678901"},
+			},
+		},
+		{
+			name: "Project defaults from another service",
+			containers: []container.Summary{
+				{
+					ID:    "web1234567890",
+					Names: []string{"/shop-web-1"},
+					Ports: []container.Port{{PublicPort: 8080, PrivatePort: 80, Type: "tcp"}},
+					Labels: composeLabels("shop", "web", "1", map[string]string{
+						labelForward:                    "published",
+						"gangplank.project.ttl":         "2h",
+						"gangplank.project.remote-host": "203.0.113.10",
+					}),
+				},
+				{
+					ID:    "api1234567890",
+					Names: []string{"/shop-api-1"},
+					Ports: []container.Port{{PublicPort: 8081, PrivatePort: 80, Type: "tcp"}},
+					Labels: composeLabels("shop", "api", "1", map[string]string{
+						labelForward: "published",
+						labelTTL:     "30m",
+					}),
+				},
+				{
+					ID:    "old1234567890",
+					Names: []string{"/legacy-web-1"},
+					Ports: []container.Port{{PublicPort: 9000, PrivatePort: 80, Type: "tcp"}},
+					Labels: composeLabels("legacy", "web", "1", map[string]string{
+						labelForward:                "published",
+						"gangplank.project.enabled": "false",
+					}),
+				},
+				{
+					ID:    "admin1234567890",
+					Names: []string{"/legacy-admin-1"},
+					Ports: []container.Port{{PublicPort: 9001, PrivatePort: 80, Type: "tcp"}},
+					Labels: composeLabels("legacy", "admin", "1", map[string]string{
+						labelForward: "published",
+						labelEnabled: "true",
+					}),
+				},
+				{
+					ID:    "legacyapi1234567890",
+					Names: []string{"/legacy-api-1"},
+					Ports: []container.Port{{PublicPort: 9002, PrivatePort: 80, Type: "tcp"}},
+					Labels: composeLabels("legacy", "api", "1", map[string]string{
+						labelForward: "published",
+						labelEnable:  "true",
+					}),
+				},
+				{
+					ID:     "other1234567890",
+					Names:  []string{"/blog-web-1"},
+					Ports:  []container.Port{{PublicPort: 8082, PrivatePort: 80, Type: "tcp"}},
+					Labels: composeLabels("blog", "web", "1", map[string]string{labelForward: "published"}),
+				},
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "shop/web", TTL: 2 * time.Hour, RemoteHost: "203.0.113.10", ContainerID: "web1234567890"},
+				{ExternalPort: 8081, InternalPort: 80, Protocol: "TCP", Name: "shop/api", TTL: 30 * time.Minute, RemoteHost: "203.0.113.10", ContainerID: "api1234567890"},
+				{ExternalPort: 9001, InternalPort: 80, Protocol: "TCP", Name: "legacy/admin", ContainerID: "admin1234567890"},
+				{ExternalPort: 9002, InternalPort: 80, Protocol: "TCP", Name: "legacy/api", ContainerID: "legacyapi1234567890"},
+				{ExternalPort: 8082, InternalPort: 80, Protocol: "TCP", Name: "blog/web", ContainerID: "other1234567890"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			portProvider := NewDockerPortProvider(&MockDockerClient{Containers: tt.containers}, ContainerSelector{})
+
+			gotPorts, err := portProvider.GetPortMappings()
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, tt.wantPorts, gotPorts)
+		})
+	}
+}
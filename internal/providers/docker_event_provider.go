@@ -2,10 +2,15 @@ package providers
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	dockerevents "github.com/docker/docker/api/types/events"
 	"log"
+	"slices"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/IonBazan/gangplank/internal/types"
 	"github.com/docker/docker/api/types/container"
@@ -16,126 +21,402 @@ import (
 type EventInspector interface {
 	Events(ctx context.Context, options dockerevents.ListOptions) (<-chan dockerevents.Message, <-chan error)
 	ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error)
+	ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error)
 }
 
+const (
+	defaultReconnectDelay    = time.Second
+	defaultMaxReconnectDelay = time.Minute
+)
+
 type DockerEventPortProvider struct {
-	dockerCli EventInspector
+	dockerCli   EventInspector
+	selector    ContainerSelector
+	closePaused bool
+
+	reconnectDelay    time.Duration
+	maxReconnectDelay time.Duration
+	reconnects        atomic.Uint64
+	connected         atomic.Bool
+	now               func() time.Time
+
+	// queue handles the events of each container in order, so a start and a die handled concurrently cannot leave
+	// the container forwarded.
+	queue *containerQueue
+	mu    sync.Mutex
+	// containers holds the mappings of each known container ID, so they can be deleted once the container is gone
+	// and repeated lifecycle events, like stop followed by die, are only handled once.
+	containers map[string]*containerState
+	// projects tracks the running containers of each compose project to read their project defaults.
+	projects *projectMembers
+}
+
+// containerState is what the event provider knows about a container.
+type containerState struct {
+	ports     []types.PortMapping
+	forwarded bool
 }
 
-func NewDockerEventPortProvider(cli EventInspector) *DockerEventPortProvider {
-	return &DockerEventPortProvider{dockerCli: cli}
+// NewDockerEventPortProvider follows container events. With closePaused, the ports of paused containers are removed
+// until they are unpaused.
+func NewDockerEventPortProvider(cli EventInspector, selector ContainerSelector, closePaused bool) *DockerEventPortProvider {
+	return &DockerEventPortProvider{
+		dockerCli:         cli,
+		selector:          selector,
+		closePaused:       closePaused,
+		reconnectDelay:    defaultReconnectDelay,
+		maxReconnectDelay: defaultMaxReconnectDelay,
+		now:               time.Now,
+		queue:             newContainerQueue(),
+		containers:        map[string]*containerState{},
+		projects:          newProjectMembers(),
+	}
 }
 
 func (d *DockerEventPortProvider) GetPortMappings() ([]types.PortMapping, error) {
 	return nil, nil
 }
 
+// Listen follows container events until the context is cancelled. When the event stream fails, e.g. because the
+// Docker daemon restarted, it reconnects with an increasing delay, replays the events missed in between and forwards
+// the ports of running containers that are not forwarded yet.
 func (d *DockerEventPortProvider) Listen(ctx context.Context, events PortEventChannels) {
+	since := d.now()
+	// Containers running before Gangplank started were forwarded from the container list, remember their mappings.
+	if err := d.prime(); err != nil {
+		log.Printf("Failed to list Docker containers: %v", err)
+	}
+	delay := d.reconnectDelay
+	for {
+		d.connected.Store(true)
+		err := d.follow(ctx, events, &since)
+		d.connected.Store(false)
+		if ctx.Err() != nil {
+			return
+		}
+		d.reconnects.Add(1)
+		log.Printf("Error receiving Docker events: %v, reconnecting in %s", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay = min(delay*2, d.maxReconnectDelay)
+
+		// The daemon is back once containers can be listed again.
+		if err := d.resync(events); err != nil {
+			log.Printf("Failed to resync Docker containers: %v", err)
+			continue
+		}
+		log.Printf("Reconnected to Docker events, replaying events since %s", since.Format(time.RFC3339))
+		delay = d.reconnectDelay
+	}
+}
+
+// Reconnects returns how many times the Docker event stream had to be reconnected.
+func (d *DockerEventPortProvider) Reconnects() uint64 {
+	return d.reconnects.Load()
+}
+
+// Connected reports whether the Docker event stream is being followed, i.e. it is not waiting to reconnect.
+func (d *DockerEventPortProvider) Connected() bool {
+	return d.connected.Load()
+}
+
+// follow handles the events received after since until the stream fails, and moves since along with them.
+func (d *DockerEventPortProvider) follow(ctx context.Context, events PortEventChannels, since *time.Time) error {
 	filterArgs := filters.NewArgs(
 		filters.Arg("type", "container"),
-		filters.Arg("event", "start"),
-		filters.Arg("event", "stop"),
-		filters.Arg("event", "die"),
+		filters.Arg("event", string(dockerevents.ActionStart)),
+		filters.Arg("event", string(dockerevents.ActionRestart)),
+		filters.Arg("event", string(dockerevents.ActionStop)),
+		filters.Arg("event", string(dockerevents.ActionDie)),
+		filters.Arg("event", string(dockerevents.ActionDestroy)),
+		filters.Arg("event", string(dockerevents.ActionHealthStatus)),
 	)
+	if d.closePaused {
+		filterArgs.Add("event", string(dockerevents.ActionPause))
+		filterArgs.Add("event", string(dockerevents.ActionUnPause))
+	}
 	eventChan, errChan := d.dockerCli.Events(ctx, dockerevents.ListOptions{
+		Since:   dockerTimestamp(*since),
 		Filters: filterArgs,
 	})
 	for {
 		select {
-		case event := <-eventChan:
-			switch event.Action {
-			case "start":
-				if events.Add != nil {
-					go d.handleContainerStart(event.Actor.ID, events.Add)
-				}
-			case "stop", "die":
-				if events.Delete != nil {
-					go d.handleContainerStop(event.Actor.ID, events.Delete)
-				}
+		case event, ok := <-eventChan:
+			if !ok {
+				return errors.New("event stream closed")
 			}
+			if event.TimeNano != 0 {
+				*since = time.Unix(0, event.TimeNano)
+			}
+			d.handle(event, events)
 		case err := <-errChan:
 			if err != nil {
-				log.Printf("Error receiving Docker events: %v", err)
-				return
+				return err
 			}
 		case <-ctx.Done():
-			return
+			return ctx.Err()
 		}
 	}
 }
 
-func (d *DockerEventPortProvider) handleContainerStart(containerID string, addCh chan<- types.PortMapping) {
-	info, err := d.dockerCli.ContainerInspect(context.Background(), containerID)
+// prime remembers the mappings of the running containers as forwarded.
+func (d *DockerEventPortProvider) prime() error {
+	byContainer, err := d.listRunning()
 	if err != nil {
-		log.Printf("Failed to inspect container %s: %v", containerID[:12], err)
-		return
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for containerID, ports := range byContainer {
+		d.containers[containerID] = &containerState{ports: ports, forwarded: true}
 	}
+	return nil
+}
 
-	var ports []container.Port
-	for portProto, bindings := range info.NetworkSettings.Ports {
-		for _, binding := range bindings {
-			if binding.HostPort == "" {
-				continue
-			}
-			extPort, _ := strconv.Atoi(binding.HostPort)
-			ports = append(ports, container.Port{
-				PrivatePort: uint16(portProto.Int()),
-				PublicPort:  uint16(extPort),
-				Type:        portProto.Proto(),
-			})
+// resync forwards the ports of running containers that are not forwarded yet, as they may have started while
+// disconnected, and withdraws the ports of forwarded containers that are gone, as their stop events may not be
+// replayed after a daemon restart.
+func (d *DockerEventPortProvider) resync(events PortEventChannels) error {
+	byContainer, err := d.listRunning()
+	if err != nil {
+		return err
+	}
+	for containerID, ports := range byContainer {
+		d.queue.run(containerID, func() {
+			d.transition(containerID, ports, true, events)
+		})
+	}
+	for _, containerID := range d.forwardedContainers() {
+		if _, running := byContainer[containerID]; running {
+			continue
 		}
+		d.queue.run(containerID, func() {
+			d.transition(containerID, nil, false, events)
+		})
 	}
+	return nil
+}
 
-	ctr := container.Summary{
-		ID:     info.ID,
-		Labels: info.Config.Labels,
-		Ports:  ports,
-	}
-	mappings := extractPortsFromContainer(ctr)
-	for _, m := range mappings {
-		if info.Name != "" {
-			m.Name = strings.TrimPrefix(info.Name, "/")
-		} else {
-			m.Name = containerID[:12]
+// forwardedContainers returns the IDs of the containers whose ports are forwarded.
+func (d *DockerEventPortProvider) forwardedContainers() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var ids []string
+	for containerID, state := range d.containers {
+		if state.forwarded {
+			ids = append(ids, containerID)
 		}
-		addCh <- m
 	}
+	return ids
 }
 
-func (d *DockerEventPortProvider) handleContainerStop(containerID string, deleteCh chan<- types.PortMapping) {
-	info, err := d.dockerCli.ContainerInspect(context.Background(), containerID)
+// listRunning returns the port mappings of the running containers like DockerPortProvider, and remembers the
+// containers of each compose project.
+func (d *DockerEventPortProvider) listRunning() (map[string][]types.PortMapping, error) {
+	lister := NewDockerPortProvider(d.dockerCli, d.selector)
+	containers, err := lister.runningContainers()
 	if err != nil {
-		log.Printf("Failed to inspect container %s: %v", containerID[:12], err)
+		return nil, err
+	}
+	d.projects.reset(containers)
+	return lister.mappingsByContainer(containers), nil
+}
+
+// handle queues the handling of a container event.
+func (d *DockerEventPortProvider) handle(event dockerevents.Message, events PortEventChannels) {
+	containerID := event.Actor.ID
+	switch event.Action {
+	case dockerevents.ActionStart, dockerevents.ActionRestart, dockerevents.ActionUnPause:
+		d.queue.run(containerID, func() { d.handleContainerStart(containerID, events) })
+	case dockerevents.ActionStop, dockerevents.ActionDie, dockerevents.ActionPause:
+		d.queue.run(containerID, func() { d.handleContainerStop(containerID, false, events) })
+	case dockerevents.ActionDestroy:
+		d.queue.run(containerID, func() { d.handleContainerStop(containerID, true, events) })
+	case dockerevents.ActionHealthStatusHealthy:
+		d.queue.run(containerID, func() { d.handleHealthChange(containerID, true, events) })
+	case dockerevents.ActionHealthStatusUnhealthy:
+		d.queue.run(containerID, func() { d.handleHealthChange(containerID, false, events) })
+	}
+}
+
+// transition moves a container to the forwarded or closed state, and sends the adds or deletes this requires. Events
+// that do not change the state, like a die after a stop, send nothing.
+func (d *DockerEventPortProvider) transition(containerID string, ports []types.PortMapping, forward bool, events PortEventChannels) {
+	d.mu.Lock()
+	state, known := d.containers[containerID]
+	if !known {
+		state = &containerState{}
+		d.containers[containerID] = state
+	}
+	previous, wasForwarded := state.ports, state.forwarded
+	state.ports, state.forwarded = ports, forward
+	d.mu.Unlock()
+
+	if !forward {
+		if wasForwarded {
+			send(events.Delete, previous)
+		}
+		return
+	}
+	if wasForwarded {
+		if slices.Equal(previous, ports) {
+			return
+		}
+		var stale []types.PortMapping
+		for _, m := range previous {
+			if !slices.Contains(ports, m) {
+				stale = append(stale, m)
+			}
+		}
+		send(events.Delete, stale)
+	}
+	send(events.Add, ports)
+}
+
+// forget drops what is known about a container.
+func (d *DockerEventPortProvider) forget(containerID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.containers, containerID)
+}
+
+// known returns whether the provider has seen the container before.
+func (d *DockerEventPortProvider) known(containerID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.containers[containerID]
+	return ok
+}
+
+func send(ch chan<- types.PortMapping, ports []types.PortMapping) {
+	if ch == nil {
+		return
+	}
+	for _, m := range ports {
+		ch <- m
+	}
+}
+
+// dockerTimestamp formats a time for the since and until options of the Docker events API.
+func dockerTimestamp(t time.Time) string {
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
+
+func (d *DockerEventPortProvider) handleContainerStart(containerID string, events PortEventChannels) {
+	ctr, ok := d.inspect(containerID)
+	if !ok {
 		return
 	}
+	ports := d.selector.PortMappings(ctr)
+	switch {
+	case ctr.State != "" && ctr.State != "running":
+		// The container stopped again before its start was handled, and its stop event follows.
+		d.transition(containerID, ports, false, events)
+	case waitsForHealth(ctr):
+		log.Printf("Waiting for container %s to become healthy before forwarding its ports", shortID(containerID))
+		d.transition(containerID, ports, false, events)
+	default:
+		d.transition(containerID, ports, true, events)
+	}
+}
+
+// handleContainerStop deletes the mappings added for a container. The container is only inspected when it is not
+// known to this provider, as containers started with --rm are often gone by then.
+func (d *DockerEventPortProvider) handleContainerStop(containerID string, destroyed bool, events PortEventChannels) {
+	d.projects.remove(containerID)
+	if d.known(containerID) {
+		d.transition(containerID, nil, false, events)
+	} else if ctr, ok := d.inspect(containerID); ok {
+		send(events.Delete, d.selector.PortMappings(ctr))
+		d.transition(containerID, nil, false, events)
+	}
+	if destroyed {
+		d.forget(containerID)
+	}
+}
+
+// handleHealthChange opens or closes the ports of containers labeled with gangplank.require-healthy when their health
+// check passes or fails.
+func (d *DockerEventPortProvider) handleHealthChange(containerID string, healthy bool, events PortEventChannels) {
+	ctr, ok := d.inspect(containerID)
+	if !ok || !requiresHealthy(ctr) {
+		return
+	}
+	d.transition(containerID, d.selector.PortMappings(ctr), healthy, events)
+}
+
+// inspect describes a container the way ContainerList does, so events and listings yield the same mappings.
+func (d *DockerEventPortProvider) inspect(containerID string) (container.Summary, bool) {
+	info, err := d.dockerCli.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		log.Printf("Failed to inspect container %s: %v", shortID(containerID), err)
+		return container.Summary{}, false
+	}
 
 	var ports []container.Port
-	for portProto, bindings := range info.NetworkSettings.Ports {
-		for _, binding := range bindings {
-			if binding.HostPort == "" {
-				continue
+	var networks *container.NetworkSettingsSummary
+	if info.NetworkSettings != nil {
+		for portProto, bindings := range info.NetworkSettings.Ports {
+			for _, binding := range bindings {
+				if binding.HostPort == "" {
+					continue
+				}
+				extPort, _ := strconv.Atoi(binding.HostPort)
+				ports = append(ports, container.Port{
+					PrivatePort: uint16(portProto.Int()),
+					PublicPort:  uint16(extPort),
+					Type:        portProto.Proto(),
+				})
 			}
-			extPort, _ := strconv.Atoi(binding.HostPort)
-			ports = append(ports, container.Port{
-				PrivatePort: uint16(portProto.Int()),
-				PublicPort:  uint16(extPort),
-				Type:        portProto.Proto(),
-			})
 		}
+		networks = &container.NetworkSettingsSummary{Networks: info.NetworkSettings.Networks}
 	}
 
 	ctr := container.Summary{
-		ID:     info.ID,
-		Labels: info.Config.Labels,
-		Ports:  ports,
-	}
-	mappings := extractPortsFromContainer(ctr)
-	for _, m := range mappings {
-		if info.Name != "" {
-			m.Name = strings.TrimPrefix(info.Name, "/")
-		} else {
-			m.Name = containerID[:12]
+		ID:              info.ID,
+		Names:           containerNames(info.Name),
+		Status:          summaryStatus(info.State),
+		State:           summaryState(info.State),
+		Ports:           ports,
+		NetworkSettings: networks,
+	}
+	if info.Config != nil {
+		ctr.Image = info.Config.Image
+		ctr.Labels = info.Config.Labels
+	}
+	return d.withProjectDefaults(ctr), true
+}
+
+// withProjectDefaults applies the gangplank.project.* labels declared by any running service of the container's
+// compose project, like DockerPortProvider does. The project is only listed the first time it is seen.
+func (d *DockerEventPortProvider) withProjectDefaults(ctr container.Summary) container.Summary {
+	project := ctr.Labels[labelComposeProject]
+	if project == "" {
+		return ctr
+	}
+	if !d.projects.tracked(project) {
+		services, err := d.dockerCli.ContainerList(context.Background(), container.ListOptions{
+			Filters: filters.NewArgs(
+				filters.Arg("status", "running"),
+				filters.Arg("label", labelComposeProject+"="+project),
+			),
+		})
+		if err != nil {
+			log.Printf("Failed to list containers of compose project %s: %v", project, err)
+			return ctr
 		}
-		deleteCh <- m
+		d.projects.setProject(project, services)
+	}
+	d.projects.update(ctr, ctr.State == "" || ctr.State == "running")
+	return d.projects.defaults(project).apply(ctr)
+}
+
+func containerNames(name string) []string {
+	if name == "" {
+		return nil
 	}
+	return []string{name}
 }
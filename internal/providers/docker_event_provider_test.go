@@ -2,7 +2,11 @@ package providers
 
 import (
 	"context"
+	"errors"
 	"github.com/docker/go-connections/nat"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -10,6 +14,7 @@ import (
 	"github.com/IonBazan/gangplank/internal/upnp"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,6 +22,7 @@ type MockEventClient struct {
 	EventsChan chan events.Message
 	ErrChan    chan error
 	Inspect    map[string]container.InspectResponse
+	Containers []container.Summary
 }
 
 func (m *MockEventClient) Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error) {
@@ -33,13 +39,26 @@ func (m *MockEventClient) ContainerInspect(ctx context.Context, containerID stri
 	return container.InspectResponse{}, assert.AnError
 }
 
+func (m *MockEventClient) ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error) {
+	var containers []container.Summary
+	for _, ctr := range m.Containers {
+		if options.Filters.ExactMatch("label", labelComposeProject+"="+ctr.Labels[labelComposeProject]) {
+			containers = append(containers, ctr)
+		}
+	}
+	return containers, nil
+}
+
 func TestDockerEventPortProvider_Listen(t *testing.T) {
 	tests := []struct {
-		name       string
-		containers map[string]container.InspectResponse
-		events     []events.Message
-		wantAdd    []types.PortMapping
-		wantDelete []types.PortMapping
+		name        string
+		selector    ContainerSelector
+		closePaused bool
+		containers  map[string]container.InspectResponse
+		listed      []container.Summary
+		events      []events.Message
+		wantAdd     []types.PortMapping
+		wantDelete  []types.PortMapping
 	}{
 		{
 			name: "Nginx start with published ports",
@@ -67,7 +86,7 @@ func TestDockerEventPortProvider_Listen(t *testing.T) {
 				{Action: "start", Actor: events.Actor{ID: "nginx1234567890"}},
 			},
 			wantAdd: []types.PortMapping{
-				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "nginx"},
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "nginx", ContainerID: "nginx1234567890"},
 			},
 			wantDelete: []types.PortMapping{},
 		},
@@ -98,10 +117,10 @@ func TestDockerEventPortProvider_Listen(t *testing.T) {
 				{Action: "stop", Actor: events.Actor{ID: "redis4567890123"}},
 			},
 			wantAdd: []types.PortMapping{
-				{ExternalPort: 6379, InternalPort: 6379, Protocol: "TCP", Name: "redis"},
+				{ExternalPort: 6379, InternalPort: 6379, Protocol: "TCP", Name: "redis", ContainerID: "redis4567890123"},
 			},
 			wantDelete: []types.PortMapping{
-				{ExternalPort: 6379, InternalPort: 6379, Protocol: "TCP", Name: "redis"},
+				{ExternalPort: 6379, InternalPort: 6379, Protocol: "TCP", Name: "redis", ContainerID: "redis4567890123"},
 			},
 		},
 		{
@@ -130,10 +149,250 @@ func TestDockerEventPortProvider_Listen(t *testing.T) {
 				{Action: "start", Actor: events.Actor{ID: "pg7890123456789"}},
 			},
 			wantAdd: []types.PortMapping{
-				{ExternalPort: 5433, InternalPort: 5432, Protocol: "TCP", Name: "postgres"},
+				{ExternalPort: 5433, InternalPort: 5432, Protocol: "TCP", Name: "postgres", ContainerID: "pg7890123456789"},
 			},
 			wantDelete: []types.PortMapping{},
 		},
+		{
+			name:     "All published ports of containers on a network",
+			selector: ContainerSelector{Policy: ForwardPolicyAllPublished, Networks: []string{"games"}},
+			containers: map[string]container.InspectResponse{
+				"game1234567890": {
+					ContainerJSONBase: &container.ContainerJSONBase{
+						ID:   "game1234567890",
+						Name: "/game",
+					},
+					NetworkSettings: &container.NetworkSettings{
+						NetworkSettingsBase: container.NetworkSettingsBase{
+							Ports: map[nat.Port][]nat.PortBinding{
+								"25565/udp": {{HostPort: "25565"}},
+							},
+						},
+						Networks: map[string]*network.EndpointSettings{"games": {}},
+					},
+					Config: &container.Config{Image: "itzg/minecraft-server"},
+				},
+				"web1234567890": {
+					ContainerJSONBase: &container.ContainerJSONBase{
+						ID:   "web1234567890",
+						Name: "/web",
+					},
+					NetworkSettings: &container.NetworkSettings{
+						NetworkSettingsBase: container.NetworkSettingsBase{
+							Ports: map[nat.Port][]nat.PortBinding{
+								"80/tcp": {{HostPort: "8080"}},
+							},
+						},
+						Networks: map[string]*network.EndpointSettings{"bridge": {}},
+					},
+					Config: &container.Config{Image: "nginx"},
+				},
+			},
+			events: []events.Message{
+				{Action: "start", Actor: events.Actor{ID: "game1234567890"}},
+				{Action: "start", Actor: events.Actor{ID: "web1234567890"}},
+			},
+			wantAdd: []types.PortMapping{
+				{ExternalPort: 25565, InternalPort: 25565, Protocol: "UDP", Name: "game", ContainerID: "game1234567890"},
+			},
+			wantDelete: []types.PortMapping{},
+		},
+		{
+			name: "Compose service with project defaults",
+			containers: map[string]container.InspectResponse{
+				"api1234567890": {
+					ContainerJSONBase: &container.ContainerJSONBase{
+						ID:   "api1234567890",
+						Name: "/shop-api-1",
+					},
+					NetworkSettings: &container.NetworkSettings{
+						NetworkSettingsBase: container.NetworkSettingsBase{
+							Ports: map[nat.Port][]nat.PortBinding{
+								"80/tcp": {{HostPort: "8081"}},
+							},
+						},
+					},
+					Config: &container.Config{
+						Labels: map[string]string{
+							labelForward:        "published",
+							labelComposeProject: "shop",
+							labelComposeService: "api",
+						},
+					},
+				},
+			},
+			listed: []container.Summary{
+				{ID: "api1234567890", Labels: map[string]string{labelComposeProject: "shop", labelComposeService: "api"}},
+				{ID: "web1234567890", Labels: map[string]string{labelComposeProject: "shop", labelComposeService: "web", "gangplank.project.ttl": "2h"}},
+				{ID: "blog1234567890", Labels: map[string]string{labelComposeProject: "blog", "gangplank.project.ttl": "5m"}},
+			},
+			events: []events.Message{
+				{Action: "start", Actor: events.Actor{ID: "api1234567890"}},
+			},
+			wantAdd: []types.PortMapping{
+				{ExternalPort: 8081, InternalPort: 80, Protocol: "TCP", Name: "shop/api", TTL: 2 * time.Hour, ContainerID: "api1234567890"},
+			},
+			wantDelete: []types.PortMapping{},
+		},
+		{
+			name:        "Pause and unpause",
+			closePaused: true,
+			containers: map[string]container.InspectResponse{
+				"web1234567890": {
+					ContainerJSONBase: &container.ContainerJSONBase{
+						ID:    "web1234567890",
+						Name:  "/web",
+						State: &container.State{Running: true},
+					},
+					NetworkSettings: &container.NetworkSettings{
+						NetworkSettingsBase: container.NetworkSettingsBase{
+							Ports: map[nat.Port][]nat.PortBinding{
+								"80/tcp": {{HostPort: "8080"}},
+							},
+						},
+					},
+					Config: &container.Config{
+						Labels: map[string]string{
+							labelForward: "published",
+						},
+					},
+				},
+			},
+			events: []events.Message{
+				{Action: events.ActionPause, Actor: events.Actor{ID: "web1234567890"}},
+				{Action: events.ActionUnPause, Actor: events.Actor{ID: "web1234567890"}},
+			},
+			wantAdd: []types.PortMapping{
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web", ContainerID: "web1234567890"},
+			},
+			wantDelete: []types.PortMapping{
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web", ContainerID: "web1234567890"},
+			},
+		},
+		{
+			name: "Health status of containers requiring a healthy status",
+			containers: map[string]container.InspectResponse{
+				"web1234567890": {
+					ContainerJSONBase: &container.ContainerJSONBase{
+						ID:    "web1234567890",
+						Name:  "/web",
+						State: &container.State{Running: true, Health: &container.Health{Status: container.Starting}},
+					},
+					NetworkSettings: &container.NetworkSettings{
+						NetworkSettingsBase: container.NetworkSettingsBase{
+							Ports: map[nat.Port][]nat.PortBinding{
+								"80/tcp": {{HostPort: "8080"}},
+							},
+						},
+					},
+					Config: &container.Config{
+						Labels: map[string]string{
+							labelForward:        "published",
+							labelRequireHealthy: "true",
+						},
+					},
+				},
+				"db1234567890": {
+					ContainerJSONBase: &container.ContainerJSONBase{
+						ID:    "db1234567890",
+						Name:  "/db",
+						State: &container.State{Running: true, Health: &container.Health{Status: container.Unhealthy}},
+					},
+					NetworkSettings: &container.NetworkSettings{
+						NetworkSettingsBase: container.NetworkSettingsBase{
+							Ports: map[nat.Port][]nat.PortBinding{
+								"5432/tcp": {{HostPort: "5432"}},
+							},
+						},
+					},
+					Config: &container.Config{
+						Labels: map[string]string{
+							labelForward: "published",
+						},
+					},
+				},
+			},
+			events: []events.Message{
+				{Action: events.ActionStart, Actor: events.Actor{ID: "web1234567890"}},
+				{Action: events.ActionHealthStatusHealthy, Actor: events.Actor{ID: "web1234567890"}},
+				{Action: events.ActionHealthStatusUnhealthy, Actor: events.Actor{ID: "web1234567890"}},
+				{Action: events.ActionStart, Actor: events.Actor{ID: "db1234567890"}},
+				{Action: events.ActionHealthStatusUnhealthy, Actor: events.Actor{ID: "db1234567890"}},
+			},
+			wantAdd: []types.PortMapping{
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web", ContainerID: "web1234567890"},
+				{ExternalPort: 5432, InternalPort: 5432, Protocol: "TCP", Name: "db", ContainerID: "db1234567890"},
+			},
+			wantDelete: []types.PortMapping{
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web", ContainerID: "web1234567890"},
+			},
+		},
+		{
+			name: "Stop and die are handled once",
+			containers: map[string]container.InspectResponse{
+				"web1234567890": {
+					ContainerJSONBase: &container.ContainerJSONBase{
+						ID:   "web1234567890",
+						Name: "/web",
+					},
+					NetworkSettings: &container.NetworkSettings{
+						NetworkSettingsBase: container.NetworkSettingsBase{
+							Ports: map[nat.Port][]nat.PortBinding{
+								"80/tcp": {{HostPort: "8080"}},
+							},
+						},
+					},
+					Config: &container.Config{
+						Labels: map[string]string{
+							labelForward: "published",
+						},
+					},
+				},
+			},
+			events: []events.Message{
+				{Action: events.ActionStart, Actor: events.Actor{ID: "web1234567890"}},
+				{Action: events.ActionRestart, Actor: events.Actor{ID: "web1234567890"}},
+				{Action: events.ActionStop, Actor: events.Actor{ID: "web1234567890"}},
+				{Action: events.ActionDie, Actor: events.Actor{ID: "web1234567890"}},
+				{Action: events.ActionDestroy, Actor: events.Actor{ID: "web1234567890"}},
+			},
+			wantAdd: []types.PortMapping{
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web", ContainerID: "web1234567890"},
+			},
+			wantDelete: []types.PortMapping{
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web", ContainerID: "web1234567890"},
+			},
+		},
+		{
+			name: "Start handled after the container exited",
+			containers: map[string]container.InspectResponse{
+				"job1234567890": {
+					ContainerJSONBase: &container.ContainerJSONBase{
+						ID:    "job1234567890",
+						Name:  "/job",
+						State: &container.State{Status: "exited"},
+					},
+					NetworkSettings: &container.NetworkSettings{
+						NetworkSettingsBase: container.NetworkSettingsBase{
+							Ports: map[nat.Port][]nat.PortBinding{
+								"80/tcp": {{HostPort: "8080"}},
+							},
+						},
+					},
+					Config: &container.Config{
+						Labels: map[string]string{
+							labelForward: "published",
+						},
+					},
+				},
+			},
+			events: []events.Message{
+				{Action: events.ActionStart, Actor: events.Actor{ID: "job1234567890"}},
+				{Action: events.ActionDie, Actor: events.Actor{ID: "job1234567890"}},
+			},
+			wantAdd:    []types.PortMapping{},
+			wantDelete: []types.PortMapping{},
+		},
 		{
 			name:       "No events",
 			containers: map[string]container.InspectResponse{},
@@ -151,8 +410,9 @@ func TestDockerEventPortProvider_Listen(t *testing.T) {
 				EventsChan: eventsChan,
 				ErrChan:    errChan,
 				Inspect:    tt.containers,
+				Containers: tt.listed,
 			}
-			portProvider := NewDockerEventPortProvider(mockClient)
+			portProvider := NewDockerEventPortProvider(mockClient, tt.selector, tt.closePaused)
 
 			addCh := make(chan types.PortMapping, 10)
 			deleteCh := make(chan types.PortMapping, 10)
@@ -193,3 +453,283 @@ func TestDockerEventPortProvider_Listen(t *testing.T) {
 		})
 	}
 }
+
+// reconnectingEventClient fails the first event stream and records the since option of each subscription. Its
+// containers only start once the first stream failed.
+type reconnectingEventClient struct {
+	MockEventClient
+	mu    sync.Mutex
+	since []string
+	// running is listed until the stream fails, Containers afterwards.
+	running []container.Summary
+	failed  bool
+}
+
+func (m *reconnectingEventClient) ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.failed {
+		return m.running, nil
+	}
+	return m.MockEventClient.ContainerList(ctx, options)
+}
+
+func (m *reconnectingEventClient) Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.since = append(m.since, options.Since)
+	if !m.failed {
+		m.failed = true
+		eventsChan := make(chan events.Message, 1)
+		errChan := make(chan error, 1)
+		eventsChan <- events.Message{Action: events.ActionStop, Actor: events.Actor{ID: "web1234567890"}, TimeNano: time.Unix(1700000100, 5).UnixNano()}
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			errChan <- errors.New("unexpected EOF")
+		}()
+		return eventsChan, errChan
+	}
+	return m.EventsChan, m.ErrChan
+}
+
+func (m *reconnectingEventClient) subscriptions() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.since)
+}
+
+func TestDockerEventPortProvider_Reconnect(t *testing.T) {
+	web := container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{ID: "web1234567890", Name: "/web"},
+		NetworkSettings: &container.NetworkSettings{
+			NetworkSettingsBase: container.NetworkSettingsBase{
+				Ports: map[nat.Port][]nat.PortBinding{"80/tcp": {{HostPort: "8080"}}},
+			},
+		},
+		Config: &container.Config{Labels: map[string]string{labelForward: "published"}},
+	}
+	mockClient := &reconnectingEventClient{MockEventClient: MockEventClient{
+		EventsChan: make(chan events.Message),
+		ErrChan:    make(chan error),
+		Inspect:    map[string]container.InspectResponse{"web1234567890": web},
+		Containers: []container.Summary{{
+			ID:     "api1234567890",
+			Names:  []string{"/api"},
+			Ports:  []container.Port{{PublicPort: 8081, PrivatePort: 80, Type: "tcp"}},
+			Labels: map[string]string{labelForward: "published"},
+		}},
+	}}
+	// The db container is removed while disconnected, and its events are not replayed.
+	mockClient.running = []container.Summary{{
+		ID:     "db1234567890",
+		Names:  []string{"/db"},
+		Ports:  []container.Port{{PublicPort: 5432, PrivatePort: 5432, Type: "tcp"}},
+		Labels: map[string]string{labelForward: "published"},
+	}}
+	portProvider := NewDockerEventPortProvider(mockClient, ContainerSelector{}, false)
+	portProvider.reconnectDelay = 10 * time.Millisecond
+	portProvider.now = func() time.Time { return time.Unix(1700000000, 0) }
+	assert.False(t, portProvider.Connected())
+
+	addCh := make(chan types.PortMapping, 10)
+	deleteCh := make(chan types.PortMapping, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go portProvider.Listen(ctx, PortEventChannels{Add: addCh, Delete: deleteCh})
+
+	select {
+	case m := <-deleteCh:
+		assert.Equal(t, types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web", ContainerID: "web1234567890"}, m)
+	case <-time.After(time.Second):
+		t.Fatal("stop event was not handled")
+	}
+	select {
+	case m := <-addCh:
+		assert.Equal(t, types.PortMapping{ExternalPort: 8081, InternalPort: 80, Protocol: "TCP", Name: "api", ContainerID: "api1234567890"}, m)
+	case <-time.After(time.Second):
+		t.Fatal("containers were not resynced after reconnecting")
+	}
+	select {
+	case m := <-deleteCh:
+		assert.Equal(t, types.PortMapping{ExternalPort: 5432, InternalPort: 5432, Protocol: "TCP", Name: "db", ContainerID: "db1234567890"}, m)
+	case <-time.After(time.Second):
+		t.Fatal("container gone while disconnected was not withdrawn")
+	}
+
+	assert.Eventually(t, func() bool { return len(mockClient.subscriptions()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"1700000000.000000000", "1700000100.000000005"}, mockClient.subscriptions())
+	assert.Equal(t, uint64(1), portProvider.Reconnects())
+	assert.True(t, portProvider.Connected(), "event stream is followed again")
+}
+
+// removedContainerClient can only inspect containers that were not removed yet, like containers started with --rm.
+type removedContainerClient struct {
+	MockEventClient
+	mu      sync.Mutex
+	removed map[string]bool
+}
+
+func (m *removedContainerClient) ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.removed[containerID] {
+		return container.InspectResponse{}, errors.New("No such container: " + containerID)
+	}
+	return m.MockEventClient.ContainerInspect(ctx, containerID)
+}
+
+func (m *removedContainerClient) remove(containerID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.removed[containerID] = true
+}
+
+func TestDockerEventPortProvider_StopRemovedContainer(t *testing.T) {
+	inspect := func(id, name, hostPort string) container.InspectResponse {
+		return container.InspectResponse{
+			ContainerJSONBase: &container.ContainerJSONBase{ID: id, Name: name},
+			NetworkSettings: &container.NetworkSettings{
+				NetworkSettingsBase: container.NetworkSettingsBase{
+					Ports: map[nat.Port][]nat.PortBinding{"80/tcp": {{HostPort: hostPort}}},
+				},
+			},
+			Config: &container.Config{Labels: map[string]string{labelForward: "published"}},
+		}
+	}
+	eventsChan := make(chan events.Message)
+	mockClient := &removedContainerClient{
+		MockEventClient: MockEventClient{
+			EventsChan: eventsChan,
+			ErrChan:    make(chan error),
+			Inspect: map[string]container.InspectResponse{
+				"web1234567890": inspect("web1234567890", "/web", "8080"),
+				"api1234567890": inspect("api1234567890", "/api", "8081"),
+			},
+			Containers: []container.Summary{{
+				ID:     "api1234567890",
+				Names:  []string{"/api"},
+				Ports:  []container.Port{{PublicPort: 8081, PrivatePort: 80, Type: "tcp"}},
+				Labels: map[string]string{labelForward: "published"},
+			}},
+		},
+		removed: map[string]bool{},
+	}
+	portProvider := NewDockerEventPortProvider(mockClient, ContainerSelector{}, false)
+
+	addCh := make(chan types.PortMapping, 10)
+	deleteCh := make(chan types.PortMapping, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go portProvider.Listen(ctx, PortEventChannels{Add: addCh, Delete: deleteCh})
+
+	web := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web", ContainerID: "web1234567890"}
+	eventsChan <- events.Message{Action: events.ActionStart, Actor: events.Actor{ID: "web1234567890"}}
+	select {
+	case m := <-addCh:
+		assert.Equal(t, web, m)
+	case <-time.After(time.Second):
+		t.Fatal("start event was not handled")
+	}
+
+	// Both the container started after Gangplank and the one running before are deleted once they are gone.
+	mockClient.remove("web1234567890")
+	mockClient.remove("api1234567890")
+	eventsChan <- events.Message{Action: events.ActionDie, Actor: events.Actor{ID: "web1234567890"}}
+	eventsChan <- events.Message{Action: events.ActionDestroy, Actor: events.Actor{ID: "api1234567890"}}
+
+	var gotDelete []types.PortMapping
+	for len(gotDelete) < 2 {
+		select {
+		case m := <-deleteCh:
+			gotDelete = append(gotDelete, m)
+		case <-time.After(time.Second):
+			t.Fatalf("missing deletes, got %v", gotDelete)
+		}
+	}
+	assert.ElementsMatch(t, []types.PortMapping{web, {ExternalPort: 8081, InternalPort: 80, Protocol: "TCP", Name: "api", ContainerID: "api1234567890"}}, gotDelete)
+}
+
+// countingEventClient counts the container listings.
+type countingEventClient struct {
+	MockEventClient
+	lists atomic.Int32
+}
+
+func (m *countingEventClient) ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error) {
+	m.lists.Add(1)
+	return m.MockEventClient.ContainerList(ctx, options)
+}
+
+func TestDockerEventPortProvider_ProjectDefaults(t *testing.T) {
+	web := container.Summary{
+		ID:     "web1234567890",
+		Names:  []string{"/shop-web-1"},
+		Labels: composeLabels("shop", "web", "1", map[string]string{"gangplank.project.ttl": "2h"}),
+	}
+	api := container.Summary{
+		ID:     "api1234567890",
+		Names:  []string{"/shop-api-1"},
+		Ports:  []container.Port{{PublicPort: 8081, PrivatePort: 80, Type: "tcp"}},
+		Labels: composeLabels("shop", "api", "1", map[string]string{labelForward: "published"}),
+	}
+	eventsChan := make(chan events.Message, 10)
+	mockClient := &countingEventClient{MockEventClient: MockEventClient{
+		EventsChan: eventsChan,
+		ErrChan:    make(chan error),
+		Inspect: map[string]container.InspectResponse{
+			"api1234567890": {
+				ContainerJSONBase: &container.ContainerJSONBase{ID: api.ID, Name: "/shop-api-1"},
+				NetworkSettings: &container.NetworkSettings{
+					NetworkSettingsBase: container.NetworkSettingsBase{
+						Ports: map[nat.Port][]nat.PortBinding{"80/tcp": {{HostPort: "8081"}}},
+					},
+				},
+				Config: &container.Config{Labels: api.Labels},
+			},
+		},
+		Containers: []container.Summary{web},
+	}}
+	portProvider := NewDockerEventPortProvider(mockClient, ContainerSelector{}, false)
+
+	addCh := make(chan types.PortMapping, 10)
+	deleteCh := make(chan types.PortMapping, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go portProvider.Listen(ctx, PortEventChannels{Add: addCh, Delete: deleteCh})
+
+	receive := func() types.PortMapping {
+		select {
+		case m := <-addCh:
+			return m
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for a port mapping")
+			return types.PortMapping{}
+		}
+	}
+	// The event path must build the same mapping as a listing of the running containers.
+	listed := func(running ...container.Summary) types.PortMapping {
+		ports, err := NewDockerPortProvider(&MockDockerClient{Containers: running}, ContainerSelector{}).GetPortMappings()
+		assert.NoError(t, err)
+		assert.Len(t, ports, 1)
+		return ports[0]
+	}
+
+	eventsChan <- events.Message{Action: "start", Actor: events.Actor{ID: api.ID}}
+	got := receive()
+	assert.Equal(t, 2*time.Hour, got.TTL)
+	assert.Equal(t, listed(web, api), got)
+
+	// Once the service declaring the defaults stopped, they no longer apply.
+	eventsChan <- events.Message{Action: "die", Actor: events.Actor{ID: web.ID}}
+	eventsChan <- events.Message{Action: "die", Actor: events.Actor{ID: api.ID}}
+	// Events of different containers are handled concurrently.
+	assert.Eventually(t, func() bool {
+		return len(portProvider.projects.defaults("shop")) == 0
+	}, time.Second, 10*time.Millisecond)
+	eventsChan <- events.Message{Action: "start", Actor: events.Actor{ID: api.ID}}
+	got = receive()
+	assert.Zero(t, got.TTL)
+	assert.Equal(t, listed(api), got)
+
+	assert.Equal(t, int32(1), mockClient.lists.Load(), "only the initial listing is needed")
+}
@@ -0,0 +1,67 @@
+package providers
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// requiresHealthy reports whether the container asks to be forwarded only while its health check passes.
+func requiresHealthy(ctr container.Summary) bool {
+	val, ok := ctr.Labels[labelRequireHealthy]
+	if !ok {
+		return false
+	}
+	required, err := strconv.ParseBool(strings.TrimSpace(val))
+	if err != nil {
+		log.Printf("Invalid %s label for container %s: %v", labelRequireHealthy, shortID(ctr.ID), err)
+		return false
+	}
+	return required
+}
+
+// waitsForHealth reports whether the ports of a container must stay closed until it becomes healthy. The health is
+// read from the status, e.g. "Up 5 minutes (healthy)", like the one reported by ContainerList.
+func waitsForHealth(ctr container.Summary) bool {
+	return requiresHealthy(ctr) && !strings.Contains(ctr.Status, "("+container.Healthy+")")
+}
+
+// summaryStatus describes the state of an inspected container the way ContainerList does.
+func summaryStatus(state *container.State) string {
+	if state == nil {
+		return ""
+	}
+	status := "Up"
+	if !state.Running {
+		status = "Exited"
+	}
+	if state.Paused {
+		status += " (Paused)"
+	} else if state.Health != nil {
+		switch state.Health.Status {
+		case container.Healthy, container.Unhealthy:
+			status += " (" + state.Health.Status + ")"
+		case container.Starting:
+			status += " (health: starting)"
+		}
+	}
+	return status
+}
+
+// summaryState returns the state of an inspected container, e.g. "running", or an empty string when it is unknown.
+func summaryState(state *container.State) string {
+	switch {
+	case state == nil:
+		return ""
+	case state.Status != "":
+		return state.Status
+	case state.Paused:
+		return "paused"
+	case state.Running:
+		return "running"
+	default:
+		return "exited"
+	}
+}
@@ -0,0 +1,158 @@
+package providers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/IonBazan/gangplank/internal/types"
+)
+
+// labelPortsPrefix starts the indexed per-port labels, e.g. gangplank.ports.web.external=443.
+const labelPortsPrefix = "gangplank.ports."
+
+const (
+	portKeyExternal = "external"
+	portKeyInternal = "internal"
+	portKeyProtocol = "protocol"
+)
+
+// indexedPortKeys are the keys accepted after gangplank.ports.<name>. Besides the ports and the protocol, they match
+// the options of a port entry.
+var indexedPortKeys = []string{
+	portKeyExternal,
+	portKeyInternal,
+	portKeyProtocol,
+	types.OptionEnabled,
+	types.OptionTTL,
+	types.OptionDescription,
+	types.OptionRemoteHost,
+	types.OptionPriority,
+}
+
+// parseIndexedLabels reads gangplank.ports.<name>.<key> labels. The name becomes the mapping name and must not be
+// used by another mapping of the container, and the mapping must not overlap with the existing ones.
+func parseIndexedLabels(info ContainerInfo, existing []types.PortMapping) ([]types.PortMapping, []error) {
+	ports := map[string]map[string]string{}
+	var errs []error
+	for label, value := range info.Labels {
+		rest, ok := strings.CutPrefix(label, labelPortsPrefix)
+		if !ok {
+			continue
+		}
+		name, key, ok := strings.Cut(rest, ".")
+		if !ok || name == "" || !isIndexedPortKey(key) {
+			errs = append(errs, &LabelError{Container: info.ContainerName, Label: label, Entry: value,
+				Err: fmt.Errorf("expected %s<name>.<key> with key one of %s", labelPortsPrefix, strings.Join(indexedPortKeys, ", "))})
+			continue
+		}
+		if ports[name] == nil {
+			ports[name] = map[string]string{}
+		}
+		ports[name][key] = strings.TrimSpace(value)
+	}
+
+	names := make([]string, 0, len(ports))
+	for name := range ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	usedNames := map[string]bool{}
+	usedKeys := map[string]string{}
+	for _, m := range existing {
+		usedNames[m.Name] = true
+		usedKeys[m.Key()] = m.Name
+	}
+
+	var mappings []types.PortMapping
+	for _, name := range names {
+		label := labelPortsPrefix + name
+		fail := func(err error) {
+			errs = append(errs, &LabelError{Container: info.ContainerName, Label: label, Entry: formatIndexedPort(ports[name]), Err: err})
+		}
+
+		if usedNames[name] {
+			fail(fmt.Errorf("name %q is already used by another port mapping of the container", name))
+			continue
+		}
+		portMappings, err := indexedPortMappings(name, ports[name], composeReplica(info.Labels))
+		if err != nil {
+			fail(err)
+			continue
+		}
+
+		collision := ""
+		for _, m := range portMappings {
+			if other, ok := usedKeys[m.Key()]; ok {
+				collision = fmt.Sprintf("port %s is already forwarded as %s", m.Key(), other)
+				break
+			}
+		}
+		if collision != "" {
+			fail(fmt.Errorf("%s", collision))
+			continue
+		}
+
+		for _, m := range portMappings {
+			usedKeys[m.Key()] = name
+		}
+		usedNames[name] = true
+		mappings = append(mappings, portMappings...)
+	}
+
+	return mappings, errs
+}
+
+func indexedPortMappings(name string, keys map[string]string, replica int) ([]types.PortMapping, error) {
+	external, internal := keys[portKeyExternal], keys[portKeyInternal]
+	options := types.MappingOptions{{Key: types.OptionName, Value: name}}
+	if strings.EqualFold(external, "auto") {
+		external = ""
+		options = append(options, types.MappingOption{Key: types.OptionExternal, Value: "auto"})
+	}
+	if external == "" && internal == "" {
+		return nil, fmt.Errorf("%s or %s port is required", portKeyExternal, portKeyInternal)
+	}
+
+	target := external + ":" + internal
+	if protocol := keys[portKeyProtocol]; protocol != "" {
+		target += "/" + protocol
+	}
+	mapping, err := types.ParsePortMapping(target)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range []string{types.OptionEnabled, types.OptionTTL, types.OptionDescription, types.OptionRemoteHost, types.OptionPriority} {
+		if value, ok := keys[key]; ok {
+			options = append(options, types.MappingOption{Key: key, Value: value})
+		}
+	}
+	if err := options.Apply(&mapping); err != nil {
+		return nil, err
+	}
+	shiftForReplica(&mapping, replica)
+
+	return mapping.Expand()
+}
+
+func isIndexedPortKey(key string) bool {
+	for _, known := range indexedPortKeys {
+		if key == known {
+			return true
+		}
+	}
+	return false
+}
+
+// formatIndexedPort describes the labels of an indexed port for error messages.
+func formatIndexedPort(keys map[string]string) string {
+	parts := make([]string, 0, len(keys))
+	for _, key := range indexedPortKeys {
+		if value, ok := keys[key]; ok {
+			parts = append(parts, key+"="+value)
+		}
+	}
+	return strings.Join(parts, ";")
+}
@@ -0,0 +1,139 @@
+package providers
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIndexedLabels(t *testing.T) {
+	tests := []struct {
+		name       string
+		labels     map[string]string
+		existing   []types.PortMapping
+		wantPorts  []types.PortMapping
+		wantErrors []string
+	}{
+		{
+			name: "Ports with options",
+			labels: map[string]string{
+				"gangplank.ports.web.external":    "443",
+				"gangplank.ports.web.internal":    "8443",
+				"gangplank.ports.web.protocol":    "tcp",
+				"gangplank.ports.web.ttl":         "2h",
+				"gangplank.ports.game.internal":   "27015-27016",
+				"gangplank.ports.game.protocol":   "udp",
+				"gangplank.ports.admin.external":  "9000",
+				"gangplank.ports.admin.enabled":   "false",
+				"gangplank.ports.voice.external":  "auto",
+				"gangplank.ports.voice.internal":  "9987",
+				"gangplank.ports.voice.protocol":  "UDP",
+				"gangplank.ports.dns.internal":    "53",
+				"gangplank.ports.dns.protocol":    "both",
+				"gangplank.ports.dns.remote-host": "203.0.113.10",
+				"gangplank.forward":               "published",
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 53, InternalPort: 53, Protocol: "TCP", Name: "dns", RemoteHost: "203.0.113.10"},
+				{ExternalPort: 53, InternalPort: 53, Protocol: "UDP", Name: "dns", RemoteHost: "203.0.113.10"},
+				{ExternalPort: 27015, InternalPort: 27015, Protocol: "UDP", Name: "game"},
+				{ExternalPort: 27016, InternalPort: 27016, Protocol: "UDP", Name: "game"},
+				{ExternalPort: 9987, InternalPort: 9987, Protocol: "UDP", Name: "voice", AutoExternalPort: true},
+				{ExternalPort: 443, InternalPort: 8443, Protocol: "TCP", Name: "web", TTL: 2 * time.Hour},
+			},
+		},
+		{
+			name: "Invalid keys and values",
+			labels: map[string]string{
+				"gangplank.ports.web.color":       "blue",
+				"gangplank.ports..external":       "443",
+				"gangplank.ports.empty.protocol":  "tcp",
+				"gangplank.ports.bad.external":    "abc",
+				"gangplank.ports.ok.external":     "8080",
+				"gangplank.ports.ok.internal":     "80",
+				"gangplank.ports.ok.description":  "OK",
+				"gangplank.ports.ttl.external":    "8081",
+				"gangplank.ports.ttl.ttl":         "forever",
+				"gangplank.ports.web.external":    "443",
+				"gangplank.ports.nested.web.ttl":  "2h",
+				"gangplank.forward.container":     "80/tcp",
+				"gangplank.ports.other.whatever.": "x",
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "ok", Description: "OK"},
+				{ExternalPort: 443, InternalPort: 443, Protocol: "TCP", Name: "web"},
+			},
+			wantErrors: []string{
+				`invalid gangplank.ports.web.color entry "blue"`,
+				`invalid gangplank.ports..external entry "443"`,
+				`invalid gangplank.ports.nested.web.ttl entry "2h"`,
+				`invalid gangplank.ports.other.whatever. entry "x"`,
+				`invalid gangplank.ports.bad entry "external=abc"`,
+				`invalid gangplank.ports.empty entry "protocol=tcp" for container app: external or internal port is required`,
+				`invalid gangplank.ports.ttl entry "external=8081;ttl=forever" for container app: Invalid ttl "forever"`,
+			},
+		},
+		{
+			name: "Collisions with other labels",
+			labels: map[string]string{
+				"gangplank.ports.https.external": "443",
+				"gangplank.ports.alt.external":   "8080",
+				"gangplank.ports.alt.internal":   "80",
+				"gangplank.ports.new.external":   "8443",
+			},
+			existing: []types.PortMapping{
+				{ExternalPort: 8443, InternalPort: 443, Protocol: "TCP", Name: "https"},
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "app"},
+			},
+			wantPorts: []types.PortMapping{},
+			wantErrors: []string{
+				`invalid gangplank.ports.alt entry "external=8080;internal=80" for container app: port 8080/TCP is already forwarded as app`,
+				`invalid gangplank.ports.https entry "external=443" for container app: name "https" is already used by another port mapping of the container`,
+				`invalid gangplank.ports.new entry "external=8443" for container app: port 8443/TCP is already forwarded as https`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := ContainerInfo{Labels: tt.labels, ContainerName: "app", ID: "app1234567890"}
+
+			gotPorts, errs := parseIndexedLabels(info, tt.existing)
+			assert.ElementsMatch(t, tt.wantPorts, gotPorts)
+
+			var gotErrors []string
+			for _, err := range errs {
+				gotErrors = append(gotErrors, err.Error())
+			}
+			assert.Len(t, gotErrors, len(tt.wantErrors))
+			for _, want := range tt.wantErrors {
+				assert.True(t, slices.ContainsFunc(gotErrors, func(got string) bool { return strings.HasPrefix(got, want) }),
+					"missing error %q in %v", want, gotErrors)
+			}
+		})
+	}
+}
+
+func TestExtractPortsFromContainer_IndexedLabels(t *testing.T) {
+	ctr := container.Summary{
+		ID:    "app1234567890",
+		Names: []string{"/app"},
+		Labels: map[string]string{
+			labelForward:                     "8080:80/tcp;name=http",
+			"gangplank.ports.https.external": "443",
+			"gangplank.ports.https.internal": "8443",
+			"gangplank.ports.https.priority": "5",
+			labelTTL:                         "1h",
+		},
+	}
+
+	assert.ElementsMatch(t, []types.PortMapping{
+		{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "http", TTL: time.Hour, ContainerID: "app1234567890"},
+		{ExternalPort: 443, InternalPort: 8443, Protocol: "TCP", Name: "https", TTL: time.Hour, Priority: 5, ContainerID: "app1234567890"},
+	}, extractPortsFromContainer(ctr))
+}
@@ -1,9 +1,13 @@
 package providers
 
 import (
+	"fmt"
 	"log"
+	"sort"
 	"strconv"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/IonBazan/gangplank/internal/types"
 	"github.com/docker/docker/api/types/container"
@@ -14,15 +18,53 @@ type ContainerInfo struct {
 	Ports         []container.Port
 	ContainerName string
 	ID            string
+	Image         string
+}
+
+// DescriptionData is available to the gangplank.description template, e.g. "{{.Service}} ({{.Image}})".
+type DescriptionData struct {
+	Name         string
+	Image        string
+	Service      string
+	Project      string
+	ExternalPort int
+	InternalPort int
+	Protocol     string
 }
 
 const labelForward = "gangplank.forward"
 const labelForwardContainer = "gangplank.forward.container"
+const labelRemoteHost = "gangplank.remote-host"
+const labelTTL = "gangplank.ttl"
+const labelDescription = "gangplank.description"
+const labelEnabled = "gangplank.enabled"
+
+// labelEnable is accepted as an alias of labelEnabled, matching the enable labels of other tools such as Traefik.
+const labelEnable = "gangplank.enable"
+const labelRequireHealthy = "gangplank.require-healthy"
+const labelPriority = "gangplank.priority"
+
+const (
+	labelComposeService = "com.docker.compose.service"
+	labelComposeProject = "com.docker.compose.project"
+)
+
+// enabledLabel returns the gangplank.enabled label of a container, or its gangplank.enable alias.
+func enabledLabel(labels map[string]string) (string, string, bool) {
+	for _, label := range []string{labelEnabled, labelEnable} {
+		if val, ok := labels[label]; ok {
+			return label, val, true
+		}
+	}
+	return "", "", false
+}
 
 func extractPortsFromContainer(ctr container.Summary) []types.PortMapping {
 	var mappings []types.PortMapping
 	containerName := shortID(ctr.ID)
-	if len(ctr.Names) > 0 {
+	if name, ok := composeName(ctr.Labels); ok {
+		containerName = name
+	} else if len(ctr.Names) > 0 {
 		containerName = strings.TrimPrefix(ctr.Names[0], "/")
 	}
 	info := ContainerInfo{
@@ -30,75 +72,322 @@ func extractPortsFromContainer(ctr container.Summary) []types.PortMapping {
 		Ports:         ctr.Ports,
 		ContainerName: containerName,
 		ID:            ctr.ID,
+		Image:         ctr.Image,
 	}
 
-	if val, ok := ctr.Labels[labelForward]; ok {
-		mappings = append(mappings, parseDockerLabel(val, info, false)...)
+	if label, val, ok := enabledLabel(ctr.Labels); ok {
+		if enabled, err := strconv.ParseBool(strings.TrimSpace(val)); err != nil {
+			log.Printf("Invalid %s label for container %s: %v", label, shortID(ctr.ID), err)
+		} else if !enabled {
+			return nil
+		}
+	}
+
+	for _, labelName := range []string{labelForward, labelForwardContainer} {
+		if val, ok := ctr.Labels[labelName]; ok {
+			labelMappings, errs := parseDockerLabel(labelName, val, info)
+			for _, err := range errs {
+				log.Print(err)
+			}
+			mappings = append(mappings, labelMappings...)
+		}
 	}
-	if val, ok := ctr.Labels[labelForwardContainer]; ok {
-		mappings = append(mappings, parseDockerLabel(val, info, true)...)
+	indexedMappings, errs := parseIndexedLabels(info, mappings)
+	for _, err := range errs {
+		log.Print(err)
 	}
+	mappings = append(mappings, indexedMappings...)
 
+	if remoteHost, ok := ctr.Labels[labelRemoteHost]; ok && len(mappings) > 0 {
+		remoteHost = strings.TrimSpace(remoteHost)
+		for i := range mappings {
+			if mappings[i].RemoteHost != "" {
+				continue
+			}
+			mappings[i].RemoteHost = remoteHost
+			// Never fall back to opening a restricted mapping to everyone.
+			if err := mappings[i].Validate(); err != nil {
+				log.Printf("Invalid %s label for container %s, skipping its port mappings: %v", labelRemoteHost, shortID(ctr.ID), err)
+				return nil
+			}
+		}
+	}
+
+	mappings = applyMappingOptions(mappings, info)
+	for i := range mappings {
+		mappings[i].ContainerID = ctr.ID
+	}
 	return mappings
 }
 
-func parseDockerLabel(label string, info ContainerInfo, isContainerRef bool) []types.PortMapping {
-	var mappings []types.PortMapping
-	parts := strings.Split(label, ",")
+// applyMappingOptions sets the lease duration, priority and description requested by the container labels on mappings
+// that do not set their own, and renders description templates.
+func applyMappingOptions(mappings []types.PortMapping, info ContainerInfo) []types.PortMapping {
+	if val, ok := info.Labels[labelPriority]; ok {
+		priority, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil {
+			log.Printf("Invalid %s label %q for container %s, using the default priority", labelPriority, val, shortID(info.ID))
+		} else {
+			for i := range mappings {
+				if mappings[i].Priority == 0 {
+					mappings[i].Priority = priority
+				}
+			}
+		}
+	}
 
-	for _, part := range parts {
-		part = strings.TrimSpace(part)
-		if part == "published" {
-			for _, port := range info.Ports {
-				if port.PublicPort == 0 {
-					continue
+	if val, ok := info.Labels[labelTTL]; ok {
+		ttl, err := time.ParseDuration(strings.TrimSpace(val))
+		if err != nil || ttl < 0 {
+			log.Printf("Invalid %s label %q for container %s, using the default lease duration", labelTTL, val, shortID(info.ID))
+		} else {
+			for i := range mappings {
+				if mappings[i].TTL == 0 {
+					mappings[i].TTL = ttl
 				}
-				mappings = append(mappings, types.PortMapping{
-					ExternalPort: int(port.PublicPort),
-					InternalPort: int(port.PrivatePort),
-					Protocol:     strings.ToUpper(port.Type),
-					Name:         info.ContainerName,
-				})
 			}
+		}
+	}
+
+	labelTemplate := info.Labels[labelDescription]
+	for i := range mappings {
+		text := mappings[i].Description
+		if text == "" {
+			text = labelTemplate
+		}
+		if text == "" {
 			continue
 		}
+		mappings[i].Description = ""
+		tmpl, err := template.New(labelDescription).Option("missingkey=error").Parse(text)
+		if err != nil {
+			log.Printf("Invalid description template %q for container %s, using the default description: %v", text, shortID(info.ID), err)
+			continue
+		}
+		var description strings.Builder
+		err = tmpl.Execute(&description, DescriptionData{
+			Name:         info.ContainerName,
+			Image:        info.Image,
+			Service:      info.Labels[labelComposeService],
+			Project:      info.Labels[labelComposeProject],
+			ExternalPort: mappings[i].ExternalPort,
+			InternalPort: mappings[i].InternalPort,
+			Protocol:     mappings[i].Protocol,
+		})
+		if err != nil {
+			log.Printf("Failed to render description template %q for container %s, using the default description: %v", text, shortID(info.ID), err)
+			continue
+		}
+		mappings[i].Description = description.String()
+	}
+	return mappings
+}
 
-		if isContainerRef {
-			fields := strings.Split(part, "/")
-			protocol := "TCP"
-			if len(fields) == 2 && fields[1] != "" {
-				upperProtocol := strings.ToUpper(fields[1])
-				if upperProtocol == "TCP" || upperProtocol == "UDP" {
-					protocol = upperProtocol
-				}
+// LabelError is an invalid entry in a gangplank label of a container.
+type LabelError struct {
+	Container string
+	Label     string
+	Entry     string
+	Err       error
+}
+
+func (e *LabelError) Error() string {
+	return fmt.Sprintf("invalid %s entry %q for container %s: %v", e.Label, e.Entry, e.Container, e.Err)
+}
+
+func (e *LabelError) Unwrap() error {
+	return e.Err
+}
+
+// parseDockerLabel parses the entries of a gangplank.forward or gangplank.forward.container label, see
+// types.ParsePortEntry for the grammar. Invalid entries are skipped and reported as LabelErrors.
+func parseDockerLabel(labelName, label string, info ContainerInfo) ([]types.PortMapping, []error) {
+	var mappings []types.PortMapping
+	var errs []error
+
+	for _, part := range strings.Split(label, ",") {
+		part = strings.TrimSpace(part)
+		entryMappings, err := parseLabelEntry(labelName, part, info)
+		if err != nil {
+			errs = append(errs, &LabelError{Container: info.ContainerName, Label: labelName, Entry: part, Err: err})
+			continue
+		}
+		mappings = append(mappings, entryMappings...)
+	}
+	return mappings, errs
+}
+
+func parseLabelEntry(labelName, entry string, info ContainerInfo) ([]types.PortMapping, error) {
+	target, options, err := types.ParsePortEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []types.PortMapping
+	switch {
+	case target == "published":
+		if options.Has(types.OptionExternal) {
+			return nil, fmt.Errorf("option %s cannot be used with published ports", types.OptionExternal)
+		}
+		for _, group := range groupPublishedPorts(info.Ports) {
+			group.Name = info.ContainerName
+			if err := options.Apply(&group); err != nil {
+				return nil, err
 			}
-			intPort, err := strconv.Atoi(fields[0])
-			if err != nil {
-				log.Printf("Invalid container port %s for container %s: %v", fields[0], shortID(info.ID), err)
+			candidates = append(candidates, group)
+		}
+	case labelName == labelForwardContainer:
+		candidates, err = resolveContainerPorts(target, options, info)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		mapping, err := types.ParsePortMapping(entry)
+		if err != nil {
+			return nil, err
+		}
+		if !options.Has(types.OptionName) {
+			mapping.Name = info.ContainerName
+		}
+		shiftForReplica(&mapping, composeReplica(info.Labels))
+		candidates = append(candidates, mapping)
+	}
+
+	return types.ExpandPortMappings(candidates)
+}
+
+// resolveContainerPorts finds the host ports published for a "[<external>:]<container port>[/<protocol>]" reference.
+// Without an external port, the published host port is forwarded as is. With one, the router forwards the chosen
+// external port to the published host port.
+func resolveContainerPorts(target string, options types.MappingOptions, info ContainerInfo) ([]types.PortMapping, error) {
+	fields := strings.Split(target, "/")
+	protocols := []string{"TCP"}
+	if len(fields) == 2 && fields[1] != "" {
+		ref := types.PortMapping{Protocol: fields[1]}
+		upperProtocol := strings.ToUpper(fields[1])
+		if ref.IsBothProtocols() {
+			protocols = []string{"TCP", "UDP"}
+		} else if upperProtocol == "TCP" || upperProtocol == "UDP" {
+			protocols = []string{upperProtocol}
+		}
+	}
+
+	extPart, intPart, hasExternal := strings.Cut(fields[0], ":")
+	if !hasExternal {
+		extPart, intPart = "", extPart
+	}
+	intPort, intPortEnd, err := types.ParsePortRange(intPart)
+	if err != nil {
+		return nil, fmt.Errorf("invalid container port %s: %v", intPart, err)
+	}
+	intPortEnd = max(intPort, intPortEnd)
+	if intPortEnd-intPort+1 > types.MaxPortRangeSize {
+		return nil, fmt.Errorf("invalid container port %s: at most %d ports are allowed in a range", intPart, types.MaxPortRangeSize)
+	}
+
+	extPort := 0
+	if extPart != "" {
+		if options.Has(types.OptionExternal) {
+			return nil, fmt.Errorf("external port %s is set together with the ext option", extPart)
+		}
+		var extPortEnd int
+		extPort, extPortEnd, err = types.ParsePortRange(extPart)
+		if err != nil {
+			return nil, fmt.Errorf("invalid external port %s: %v", extPart, err)
+		}
+		if extPortEnd != 0 && extPortEnd-extPort != intPortEnd-intPort {
+			return nil, fmt.Errorf("external port range %s must be the same size as container port range %s", extPart, intPart)
+		}
+	}
+
+	var mappings []types.PortMapping
+	for port := intPort; port <= intPortEnd; port++ {
+		for _, protocol := range protocols {
+			mapping, ok := findPublishedPort(info, port, protocol)
+			if !ok {
 				continue
 			}
-			for _, port := range info.Ports {
-				if int(port.PrivatePort) == intPort && port.PublicPort != 0 {
-					mappings = append(mappings, types.PortMapping{
-						ExternalPort: int(port.PublicPort),
-						InternalPort: intPort,
-						Protocol:     protocol,
-						Name:         info.ContainerName,
-					})
-					break
-				}
+			hostPort := mapping.ExternalPort
+			if extPort != 0 {
+				mapping.ExternalPort = extPort
 			}
-		} else {
-			mapping, err := types.ParsePortMapping(part)
-			if err != nil {
-				log.Printf("Invalid port mapping %s for container %s: %v", part, shortID(info.ID), err)
-				continue
+			if err := options.Apply(&mapping); err != nil {
+				return nil, err
+			}
+			// An explicit external port applies to the start of the referenced range and is forwarded to the host
+			// port Docker published, not to the container port.
+			if extPort != 0 || (options.Has(types.OptionExternal) && !mapping.AutoExternalPort) {
+				mapping.ExternalPort += port - intPort + composeReplica(info.Labels)*(intPortEnd-intPort+1)
+				mapping.InternalPort = hostPort
 			}
-			mapping.Name = info.ContainerName
 			mappings = append(mappings, mapping)
 		}
 	}
-	return mappings
+	return mappings, nil
+}
+
+// findPublishedPort finds the host binding of a container port with the given protocol.
+func findPublishedPort(info ContainerInfo, intPort int, protocol string) (types.PortMapping, bool) {
+	for _, port := range info.Ports {
+		if int(port.PrivatePort) == intPort && port.PublicPort != 0 && publishedProtocolMatches(port.Type, protocol) {
+			return types.PortMapping{
+				ExternalPort: int(port.PublicPort),
+				InternalPort: intPort,
+				Protocol:     protocol,
+				Name:         info.ContainerName,
+			}, true
+		}
+	}
+	return types.PortMapping{}, false
+}
+
+// publishedProtocolMatches compares the type of a published port with a protocol. Ports without a type are TCP.
+func publishedProtocolMatches(portType, protocol string) bool {
+	if portType == "" {
+		portType = "tcp"
+	}
+	return strings.EqualFold(portType, protocol)
+}
+
+// groupPublishedPorts collapses consecutive published ports, as created by "-p 27015-27030:27015-27030/udp", into
+// port ranges. Bindings repeated for IPv4 and IPv6 are reported once.
+func groupPublishedPorts(ports []container.Port) []types.PortMapping {
+	published := make([]container.Port, 0, len(ports))
+	for _, port := range ports {
+		if port.PublicPort != 0 {
+			published = append(published, port)
+		}
+	}
+	sort.Slice(published, func(i, j int) bool {
+		if published[i].Type != published[j].Type {
+			return published[i].Type < published[j].Type
+		}
+		return published[i].PublicPort < published[j].PublicPort
+	})
+
+	var groups []types.PortMapping
+	for _, port := range published {
+		protocol := strings.ToUpper(port.Type)
+		if n := len(groups); n > 0 && groups[n-1].Protocol == protocol {
+			last := &groups[n-1]
+			lastExternal := max(last.ExternalPort, last.ExternalPortEnd)
+			lastInternal := max(last.InternalPort, last.InternalPortEnd)
+			if int(port.PublicPort) == lastExternal && int(port.PrivatePort) == lastInternal {
+				continue
+			}
+			if int(port.PublicPort) == lastExternal+1 && int(port.PrivatePort) == lastInternal+1 {
+				last.ExternalPortEnd = int(port.PublicPort)
+				last.InternalPortEnd = int(port.PrivatePort)
+				continue
+			}
+		}
+		groups = append(groups, types.PortMapping{
+			ExternalPort: int(port.PublicPort),
+			InternalPort: int(port.PrivatePort),
+			Protocol:     protocol,
+		})
+	}
+	return groups
 }
 
 func shortID(id string) string {
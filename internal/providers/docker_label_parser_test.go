@@ -2,6 +2,7 @@ package providers
 
 import (
 	"testing"
+	"time"
 
 	"github.com/IonBazan/gangplank/internal/types"
 	"github.com/docker/docker/api/types/container"
@@ -27,7 +28,7 @@ func TestExtractPortsFromContainer(t *testing.T) {
 				},
 			},
 			wantPorts: []types.PortMapping{
-				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "nginx"},
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "nginx", ContainerID: "nginx1234567890"},
 			},
 		},
 		{
@@ -43,7 +44,7 @@ func TestExtractPortsFromContainer(t *testing.T) {
 				},
 			},
 			wantPorts: []types.PortMapping{
-				{ExternalPort: 6379, InternalPort: 6379, Protocol: "TCP", Name: "redis"},
+				{ExternalPort: 6379, InternalPort: 6379, Protocol: "TCP", Name: "redis", ContainerID: "redis4567890123"},
 			},
 		},
 		{
@@ -59,7 +60,7 @@ func TestExtractPortsFromContainer(t *testing.T) {
 				},
 			},
 			wantPorts: []types.PortMapping{
-				{ExternalPort: 5433, InternalPort: 5432, Protocol: "TCP", Name: "postgres"},
+				{ExternalPort: 5433, InternalPort: 5432, Protocol: "TCP", Name: "postgres", ContainerID: "pg789012345678"},
 			},
 		},
 		{
@@ -76,8 +77,8 @@ func TestExtractPortsFromContainer(t *testing.T) {
 				},
 			},
 			wantPorts: []types.PortMapping{
-				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "nginx-multi"},
-				{ExternalPort: 8443, InternalPort: 443, Protocol: "TCP", Name: "nginx-multi"},
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "nginx-multi", ContainerID: "nginx_multi12345"},
+				{ExternalPort: 8443, InternalPort: 443, Protocol: "TCP", Name: "nginx-multi", ContainerID: "nginx_multi12345"},
 			},
 		},
 		{
@@ -120,6 +121,286 @@ func TestExtractPortsFromContainer(t *testing.T) {
 			},
 			wantPorts: []types.PortMapping{},
 		},
+		{
+			name: "Published port range",
+			ctr: container.Summary{
+				ID:    "game1234567890",
+				Names: []string{"/game"},
+				Ports: []container.Port{
+					{IP: "0.0.0.0", PublicPort: 27016, PrivatePort: 27016, Type: "udp"},
+					{IP: "0.0.0.0", PublicPort: 27015, PrivatePort: 27015, Type: "udp"},
+					{IP: "::", PublicPort: 27015, PrivatePort: 27015, Type: "udp"},
+					{IP: "0.0.0.0", PublicPort: 27015, PrivatePort: 27015, Type: "tcp"},
+					{PrivatePort: 27020, Type: "udp"},
+				},
+				Labels: map[string]string{
+					labelForward: "published",
+				},
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 27015, InternalPort: 27015, Protocol: "TCP", Name: "game", ContainerID: "game1234567890"},
+				{ExternalPort: 27015, InternalPort: 27015, Protocol: "UDP", Name: "game", ContainerID: "game1234567890"},
+				{ExternalPort: 27016, InternalPort: 27016, Protocol: "UDP", Name: "game", ContainerID: "game1234567890"},
+			},
+		},
+		{
+			name: "Host-referenced port range",
+			ctr: container.Summary{
+				ID:    "rtp1234567890",
+				Names: []string{"/rtp"},
+				Labels: map[string]string{
+					labelForward: "10000-10002:20000-20002/udp",
+				},
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 10000, InternalPort: 20000, Protocol: "UDP", Name: "rtp", ContainerID: "rtp1234567890"},
+				{ExternalPort: 10001, InternalPort: 20001, Protocol: "UDP", Name: "rtp", ContainerID: "rtp1234567890"},
+				{ExternalPort: 10002, InternalPort: 20002, Protocol: "UDP", Name: "rtp", ContainerID: "rtp1234567890"},
+			},
+		},
+		{
+			name: "Container-referenced port range",
+			ctr: container.Summary{
+				ID:    "game4567890123",
+				Names: []string{"/game"},
+				Ports: []container.Port{
+					{PublicPort: 37015, PrivatePort: 27015, Type: "udp"},
+					{PublicPort: 37016, PrivatePort: 27016, Type: "udp"},
+				},
+				Labels: map[string]string{
+					labelForwardContainer: "27015-27017/udp",
+				},
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 37015, InternalPort: 27015, Protocol: "UDP", Name: "game", ContainerID: "game4567890123"},
+				{ExternalPort: 37016, InternalPort: 27016, Protocol: "UDP", Name: "game", ContainerID: "game4567890123"},
+			},
+		},
+		{
+			name: "Container-referenced with explicit external port",
+			ctr: container.Summary{
+				ID:    "web1234567890",
+				Names: []string{"/web"},
+				Ports: []container.Port{
+					{PublicPort: 32768, PrivatePort: 80, Type: "tcp"},
+					{PublicPort: 32769, PrivatePort: 53, Type: "udp"},
+					{PublicPort: 32770, PrivatePort: 53, Type: "tcp"},
+					{PublicPort: 32771, PrivatePort: 27015, Type: "udp"},
+					{PublicPort: 32772, PrivatePort: 27016, Type: "udp"},
+				},
+				Labels: map[string]string{
+					labelForwardContainer: "80:80/tcp;name=http, 53:53/udp, 37015-37016:27015-27016/udp, 443:443/tcp",
+				},
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 80, InternalPort: 32768, Protocol: "TCP", Name: "http", ContainerID: "web1234567890"},
+				{ExternalPort: 53, InternalPort: 32769, Protocol: "UDP", Name: "web", ContainerID: "web1234567890"},
+				{ExternalPort: 37015, InternalPort: 32771, Protocol: "UDP", Name: "web", ContainerID: "web1234567890"},
+				{ExternalPort: 37016, InternalPort: 32772, Protocol: "UDP", Name: "web", ContainerID: "web1234567890"},
+			},
+		},
+		{
+			name: "Container-referenced matches the protocol",
+			ctr: container.Summary{
+				ID:    "dns4567890123",
+				Names: []string{"/dns"},
+				Ports: []container.Port{
+					{PublicPort: 5353, PrivatePort: 53, Type: "udp"},
+				},
+				Labels: map[string]string{
+					labelForwardContainer: "53/tcp, 8053:53/tcp",
+				},
+			},
+			wantPorts: []types.PortMapping{},
+		},
+		{
+			name: "Invalid container-referenced external ports",
+			ctr: container.Summary{
+				ID:    "game7890123456",
+				Names: []string{"/game"},
+				Ports: []container.Port{
+					{PublicPort: 32771, PrivatePort: 27015, Type: "udp"},
+					{PublicPort: 32772, PrivatePort: 27016, Type: "udp"},
+				},
+				Labels: map[string]string{
+					labelForwardContainer: "37015-37020:27015-27016/udp, abc:27015/udp, 37015:27015/udp;ext=37016",
+				},
+			},
+			wantPorts: []types.PortMapping{},
+		},
+		{
+			name: "Both protocols",
+			ctr: container.Summary{
+				ID:    "dns1234567890",
+				Names: []string{"/dns"},
+				Ports: []container.Port{
+					{PublicPort: 5353, PrivatePort: 53, Type: "tcp"},
+					{PublicPort: 5353, PrivatePort: 53, Type: "udp"},
+				},
+				Labels: map[string]string{
+					labelForward:          "853/both",
+					labelForwardContainer: "53/tcp+udp",
+				},
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 853, InternalPort: 853, Protocol: "TCP", Name: "dns", ContainerID: "dns1234567890"},
+				{ExternalPort: 853, InternalPort: 853, Protocol: "UDP", Name: "dns", ContainerID: "dns1234567890"},
+				{ExternalPort: 5353, InternalPort: 53, Protocol: "TCP", Name: "dns", ContainerID: "dns1234567890"},
+				{ExternalPort: 5353, InternalPort: 53, Protocol: "UDP", Name: "dns", ContainerID: "dns1234567890"},
+			},
+		},
+		{
+			name: "Remote host restriction",
+			ctr: container.Summary{
+				ID:    "admin1234567890",
+				Names: []string{"/admin"},
+				Ports: []container.Port{
+					{PublicPort: 8443, PrivatePort: 443, Type: "tcp"},
+				},
+				Labels: map[string]string{
+					labelForward:    "published",
+					labelRemoteHost: "203.0.113.10",
+				},
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 8443, InternalPort: 443, Protocol: "TCP", Name: "admin", RemoteHost: "203.0.113.10", ContainerID: "admin1234567890"},
+			},
+		},
+		{
+			name: "Invalid remote host skips the container",
+			ctr: container.Summary{
+				ID:    "admin4567890123",
+				Names: []string{"/admin"},
+				Ports: []container.Port{
+					{PublicPort: 8443, PrivatePort: 443, Type: "tcp"},
+				},
+				Labels: map[string]string{
+					labelForward:    "published",
+					labelRemoteHost: "office.example.com",
+				},
+			},
+			wantPorts: []types.PortMapping{},
+		},
+		{
+			name: "TTL and description template",
+			ctr: container.Summary{
+				ID:    "mc1234567890123",
+				Names: []string{"/games-minecraft-1"},
+				Image: "itzg/minecraft-server",
+				Ports: []container.Port{
+					{PublicPort: 25565, PrivatePort: 25565, Type: "tcp"},
+				},
+				Labels: map[string]string{
+					labelForward:        "published",
+					labelTTL:            "2h",
+					labelDescription:    "{{.Project}}/{{.Service}} ({{.Image}}) {{.ExternalPort}}/{{.Protocol}}",
+					labelComposeProject: "games",
+					labelComposeService: "minecraft",
+				},
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 25565, InternalPort: 25565, Protocol: "TCP", Name: "games/minecraft", TTL: 2 * time.Hour, Description: "games/minecraft (itzg/minecraft-server) 25565/TCP", ContainerID: "mc1234567890123"},
+			},
+		},
+		{
+			name: "Priority label and option",
+			ctr: container.Summary{
+				ID:    "web1234567890123",
+				Names: []string{"/web"},
+				Labels: map[string]string{
+					labelForward:  "443:8443/tcp, 80:8080/tcp;priority=-1",
+					labelPriority: "10",
+				},
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 443, InternalPort: 8443, Protocol: "TCP", Name: "web", Priority: 10, ContainerID: "web1234567890123"},
+				{ExternalPort: 80, InternalPort: 8080, Protocol: "TCP", Name: "web", Priority: -1, ContainerID: "web1234567890123"},
+			},
+		},
+		{
+			name: "Invalid TTL and description are ignored",
+			ctr: container.Summary{
+				ID:    "web1234567890123",
+				Names: []string{"/web"},
+				Ports: []container.Port{
+					{PublicPort: 8080, PrivatePort: 80, Type: "tcp"},
+				},
+				Labels: map[string]string{
+					labelForward:     "published",
+					labelTTL:         "forever",
+					labelDescription: "{{.Missing}}",
+				},
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web", ContainerID: "web1234567890123"},
+			},
+		},
+		{
+			name: "Disabled container",
+			ctr: container.Summary{
+				ID:    "off1234567890123",
+				Names: []string{"/off"},
+				Ports: []container.Port{
+					{PublicPort: 8080, PrivatePort: 80, Type: "tcp"},
+				},
+				Labels: map[string]string{
+					labelForward: "published",
+					labelEnabled: "false",
+				},
+			},
+			wantPorts: []types.PortMapping{},
+		},
+		{
+			name: "Per-entry options",
+			ctr: container.Summary{
+				ID:    "proxy1234567890",
+				Names: []string{"/proxy"},
+				Ports: []container.Port{
+					{PublicPort: 8080, PrivatePort: 80, Type: "tcp"},
+					{PublicPort: 25565, PrivatePort: 25565, Type: "udp"},
+				},
+				Labels: map[string]string{
+					labelForward:          "443:443/tcp;name=https;ttl=2h, 25565/udp;ext=auto, published;description={{.Name}} {{.ExternalPort}}",
+					labelForwardContainer: "80/tcp;ext=8081;name=http",
+					labelTTL:              "30m",
+				},
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 443, InternalPort: 443, Protocol: "TCP", Name: "https", TTL: 2 * time.Hour, ContainerID: "proxy1234567890"},
+				{ExternalPort: 25565, InternalPort: 25565, Protocol: "UDP", Name: "proxy", TTL: 30 * time.Minute, AutoExternalPort: true, ContainerID: "proxy1234567890"},
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "proxy", TTL: 30 * time.Minute, Description: "proxy 8080", ContainerID: "proxy1234567890"},
+				{ExternalPort: 25565, InternalPort: 25565, Protocol: "UDP", Name: "proxy", TTL: 30 * time.Minute, Description: "proxy 25565", ContainerID: "proxy1234567890"},
+				{ExternalPort: 8081, InternalPort: 8080, Protocol: "TCP", Name: "http", TTL: 30 * time.Minute, ContainerID: "proxy1234567890"},
+			},
+		},
+		{
+			name: "Invalid entries are skipped",
+			ctr: container.Summary{
+				ID:    "proxy4567890123",
+				Names: []string{"/proxy"},
+				Ports: []container.Port{
+					{PublicPort: 8080, PrivatePort: 80, Type: "tcp"},
+				},
+				Labels: map[string]string{
+					labelForward: "443;color=blue, published;ext=9000, 8443:443;enabled=false, 8444:444",
+				},
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 8444, InternalPort: 444, Protocol: "TCP", Name: "proxy", ContainerID: "proxy4567890123"},
+			},
+		},
+		{
+			name: "Port range too large",
+			ctr: container.Summary{
+				ID:    "huge1234567890",
+				Names: []string{"/huge"},
+				Labels: map[string]string{
+					labelForward:          "10000-20000/udp",
+					labelForwardContainer: "10000-20000/udp",
+				},
+			},
+			wantPorts: []types.PortMapping{},
+		},
 		{
 			name: "Short ID without name",
 			ctr: container.Summary{
@@ -133,7 +414,7 @@ func TestExtractPortsFromContainer(t *testing.T) {
 				},
 			},
 			wantPorts: []types.PortMapping{
-				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "short123"},
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "short123", ContainerID: "short123"},
 			},
 		},
 	}
@@ -145,3 +426,16 @@ func TestExtractPortsFromContainer(t *testing.T) {
 		})
 	}
 }
+
+func TestParseDockerLabel_Errors(t *testing.T) {
+	info := ContainerInfo{ContainerName: "proxy", ID: "proxy1234567890"}
+
+	mappings, errs := parseDockerLabel(labelForward, "443;color=blue, 8080:80", info)
+	assert.Equal(t, []types.PortMapping{{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "proxy"}}, mappings)
+	if assert.Len(t, errs, 1) {
+		var labelErr *LabelError
+		assert.ErrorAs(t, errs[0], &labelErr)
+		assert.Equal(t, &LabelError{Container: "proxy", Label: labelForward, Entry: "443;color=blue", Err: labelErr.Err}, labelErr)
+		assert.ErrorContains(t, errs[0], `invalid gangplank.forward entry "443;color=blue" for container proxy: Unknown option "color"`)
+	}
+}
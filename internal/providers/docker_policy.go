@@ -0,0 +1,109 @@
+package providers
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// ForwardPolicy decides which containers are forwarded when they do not say so with a label.
+type ForwardPolicy string
+
+const (
+	// ForwardPolicyLabel only forwards containers with gangplank.forward* or gangplank.ports.* labels.
+	ForwardPolicyLabel ForwardPolicy = "label"
+	// ForwardPolicyAllPublished forwards every published port of containers without such labels, unless they are
+	// disabled with gangplank.enabled=false.
+	ForwardPolicyAllPublished ForwardPolicy = "all-published"
+	// ForwardPolicyNone does not forward any container.
+	ForwardPolicyNone ForwardPolicy = "none"
+)
+
+// ParseForwardPolicy parses a forwarding policy name. An empty name is the label policy.
+func ParseForwardPolicy(s string) (ForwardPolicy, error) {
+	switch policy := ForwardPolicy(strings.ToLower(strings.TrimSpace(s))); policy {
+	case "":
+		return ForwardPolicyLabel, nil
+	case ForwardPolicyLabel, ForwardPolicyAllPublished, ForwardPolicyNone:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid forwarding policy %q: expected %s, %s or %s", s, ForwardPolicyLabel, ForwardPolicyAllPublished, ForwardPolicyNone)
+	}
+}
+
+// ContainerSelector applies the forwarding policy to containers. When filters are set, only containers matching
+// one of the compose projects, one of the image patterns (see path.Match) and one of the networks of each non-empty
+// filter are considered at all.
+type ContainerSelector struct {
+	Policy   ForwardPolicy
+	Projects []string
+	Images   []string
+	Networks []string
+}
+
+// PortMappings returns the port mappings of a container that the policy and filters allow.
+func (s ContainerSelector) PortMappings(ctr container.Summary) []types.PortMapping {
+	if s.Policy == ForwardPolicyNone || !s.Matches(ctr) {
+		return nil
+	}
+	if s.Policy == ForwardPolicyAllPublished && !hasForwardLabels(ctr.Labels) {
+		labels := make(map[string]string, len(ctr.Labels)+1)
+		for key, value := range ctr.Labels {
+			labels[key] = value
+		}
+		labels[labelForward] = "published"
+		ctr.Labels = labels
+	}
+	return extractPortsFromContainer(ctr)
+}
+
+// Matches reports whether the container passes the project, image and network filters.
+func (s ContainerSelector) Matches(ctr container.Summary) bool {
+	if len(s.Projects) > 0 && !slices.Contains(s.Projects, ctr.Labels[labelComposeProject]) {
+		return false
+	}
+	if len(s.Images) > 0 && !matchesImage(s.Images, ctr.Image) {
+		return false
+	}
+	if len(s.Networks) > 0 && !inNetwork(s.Networks, ctr.NetworkSettings) {
+		return false
+	}
+	return true
+}
+
+func hasForwardLabels(labels map[string]string) bool {
+	for label := range labels {
+		if label == labelForward || label == labelForwardContainer || strings.HasPrefix(label, labelPortsPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesImage(patterns []string, image string) bool {
+	if image == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, image); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func inNetwork(networks []string, settings *container.NetworkSettingsSummary) bool {
+	if settings == nil {
+		return false
+	}
+	for name := range settings.Networks {
+		if slices.Contains(networks, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package providers
+
+import (
+	"testing"
+
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseForwardPolicy(t *testing.T) {
+	tests := []struct {
+		input      string
+		wantPolicy ForwardPolicy
+		wantErr    bool
+	}{
+		{input: "", wantPolicy: ForwardPolicyLabel},
+		{input: "label", wantPolicy: ForwardPolicyLabel},
+		{input: " All-Published ", wantPolicy: ForwardPolicyAllPublished},
+		{input: "none", wantPolicy: ForwardPolicyNone},
+		{input: "everything", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			gotPolicy, err := ParseForwardPolicy(tt.input)
+			if tt.wantErr {
+				assert.ErrorContains(t, err, "invalid forwarding policy")
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantPolicy, gotPolicy)
+			}
+		})
+	}
+}
+
+func TestContainerSelector_PortMappings(t *testing.T) {
+	containers := []container.Summary{
+		{
+			ID:     "web1234567890",
+			Names:  []string{"/shop-web-1"},
+			Image:  "ghcr.io/acme/web:1.2",
+			Ports:  []container.Port{{PublicPort: 8080, PrivatePort: 80, Type: "tcp"}},
+			Labels: map[string]string{labelComposeProject: "shop"},
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{"shop_default": {}},
+			},
+		},
+		{
+			ID:     "db1234567890",
+			Names:  []string{"/shop-db-1"},
+			Image:  "postgres:17",
+			Ports:  []container.Port{{PublicPort: 5432, PrivatePort: 5432, Type: "tcp"}},
+			Labels: map[string]string{labelComposeProject: "shop", labelEnabled: "false"},
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{"shop_default": {}},
+			},
+		},
+		{
+			ID:     "cache1234567890",
+			Names:  []string{"/shop-cache-1"},
+			Image:  "redis:8",
+			Ports:  []container.Port{{PublicPort: 6379, PrivatePort: 6379, Type: "tcp"}},
+			Labels: map[string]string{labelComposeProject: "shop", labelEnable: "false"},
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{"shop_default": {}},
+			},
+		},
+		{
+			ID:     "game1234567890",
+			Names:  []string{"/game"},
+			Image:  "itzg/minecraft-server",
+			Ports:  []container.Port{{PublicPort: 25565, PrivatePort: 25565, Type: "tcp"}},
+			Labels: map[string]string{labelForward: "25565:25565/tcp;name=minecraft"},
+		},
+	}
+	web := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "shop-web-1", ContainerID: "web1234567890"}
+	game := types.PortMapping{ExternalPort: 25565, InternalPort: 25565, Protocol: "TCP", Name: "minecraft", ContainerID: "game1234567890"}
+
+	tests := []struct {
+		name      string
+		selector  ContainerSelector
+		wantPorts []types.PortMapping
+	}{
+		{
+			name:      "Default policy only forwards labeled containers",
+			selector:  ContainerSelector{},
+			wantPorts: []types.PortMapping{game},
+		},
+		{
+			name:      "All published ports unless disabled",
+			selector:  ContainerSelector{Policy: ForwardPolicyAllPublished},
+			wantPorts: []types.PortMapping{web, game},
+		},
+		{
+			name:      "No containers",
+			selector:  ContainerSelector{Policy: ForwardPolicyNone},
+			wantPorts: []types.PortMapping{},
+		},
+		{
+			name:      "Compose project filter",
+			selector:  ContainerSelector{Policy: ForwardPolicyAllPublished, Projects: []string{"shop"}},
+			wantPorts: []types.PortMapping{web},
+		},
+		{
+			name:      "Image pattern filter",
+			selector:  ContainerSelector{Policy: ForwardPolicyAllPublished, Images: []string{"ghcr.io/acme/*", "itzg/*"}},
+			wantPorts: []types.PortMapping{web, game},
+		},
+		{
+			name:      "Network filter",
+			selector:  ContainerSelector{Policy: ForwardPolicyAllPublished, Networks: []string{"shop_default"}},
+			wantPorts: []types.PortMapping{web},
+		},
+		{
+			name:      "Filters also apply to labeled containers",
+			selector:  ContainerSelector{Policy: ForwardPolicyLabel, Projects: []string{"shop"}},
+			wantPorts: []types.PortMapping{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotPorts := []types.PortMapping{}
+			for _, ctr := range containers {
+				gotPorts = append(gotPorts, tt.selector.PortMappings(ctr)...)
+			}
+			assert.ElementsMatch(t, tt.wantPorts, gotPorts)
+		})
+	}
+}
@@ -15,23 +15,49 @@ type ContainerLister interface {
 
 type DockerPortProvider struct {
 	dockerCli ContainerLister
+	selector  ContainerSelector
 }
 
-func NewDockerPortProvider(cli ContainerLister) *DockerPortProvider {
-	return &DockerPortProvider{dockerCli: cli}
+func NewDockerPortProvider(cli ContainerLister, selector ContainerSelector) *DockerPortProvider {
+	return &DockerPortProvider{dockerCli: cli, selector: selector}
 }
 
 func (d *DockerPortProvider) GetPortMappings() ([]types.PortMapping, error) {
+	containers, err := d.runningContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	var mappings []types.PortMapping
+	for _, containerMappings := range d.mappingsByContainer(containers) {
+		mappings = append(mappings, containerMappings...)
+	}
+	return mappings, nil
+}
+
+func (d *DockerPortProvider) runningContainers() ([]container.Summary, error) {
 	containers, err := d.dockerCli.ContainerList(context.Background(), container.ListOptions{
 		Filters: filters.NewArgs(filters.Arg("status", "running")),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to list containers: %v", err)
 	}
+	return containers, nil
+}
 
-	var mappings []types.PortMapping
+// mappingsByContainer returns the port mappings of the running containers, keyed by container ID. Project defaults
+// are read from the same containers.
+func (d *DockerPortProvider) mappingsByContainer(containers []container.Summary) map[string][]types.PortMapping {
+	defaults := collectProjectDefaults(containers)
+	mappings := map[string][]types.PortMapping{}
 	for _, ctr := range containers {
-		mappings = append(mappings, extractPortsFromContainer(ctr)...)
+		ctr = defaults.apply(ctr)
+		if waitsForHealth(ctr) {
+			continue
+		}
+		if containerMappings := d.selector.PortMappings(ctr); len(containerMappings) > 0 {
+			mappings[ctr.ID] = containerMappings
+		}
 	}
-	return mappings, nil
+	return mappings
 }
@@ -43,7 +43,7 @@ func TestDockerPortProvider_GetPortMappings(t *testing.T) {
 				},
 			},
 			wantPorts: []types.PortMapping{
-				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "nginx"},
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "nginx", ContainerID: "nginx123"},
 			},
 			wantErr: false,
 		},
@@ -62,7 +62,7 @@ func TestDockerPortProvider_GetPortMappings(t *testing.T) {
 				},
 			},
 			wantPorts: []types.PortMapping{
-				{ExternalPort: 6379, InternalPort: 6379, Protocol: "TCP", Name: "redis"},
+				{ExternalPort: 6379, InternalPort: 6379, Protocol: "TCP", Name: "redis", ContainerID: "redis456"},
 			},
 			wantErr: false,
 		},
@@ -81,7 +81,38 @@ func TestDockerPortProvider_GetPortMappings(t *testing.T) {
 				},
 			},
 			wantPorts: []types.PortMapping{
-				{ExternalPort: 5433, InternalPort: 5432, Protocol: "TCP", Name: "postgres"},
+				{ExternalPort: 5433, InternalPort: 5432, Protocol: "TCP", Name: "postgres", ContainerID: "pg789"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "Containers requiring a healthy status",
+			containers: []container.Summary{
+				{
+					ID:     "web1234567890",
+					Names:  []string{"/web"},
+					Status: "Up 5 minutes (healthy)",
+					Ports:  []container.Port{{PublicPort: 8080, PrivatePort: 80, Type: "tcp"}},
+					Labels: map[string]string{labelForward: "published", labelRequireHealthy: "true"},
+				},
+				{
+					ID:     "api1234567890",
+					Names:  []string{"/api"},
+					Status: "Up 10 seconds (health: starting)",
+					Ports:  []container.Port{{PublicPort: 8081, PrivatePort: 80, Type: "tcp"}},
+					Labels: map[string]string{labelForward: "published", labelRequireHealthy: "true"},
+				},
+				{
+					ID:     "db1234567890",
+					Names:  []string{"/db"},
+					Status: "Up 5 minutes (unhealthy)",
+					Ports:  []container.Port{{PublicPort: 5432, PrivatePort: 5432, Type: "tcp"}},
+					Labels: map[string]string{labelForward: "published"},
+				},
+			},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web", ContainerID: "web1234567890"},
+				{ExternalPort: 5432, InternalPort: 5432, Protocol: "TCP", Name: "db", ContainerID: "db1234567890"},
 			},
 			wantErr: false,
 		},
@@ -98,7 +129,7 @@ func TestDockerPortProvider_GetPortMappings(t *testing.T) {
 			mockClient := &MockDockerClient{
 				Containers: tt.containers,
 			}
-			portProvider := NewDockerPortProvider(mockClient)
+			portProvider := NewDockerPortProvider(mockClient, ContainerSelector{})
 
 			gotPorts, err := portProvider.GetPortMappings()
 			if tt.wantErr {
@@ -0,0 +1,361 @@
+package providers
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/config"
+	"github.com/IonBazan/gangplank/internal/types"
+)
+
+const DefaultProcRoot = "/proc"
+const DefaultListenerPollInterval = 30 * time.Second
+
+const (
+	tcpStateListen = "0A"
+	udpStateClose  = "07"
+)
+
+// hostSocket is a listening socket found in /proc/net.
+type hostSocket struct {
+	Port     int
+	Protocol string
+	Inode    string
+}
+
+// hostProcess describes the process owning a socket.
+type hostProcess struct {
+	Names []string
+	Unit  string
+}
+
+// ListenerPortProvider forwards host services that are not running in containers while they are listening.
+type ListenerPortProvider struct {
+	procRoot     string
+	pollInterval time.Duration
+
+	mu    sync.RWMutex
+	rules []config.ListenerRule
+}
+
+func NewListenerPortProvider(procRoot string, rules []config.ListenerRule, pollInterval time.Duration) *ListenerPortProvider {
+	if procRoot == "" {
+		procRoot = DefaultProcRoot
+	}
+	if pollInterval <= 0 {
+		pollInterval = DefaultListenerPollInterval
+	}
+
+	return &ListenerPortProvider{procRoot: procRoot, rules: rules, pollInterval: pollInterval}
+}
+
+// Rules returns the listener rules the provider currently matches.
+func (l *ListenerPortProvider) Rules() []config.ListenerRule {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.rules
+}
+
+// SetRules replaces the listener rules, e.g. after the config file was reloaded. Listen picks them up on its next poll.
+func (l *ListenerPortProvider) SetRules(rules []config.ListenerRule) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rules = rules
+}
+
+func (l *ListenerPortProvider) GetPortMappings() ([]types.PortMapping, error) {
+	sockets, err := l.listeningSockets()
+	if err != nil {
+		return nil, err
+	}
+
+	rules := l.Rules()
+	var processes map[string]hostProcess
+	if needsProcesses(rules) {
+		processes = l.socketProcesses()
+	}
+
+	var mappings []types.PortMapping
+	seen := map[string]bool{}
+	for _, rule := range rules {
+		for _, socket := range sockets {
+			if !matchesListener(rule, socket, processes[socket.Inode]) {
+				continue
+			}
+			m := listenerMapping(rule, socket)
+			// The same port is usually bound on both IPv4 and IPv6.
+			key := fmt.Sprintf("%d/%s", m.ExternalPort, m.Protocol)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			mappings = append(mappings, m)
+		}
+	}
+	return mappings, nil
+}
+
+// Listen polls the host sockets and reports services that started or stopped listening since the last poll.
+func (l *ListenerPortProvider) Listen(ctx context.Context, events PortEventChannels) {
+	current, _ := l.GetPortMappings()
+	ticker := time.NewTicker(l.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			next, err := l.GetPortMappings()
+			if err != nil {
+				log.Printf("Error reading host listeners: %v", err)
+				continue
+			}
+			added, removed := diffMappings(current, next)
+			current = next
+			for _, m := range removed {
+				if events.Delete != nil {
+					events.Delete <- m
+				}
+			}
+			for _, m := range added {
+				if events.Add != nil {
+					events.Add <- m
+				}
+			}
+		}
+	}
+}
+
+func matchesListener(rule config.ListenerRule, socket hostSocket, process hostProcess) bool {
+	// Config.Validate rejects such rules; never let one open every socket on the host.
+	if rule.Process == "" && rule.Unit == "" && rule.Port == 0 {
+		return false
+	}
+	if rule.Port != 0 && rule.Port != socket.Port {
+		return false
+	}
+	if rule.Protocol != "" && !strings.EqualFold(rule.Protocol, socket.Protocol) {
+		return false
+	}
+	if rule.Unit != "" && process.Unit != rule.Unit && process.Unit != rule.Unit+".service" {
+		return false
+	}
+	if rule.Process != "" {
+		matched := false
+		for _, name := range process.Names {
+			if name == rule.Process {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func listenerMapping(rule config.ListenerRule, socket hostSocket) types.PortMapping {
+	externalPort := socket.Port
+	// A fixed external port only makes sense for a rule pinned to a single port, which Config.Validate enforces.
+	if rule.ExternalPort != 0 && rule.Port != 0 {
+		externalPort = rule.ExternalPort
+	}
+	name := rule.Name
+	if name == "" {
+		name = rule.Process
+	}
+	if name == "" {
+		name = rule.Unit
+	}
+
+	return types.PortMapping{
+		ExternalPort: externalPort,
+		InternalPort: socket.Port,
+		Protocol:     socket.Protocol,
+		Name:         name,
+	}
+}
+
+func needsProcesses(rules []config.ListenerRule) bool {
+	for _, rule := range rules {
+		if rule.Process != "" || rule.Unit != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *ListenerPortProvider) listeningSockets() ([]hostSocket, error) {
+	var sockets []hostSocket
+	found := false
+	for _, file := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		protocol := "TCP"
+		state := tcpStateListen
+		if strings.HasPrefix(file, "udp") {
+			protocol = "UDP"
+			state = udpStateClose
+		}
+
+		parsed, err := parseProcNet(filepath.Join(l.procRoot, "net", file), protocol, state)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read host sockets: %v", err)
+		}
+		found = true
+		sockets = append(sockets, parsed...)
+	}
+	if !found {
+		return nil, fmt.Errorf("failed to read host sockets: no socket tables in %s/net", l.procRoot)
+	}
+	return sockets, nil
+}
+
+// parseProcNet reads a /proc/net/{tcp,udp}[6] table and returns sockets in the given state that are reachable from
+// outside the host, i.e. not bound to a loopback address.
+func parseProcNet(path, protocol, state string) ([]hostSocket, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var sockets []hostSocket
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != state {
+			continue
+		}
+		ip, port, err := parseHexAddress(fields[1])
+		if err != nil || ip.IsLoopback() {
+			continue
+		}
+		// Connected UDP sockets have a remote peer and are not serving anything.
+		if _, remotePort, err := parseHexAddress(fields[2]); err != nil || remotePort != 0 {
+			continue
+		}
+		sockets = append(sockets, hostSocket{Port: port, Protocol: protocol, Inode: fields[9]})
+	}
+	return sockets, scanner.Err()
+}
+
+// parseHexAddress decodes "0100007F:1F90" style addresses. Each 32-bit word of the address is in host byte order.
+func parseHexAddress(s string) (net.IP, int, error) {
+	hostHex, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	raw, err := hex.DecodeString(hostHex)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port in %q", s)
+	}
+
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	return ip, int(port), nil
+}
+
+// socketProcesses maps socket inodes to the processes holding them.
+// Processes that cannot be inspected (e.g. without --pid host or enough privileges) are skipped.
+func (l *ListenerPortProvider) socketProcesses() map[string]hostProcess {
+	processes := map[string]hostProcess{}
+	entries, err := os.ReadDir(l.procRoot)
+	if err != nil {
+		log.Printf("Failed to list processes in %s: %v", l.procRoot, err)
+		return processes
+	}
+
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		pidDir := filepath.Join(l.procRoot, entry.Name())
+		fds, err := os.ReadDir(filepath.Join(pidDir, "fd"))
+		if err != nil {
+			continue
+		}
+
+		var process *hostProcess
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(pidDir, "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(target, "socket:[") {
+				continue
+			}
+			if process == nil {
+				process = readHostProcess(pidDir)
+			}
+			processes[strings.TrimSuffix(strings.TrimPrefix(target, "socket:["), "]")] = *process
+		}
+	}
+	return processes
+}
+
+func readHostProcess(pidDir string) *hostProcess {
+	process := &hostProcess{}
+	if comm, err := os.ReadFile(filepath.Join(pidDir, "comm")); err == nil {
+		process.Names = append(process.Names, strings.TrimSpace(string(comm)))
+	}
+	// comm is truncated to 15 characters, so the executable name from the command line is matched as well.
+	if cmdline, err := os.ReadFile(filepath.Join(pidDir, "cmdline")); err == nil && len(cmdline) > 0 {
+		argv0, _, _ := strings.Cut(string(cmdline), "\x00")
+		process.Names = append(process.Names, filepath.Base(argv0))
+	}
+	if cgroup, err := os.ReadFile(filepath.Join(pidDir, "cgroup")); err == nil {
+		for _, line := range strings.Split(string(cgroup), "\n") {
+			parts := strings.SplitN(line, ":", 3)
+			if len(parts) != 3 {
+				continue
+			}
+			unit := filepath.Base(parts[2])
+			if strings.HasSuffix(unit, ".service") || strings.HasSuffix(unit, ".scope") {
+				process.Unit = unit
+				break
+			}
+		}
+	}
+	return process
+}
+
+func diffMappings(previous, current []types.PortMapping) (added, removed []types.PortMapping) {
+	key := func(m types.PortMapping) string {
+		return fmt.Sprintf("%d/%s", m.ExternalPort, m.Protocol)
+	}
+	previousKeys := map[string]bool{}
+	for _, m := range previous {
+		previousKeys[key(m)] = true
+	}
+	currentKeys := map[string]bool{}
+	for _, m := range current {
+		currentKeys[key(m)] = true
+		if !previousKeys[key(m)] {
+			added = append(added, m)
+		}
+	}
+	for _, m := range previous {
+		if !currentKeys[key(m)] {
+			removed = append(removed, m)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,184 @@
+package providers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/config"
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const procNetHeader = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+
+type fakeProcess struct {
+	pid     string
+	comm    string
+	cmdline string
+	cgroup  string
+	inodes  []string
+}
+
+func writeFakeProc(t *testing.T, root string, tables map[string]string, processes []fakeProcess) {
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "net"), 0o755))
+	for name, rows := range tables {
+		require.NoError(t, os.WriteFile(filepath.Join(root, "net", name), []byte(procNetHeader+rows), 0o644))
+	}
+	for _, p := range processes {
+		pidDir := filepath.Join(root, p.pid)
+		require.NoError(t, os.MkdirAll(filepath.Join(pidDir, "fd"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(pidDir, "comm"), []byte(p.comm+"\n"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(pidDir, "cmdline"), []byte(p.cmdline), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(pidDir, "cgroup"), []byte(p.cgroup), 0o644))
+		for i, inode := range p.inodes {
+			require.NoError(t, os.Symlink("socket:["+inode+"]", filepath.Join(pidDir, "fd", string(rune('3'+i)))))
+		}
+	}
+}
+
+func defaultFakeProc(t *testing.T) string {
+	root := t.TempDir()
+	writeFakeProc(t, root,
+		map[string]string{
+			// 0.0.0.0:32400 LISTEN (plex), 127.0.0.1:8080 LISTEN (loopback), 0.0.0.0:22 LISTEN (sshd), established 443
+			"tcp": "   0: 00000000:7E90 00000000:0000 0A 00000000:00000000 00:00000000 00000000   998        0 1001 1 0 100 0 0 10 0\n" +
+				"   1: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1002 1 0 100 0 0 10 0\n" +
+				"   2: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1003 1 0 100 0 0 10 0\n" +
+				"   3: 0A01A8C0:01BB 0B01A8C0:D431 01 00000000:00000000 00:00000000 00000000     0        0 1004 1 0 100 0 0 10 0\n",
+			// [::]:32400 LISTEN (plex) and [::1]:631 LISTEN (loopback)
+			"tcp6": "   0: 00000000000000000000000000000000:7E90 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000   998        0 1005 1 0 100 0 0 10 0\n" +
+				"   1: 00000000000000000000000001000000:0277 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1006 1 0 100 0 0 10 0\n",
+			// 0.0.0.0:32410 (plex GDM discovery) and a connected socket to 8.8.8.8:53
+			"udp": "   0: 00000000:7E9A 00000000:0000 07 00000000:00000000 00:00000000 00000000   998        0 1007 2 0000000000000000 0\n" +
+				"   1: 0A01A8C0:A1B2 08080808:0035 01 00000000:00000000 00:00000000 00000000     0        0 1008 2 0000000000000000 0\n",
+		},
+		[]fakeProcess{
+			{
+				pid:     "100",
+				comm:    "Plex Media Serv",
+				cmdline: "/usr/lib/plexmediaserver/Plex Media Server\x00",
+				cgroup:  "0::/system.slice/plexmediaserver.service\n",
+				inodes:  []string{"1001", "1005", "1007"},
+			},
+			{
+				pid:     "200",
+				comm:    "sshd",
+				cmdline: "sshd: /usr/sbin/sshd -D [listener]\x00",
+				cgroup:  "0::/system.slice/ssh.service\n",
+				inodes:  []string{"1003"},
+			},
+		},
+	)
+	return root
+}
+
+func TestListenerPortProvider_GetPortMappings(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     []config.ListenerRule
+		wantPorts []types.PortMapping
+	}{
+		{
+			name:  "Match by full process name",
+			rules: []config.ListenerRule{{Name: "plex", Process: "Plex Media Server"}},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 32400, InternalPort: 32400, Protocol: "TCP", Name: "plex"},
+				{ExternalPort: 32410, InternalPort: 32410, Protocol: "UDP", Name: "plex"},
+			},
+		},
+		{
+			name:  "Match by unit and port with external override",
+			rules: []config.ListenerRule{{Unit: "plexmediaserver", Port: 32400, ExternalPort: 42400}},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 42400, InternalPort: 32400, Protocol: "TCP", Name: "plexmediaserver"},
+			},
+		},
+		{
+			name:  "Match by truncated comm and protocol",
+			rules: []config.ListenerRule{{Process: "Plex Media Serv", Protocol: "udp"}},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 32410, InternalPort: 32410, Protocol: "UDP", Name: "Plex Media Serv"},
+			},
+		},
+		{
+			name:  "Match by port only",
+			rules: []config.ListenerRule{{Name: "ssh", Port: 22, ExternalPort: 2222}},
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 2222, InternalPort: 22, Protocol: "TCP", Name: "ssh"},
+			},
+		},
+		{
+			name:      "Loopback and connected sockets are ignored",
+			rules:     []config.ListenerRule{{Port: 8080}, {Port: 631}, {Port: 443}},
+			wantPorts: []types.PortMapping{},
+		},
+		{
+			name:      "Rule without process, unit or port",
+			rules:     []config.ListenerRule{{Name: "foo"}, {Protocol: "udp"}},
+			wantPorts: []types.PortMapping{},
+		},
+		{
+			name:      "Unit mismatch",
+			rules:     []config.ListenerRule{{Unit: "ssh.service", Port: 32400}},
+			wantPorts: []types.PortMapping{},
+		},
+	}
+
+	root := defaultFakeProc(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			portProvider := NewListenerPortProvider(root, tt.rules, 0)
+
+			gotPorts, err := portProvider.GetPortMappings()
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, tt.wantPorts, gotPorts)
+		})
+	}
+}
+
+func TestListenerPortProvider_GetPortMappings_MissingProc(t *testing.T) {
+	portProvider := NewListenerPortProvider(t.TempDir(), []config.ListenerRule{{Port: 22}}, 0)
+
+	gotPorts, err := portProvider.GetPortMappings()
+	assert.Error(t, err)
+	assert.Nil(t, gotPorts)
+}
+
+func TestListenerPortProvider_Listen(t *testing.T) {
+	root := defaultFakeProc(t)
+	portProvider := NewListenerPortProvider(root, []config.ListenerRule{{Name: "plex", Process: "Plex Media Server", Protocol: "TCP"}}, 50*time.Millisecond)
+
+	addCh := make(chan types.PortMapping, 10)
+	deleteCh := make(chan types.PortMapping, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Plex is not listening yet.
+	require.NoError(t, os.Rename(filepath.Join(root, "net", "tcp"), filepath.Join(root, "net", "tcp.bak")))
+	require.NoError(t, os.Rename(filepath.Join(root, "net", "tcp6"), filepath.Join(root, "net", "tcp6.bak")))
+
+	go portProvider.Listen(ctx, PortEventChannels{Add: addCh, Delete: deleteCh})
+	time.Sleep(100 * time.Millisecond)
+
+	plex := types.PortMapping{ExternalPort: 32400, InternalPort: 32400, Protocol: "TCP", Name: "plex"}
+
+	require.NoError(t, os.Rename(filepath.Join(root, "net", "tcp.bak"), filepath.Join(root, "net", "tcp")))
+	select {
+	case m := <-addCh:
+		assert.Equal(t, plex, m)
+	case <-time.After(1 * time.Second):
+		t.Fatal("timed out waiting for add event")
+	}
+
+	require.NoError(t, os.WriteFile(filepath.Join(root, "net", "tcp"), []byte(procNetHeader), 0o644))
+	select {
+	case m := <-deleteCh:
+		assert.Equal(t, plex, m)
+	case <-time.After(1 * time.Second):
+		t.Fatal("timed out waiting for delete event")
+	}
+}
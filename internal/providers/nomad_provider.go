@@ -0,0 +1,474 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+const DefaultNomadAddress = "http://127.0.0.1:4646"
+
+const (
+	nomadTokenHeader   = "X-Nomad-Token"
+	nomadTopicAlloc    = "Allocation"
+	nomadStatusRunning = "running"
+	labelPrefix        = "gangplank."
+)
+
+type nomadPort struct {
+	Label  string `json:"Label"`
+	Value  int    `json:"Value"`
+	To     int    `json:"To"`
+	HostIP string `json:"HostIP"`
+}
+
+type nomadService struct {
+	Name      string   `json:"Name"`
+	PortLabel string   `json:"PortLabel"`
+	Tags      []string `json:"Tags"`
+}
+
+type nomadTaskGroup struct {
+	Name     string            `json:"Name"`
+	Meta     map[string]string `json:"Meta"`
+	Services []nomadService    `json:"Services"`
+	Tasks    []struct {
+		Services []nomadService `json:"Services"`
+	} `json:"Tasks"`
+}
+
+type nomadAllocation struct {
+	ID            string `json:"ID"`
+	Name          string `json:"Name"`
+	NodeID        string `json:"NodeID"`
+	TaskGroup     string `json:"TaskGroup"`
+	ClientStatus  string `json:"ClientStatus"`
+	DesiredStatus string `json:"DesiredStatus"`
+	Job           *struct {
+		Meta       map[string]string `json:"Meta"`
+		TaskGroups []nomadTaskGroup  `json:"TaskGroups"`
+	} `json:"Job"`
+	AllocatedResources *struct {
+		Shared struct {
+			Ports []nomadPort `json:"Ports"`
+		} `json:"Shared"`
+	} `json:"AllocatedResources"`
+}
+
+type nomadEventBatch struct {
+	Index  uint64 `json:"Index"`
+	Events []struct {
+		Topic   string `json:"Topic"`
+		Type    string `json:"Type"`
+		Key     string `json:"Key"`
+		Payload struct {
+			Allocation *nomadAllocation `json:"Allocation"`
+		} `json:"Payload"`
+	} `json:"Events"`
+}
+
+// NomadPortProvider reads port mappings from Nomad allocations placed on the local node.
+type NomadPortProvider struct {
+	httpClient *http.Client
+	address    string
+	token      string
+
+	reconnectDelay    time.Duration
+	maxReconnectDelay time.Duration
+
+	mu        sync.Mutex
+	nodeID    string
+	announced map[string][]types.PortMapping
+}
+
+func NewNomadPortProvider(address, token string) *NomadPortProvider {
+	if address == "" {
+		address = DefaultNomadAddress
+	}
+
+	return &NomadPortProvider{
+		httpClient:        http.DefaultClient,
+		address:           strings.TrimSuffix(address, "/"),
+		token:             token,
+		reconnectDelay:    defaultReconnectDelay,
+		maxReconnectDelay: defaultMaxReconnectDelay,
+		announced:         map[string][]types.PortMapping{},
+	}
+}
+
+func (n *NomadPortProvider) GetPortMappings() ([]types.PortMapping, error) {
+	allocs, err := n.runningAllocations(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	var mappings []types.PortMapping
+	for _, alloc := range allocs {
+		mappings = append(mappings, extractPortsFromAllocation(alloc)...)
+	}
+	return mappings, nil
+}
+
+// runningAllocations returns the allocations running on the local node, including their jobs.
+func (n *NomadPortProvider) runningAllocations(ctx context.Context) ([]nomadAllocation, error) {
+	nodeID, err := n.localNodeID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var allocs []nomadAllocation
+	if err := n.get(ctx, "/v1/node/"+url.PathEscape(nodeID)+"/allocations", &allocs); err != nil {
+		return nil, fmt.Errorf("failed to list Nomad allocations: %v", err)
+	}
+
+	var running []nomadAllocation
+	for _, alloc := range allocs {
+		if alloc.ClientStatus != nomadStatusRunning {
+			continue
+		}
+		if alloc.Job == nil {
+			if err := n.get(ctx, "/v1/allocation/"+url.PathEscape(alloc.ID), &alloc); err != nil {
+				log.Printf("Failed to get Nomad allocation %s: %v", shortID(alloc.ID), err)
+				continue
+			}
+		}
+		running = append(running, alloc)
+	}
+	return running, nil
+}
+
+// runningMappings returns the mappings of the allocations running on the local node, keyed by allocation ID.
+// Allocations that are being stopped are left out.
+func (n *NomadPortProvider) runningMappings(ctx context.Context) (map[string][]types.PortMapping, error) {
+	allocs, err := n.runningAllocations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mappings := map[string][]types.PortMapping{}
+	for _, alloc := range allocs {
+		if alloc.DesiredStatus == "stop" {
+			continue
+		}
+		mappings[alloc.ID] = extractPortsFromAllocation(alloc)
+	}
+	return mappings, nil
+}
+
+// prime remembers the mappings of the running allocations as announced.
+func (n *NomadPortProvider) prime(ctx context.Context) error {
+	byAlloc, err := n.runningMappings(ctx)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for allocID, ports := range byAlloc {
+		n.announced[allocID] = ports
+	}
+	return nil
+}
+
+// resync announces the allocations that started while disconnected and withdraws the ones that stopped, as their
+// events may no longer be in the event buffer of the agent.
+func (n *NomadPortProvider) resync(ctx context.Context, events PortEventChannels) error {
+	byAlloc, err := n.runningMappings(ctx)
+	if err != nil {
+		return err
+	}
+
+	var added, removed []types.PortMapping
+	n.mu.Lock()
+	for allocID, ports := range byAlloc {
+		if _, announced := n.announced[allocID]; !announced {
+			n.announced[allocID] = ports
+			added = append(added, ports...)
+		}
+	}
+	for allocID, ports := range n.announced {
+		if _, running := byAlloc[allocID]; !running {
+			delete(n.announced, allocID)
+			removed = append(removed, ports...)
+		}
+	}
+	n.mu.Unlock()
+
+	send(events.Delete, removed)
+	send(events.Add, added)
+	return nil
+}
+
+// Listen follows allocation events until the context is cancelled. When the event stream fails, e.g. because the
+// Nomad agent restarted, it reconnects with an increasing delay, replays the events missed in between from the last
+// index it received and resyncs the allocations running on the node.
+func (n *NomadPortProvider) Listen(ctx context.Context, events PortEventChannels) {
+	// Allocations running before Gangplank started were forwarded from the allocation list, remember their mappings.
+	if err := n.prime(ctx); err != nil {
+		log.Printf("Failed to list Nomad allocations: %v", err)
+	}
+	var index uint64
+	delay := n.reconnectDelay
+	for {
+		err := n.follow(ctx, events, &index)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Error receiving Nomad events: %v, reconnecting in %s", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay = min(delay*2, n.maxReconnectDelay)
+
+		// The agent is back once allocations can be listed again.
+		if err := n.resync(ctx, events); err != nil {
+			log.Printf("Failed to resync Nomad allocations: %v", err)
+			continue
+		}
+		log.Printf("Reconnected to Nomad events, replaying events after index %d", index)
+		delay = n.reconnectDelay
+	}
+}
+
+// follow handles the allocation events of the local node received after index until the stream fails, and moves
+// index along with them.
+func (n *NomadPortProvider) follow(ctx context.Context, events PortEventChannels, index *uint64) error {
+	nodeID, err := n.localNodeID(ctx)
+	if err != nil {
+		return err
+	}
+
+	path := "/v1/event/stream?topic=" + url.QueryEscape(nomadTopicAlloc+":*")
+	if *index > 0 {
+		path += "&index=" + strconv.FormatUint(*index+1, 10)
+	}
+	req, err := n.newRequest(ctx, path)
+	if err != nil {
+		return err
+	}
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from the event stream", resp.Status)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var batch nomadEventBatch
+		if err := decoder.Decode(&batch); err != nil {
+			if err == io.EOF {
+				return errors.New("event stream closed")
+			}
+			return err
+		}
+
+		// Heartbeats are sent as empty objects.
+		for _, event := range batch.Events {
+			if event.Topic != nomadTopicAlloc || event.Payload.Allocation == nil {
+				continue
+			}
+			if event.Payload.Allocation.NodeID != nodeID {
+				continue
+			}
+			n.handleAllocation(ctx, event.Payload.Allocation.ID, events)
+		}
+		if batch.Index > 0 {
+			*index = batch.Index
+		}
+	}
+}
+
+// handleAllocation announces mappings when an allocation starts running and withdraws them once it stops.
+// Allocation events are emitted on every client update, so only state transitions produce mappings.
+func (n *NomadPortProvider) handleAllocation(ctx context.Context, allocID string, events PortEventChannels) {
+	// Event payloads omit the job, so the full allocation is fetched to read its services and meta.
+	var alloc nomadAllocation
+	if err := n.get(ctx, "/v1/allocation/"+url.PathEscape(allocID), &alloc); err != nil {
+		log.Printf("Failed to get Nomad allocation %s: %v", shortID(allocID), err)
+		return
+	}
+
+	running := alloc.ClientStatus == nomadStatusRunning && alloc.DesiredStatus != "stop"
+
+	n.mu.Lock()
+	announced, wasRunning := n.announced[allocID]
+	var added []types.PortMapping
+	switch {
+	case running && !wasRunning:
+		added = extractPortsFromAllocation(alloc)
+		n.announced[allocID] = added
+		announced = nil
+	case !running && wasRunning:
+		delete(n.announced, allocID)
+	default:
+		announced = nil
+	}
+	n.mu.Unlock()
+
+	if events.Add != nil {
+		for _, m := range added {
+			events.Add <- m
+		}
+	}
+	if events.Delete != nil {
+		for _, m := range announced {
+			events.Delete <- m
+		}
+	}
+}
+
+func (n *NomadPortProvider) localNodeID(ctx context.Context) (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.nodeID != "" {
+		return n.nodeID, nil
+	}
+
+	var self struct {
+		Stats struct {
+			Client struct {
+				NodeID string `json:"node_id"`
+			} `json:"client"`
+		} `json:"stats"`
+	}
+	if err := n.get(ctx, "/v1/agent/self", &self); err != nil {
+		return "", fmt.Errorf("failed to query Nomad agent: %v", err)
+	}
+	if self.Stats.Client.NodeID == "" {
+		return "", fmt.Errorf("Nomad agent at %s is not running in client mode", n.address)
+	}
+
+	n.nodeID = self.Stats.Client.NodeID
+	return n.nodeID, nil
+}
+
+func (n *NomadPortProvider) get(ctx context.Context, path string, out interface{}) error {
+	req, err := n.newRequest(ctx, path)
+	if err != nil {
+		return err
+	}
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, path)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (n *NomadPortProvider) newRequest(ctx context.Context, path string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, n.address+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if n.token != "" {
+		req.Header.Set(nomadTokenHeader, n.token)
+	}
+	return req, nil
+}
+
+// extractPortsFromAllocation maps the allocated host ports using gangplank.* keys from job and group meta,
+// which apply to every port of the allocation, and from service tags, which apply to the service's port only.
+func extractPortsFromAllocation(alloc nomadAllocation) []types.PortMapping {
+	var allocated []nomadPort
+	if alloc.AllocatedResources != nil {
+		allocated = alloc.AllocatedResources.Shared.Ports
+	}
+
+	var group nomadTaskGroup
+	labels := map[string]string{}
+	if alloc.Job != nil {
+		mergeGangplankLabels(labels, alloc.Job.Meta)
+		for _, tg := range alloc.Job.TaskGroups {
+			if tg.Name == alloc.TaskGroup {
+				group = tg
+				break
+			}
+		}
+	}
+	mergeGangplankLabels(labels, group.Meta)
+
+	name := alloc.Name
+	if name == "" {
+		name = shortID(alloc.ID)
+	}
+
+	mappings := extractPortsFromContainer(container.Summary{
+		ID:     alloc.ID,
+		Names:  []string{name},
+		Labels: labels,
+		Ports:  nomadPortsToContainerPorts(allocated, ""),
+	})
+
+	services := group.Services
+	for _, task := range group.Tasks {
+		services = append(services, task.Services...)
+	}
+	for _, service := range services {
+		serviceLabels := map[string]string{}
+		for _, tag := range service.Tags {
+			if key, value, ok := strings.Cut(tag, "="); ok && strings.HasPrefix(key, labelPrefix) {
+				serviceLabels[key] = value
+			}
+		}
+		if len(serviceLabels) == 0 {
+			continue
+		}
+		mappings = append(mappings, extractPortsFromContainer(container.Summary{
+			ID:     alloc.ID,
+			Names:  []string{service.Name},
+			Labels: serviceLabels,
+			Ports:  nomadPortsToContainerPorts(allocated, service.PortLabel),
+		})...)
+	}
+
+	return mappings
+}
+
+func mergeGangplankLabels(dst, meta map[string]string) {
+	for key, value := range meta {
+		if strings.HasPrefix(key, labelPrefix) {
+			dst[key] = value
+		}
+	}
+}
+
+// nomadPortsToContainerPorts converts allocated ports, optionally restricted to a single port label.
+// Nomad ports are protocol-agnostic, so they are reported as TCP.
+func nomadPortsToContainerPorts(ports []nomadPort, portLabel string) []container.Port {
+	var result []container.Port
+	for _, p := range ports {
+		if portLabel != "" && p.Label != portLabel {
+			continue
+		}
+		privatePort := p.To
+		if privatePort <= 0 {
+			privatePort = p.Value
+		}
+		result = append(result, container.Port{
+			IP:          p.HostIP,
+			PrivatePort: uint16(privatePort),
+			PublicPort:  uint16(p.Value),
+			Type:        "tcp",
+		})
+	}
+	return result
+}
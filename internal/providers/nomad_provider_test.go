@@ -0,0 +1,297 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+const nomadTestNode = "node-1234567890"
+
+func nomadTestAllocations() map[string]string {
+	return map[string]string{
+		"alloc-web": `{
+			"ID": "alloc-web", "Name": "web.web[0]", "NodeID": "node-1234567890", "TaskGroup": "web",
+			"ClientStatus": "running", "DesiredStatus": "run",
+			"Job": {"Meta": {"owner": "team-a"}, "TaskGroups": [{"Name": "web", "Meta": {"gangplank.forward": "published"}}]},
+			"AllocatedResources": {"Shared": {"Ports": [{"Label": "http", "Value": 8080, "To": 80}]}}
+		}`,
+		"alloc-game": `{
+			"ID": "alloc-game", "Name": "game.server[0]", "NodeID": "node-1234567890", "TaskGroup": "server",
+			"ClientStatus": "running", "DesiredStatus": "run",
+			"Job": {"TaskGroups": [{"Name": "server", "Tasks": [{"Services": [
+				{"Name": "minecraft", "PortLabel": "game", "Tags": ["gangplank.forward=published", "traefik.enable=false"]}
+			]}]}]},
+			"AllocatedResources": {"Shared": {"Ports": [{"Label": "game", "Value": 25565}, {"Label": "rcon", "Value": 25575}]}}
+		}`,
+		"alloc-done": `{
+			"ID": "alloc-done", "Name": "batch.run[0]", "NodeID": "node-1234567890", "TaskGroup": "run",
+			"ClientStatus": "complete", "DesiredStatus": "run",
+			"Job": {"TaskGroups": [{"Name": "run", "Meta": {"gangplank.forward": "published"}}]},
+			"AllocatedResources": {"Shared": {"Ports": [{"Label": "http", "Value": 9000}]}}
+		}`,
+	}
+}
+
+// nomadCloseStream ends the event stream of fakeNomad when sent as an event, like an agent restart.
+const nomadCloseStream = "close"
+
+type fakeNomad struct {
+	mu     sync.Mutex
+	allocs map[string]string
+	events chan string
+	token  string
+	// subscribed is notified of each subscription to the event stream, whose index is kept in indexes.
+	subscribed chan struct{}
+	indexes    []string
+}
+
+func (f *fakeNomad) setAlloc(id, alloc string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.allocs[id] = alloc
+}
+
+func (f *fakeNomad) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(nomadTokenHeader) != f.token {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/v1/agent/self":
+		fmt.Fprintf(w, `{"stats": {"client": {"node_id": %q}}}`, nomadTestNode)
+	case r.URL.Path == "/v1/node/"+nomadTestNode+"/allocations":
+		var allocs []string
+		for _, a := range f.allocs {
+			allocs = append(allocs, a)
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(allocs, ","))
+	case strings.HasPrefix(r.URL.Path, "/v1/allocation/"):
+		alloc, ok := f.allocs[strings.TrimPrefix(r.URL.Path, "/v1/allocation/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, alloc)
+	case r.URL.Path == "/v1/event/stream":
+		if r.URL.Query().Get("topic") != "Allocation:*" {
+			http.Error(w, "unexpected topic", http.StatusBadRequest)
+			return
+		}
+		f.indexes = append(f.indexes, r.URL.Query().Get("index"))
+		f.mu.Unlock()
+		defer f.mu.Lock()
+		w.(http.Flusher).Flush()
+		select {
+		case f.subscribed <- struct{}{}:
+		default:
+		}
+		for {
+			select {
+			case e := <-f.events:
+				if e == nomadCloseStream {
+					return
+				}
+				fmt.Fprintln(w, e)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func allocEvent(allocID, nodeID, eventType string) string {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"Index": 10,
+		"Events": []map[string]interface{}{{
+			"Topic":   "Allocation",
+			"Type":    eventType,
+			"Key":     allocID,
+			"Payload": map[string]interface{}{"Allocation": map[string]string{"ID": allocID, "NodeID": nodeID}},
+		}},
+	})
+	return string(payload)
+}
+
+func TestNomadPortProvider_GetPortMappings(t *testing.T) {
+	tests := []struct {
+		name      string
+		token     string
+		wantPorts []types.PortMapping
+		wantErr   bool
+	}{
+		{
+			name:  "Running allocations with meta and service tags",
+			token: "secret",
+			wantPorts: []types.PortMapping{
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web.web[0]", ContainerID: "alloc-web"},
+				{ExternalPort: 25565, InternalPort: 25565, Protocol: "TCP", Name: "minecraft", ContainerID: "alloc-game"},
+			},
+		},
+		{
+			name:    "Invalid token",
+			token:   "wrong",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(&fakeNomad{allocs: nomadTestAllocations(), token: "secret"})
+			defer server.Close()
+
+			portProvider := NewNomadPortProvider(server.URL, tt.token)
+			gotPorts, err := portProvider.GetPortMappings()
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Nil(t, gotPorts)
+			} else {
+				assert.NoError(t, err)
+				assert.ElementsMatch(t, tt.wantPorts, gotPorts)
+			}
+		})
+	}
+}
+
+func TestNomadPortProvider_Listen(t *testing.T) {
+	allocs := nomadTestAllocations()
+	running := allocs["alloc-web"]
+	allocs["alloc-web"] = strings.Replace(running, `"ClientStatus": "running"`, `"ClientStatus": "pending"`, 1)
+	fake := &fakeNomad{allocs: allocs, events: make(chan string, 10), subscribed: make(chan struct{}, 1)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	portProvider := NewNomadPortProvider(server.URL, "")
+	addCh := make(chan types.PortMapping, 10)
+	deleteCh := make(chan types.PortMapping, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go portProvider.Listen(ctx, PortEventChannels{Add: addCh, Delete: deleteCh})
+
+	collect := func() (gotAdd, gotDelete []types.PortMapping) {
+		timeout := time.After(500 * time.Millisecond)
+		for {
+			select {
+			case m := <-addCh:
+				gotAdd = append(gotAdd, m)
+			case m := <-deleteCh:
+				gotDelete = append(gotDelete, m)
+			case <-timeout:
+				return
+			}
+		}
+	}
+
+	web := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web.web[0]", ContainerID: "alloc-web"}
+
+	<-fake.subscribed
+	fake.setAlloc("alloc-web", running)
+	fake.events <- allocEvent("alloc-web", nomadTestNode, "AllocationUpdated")
+	fake.events <- "{}"
+	fake.events <- allocEvent("alloc-web", nomadTestNode, "AllocationUpdated")
+	fake.events <- allocEvent("alloc-game", "another-node", "AllocationUpdated")
+	gotAdd, gotDelete := collect()
+	assert.Equal(t, []types.PortMapping{web}, gotAdd, "repeated updates and other nodes must not announce mappings")
+	assert.Empty(t, gotDelete)
+
+	fake.setAlloc("alloc-web", strings.Replace(running, `"ClientStatus": "running"`, `"ClientStatus": "complete"`, 1))
+	fake.events <- allocEvent("alloc-web", nomadTestNode, "AllocationUpdated")
+	gotAdd, gotDelete = collect()
+	assert.Empty(t, gotAdd)
+	assert.Equal(t, []types.PortMapping{web}, gotDelete)
+}
+
+func TestNomadPortProvider_ListenStopsAllocationRunningAtStartup(t *testing.T) {
+	allocs := nomadTestAllocations()
+	fake := &fakeNomad{allocs: allocs, events: make(chan string, 10), subscribed: make(chan struct{}, 1)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	portProvider := NewNomadPortProvider(server.URL, "")
+	addCh := make(chan types.PortMapping, 10)
+	deleteCh := make(chan types.PortMapping, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go portProvider.Listen(ctx, PortEventChannels{Add: addCh, Delete: deleteCh})
+
+	<-fake.subscribed
+	fake.events <- allocEvent("alloc-game", nomadTestNode, "AllocationUpdated")
+	fake.setAlloc("alloc-web", strings.Replace(allocs["alloc-web"], `"DesiredStatus": "run"`, `"DesiredStatus": "stop"`, 1))
+	fake.events <- allocEvent("alloc-web", nomadTestNode, "AllocationUpdated")
+
+	select {
+	case m := <-deleteCh:
+		assert.Equal(t, types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web.web[0]", ContainerID: "alloc-web"}, m)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the mapping of the stopped allocation to be deleted")
+	}
+	select {
+	case m := <-addCh:
+		t.Fatalf("allocations running at startup must not be announced again, got %v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func (f *fakeNomad) subscriptions() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.indexes)
+}
+
+func TestNomadPortProvider_ListenReconnect(t *testing.T) {
+	allocs := nomadTestAllocations()
+	fake := &fakeNomad{allocs: allocs, events: make(chan string, 10), subscribed: make(chan struct{}, 1)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	portProvider := NewNomadPortProvider(server.URL, "")
+	portProvider.reconnectDelay = 10 * time.Millisecond
+	addCh := make(chan types.PortMapping, 10)
+	deleteCh := make(chan types.PortMapping, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go portProvider.Listen(ctx, PortEventChannels{Add: addCh, Delete: deleteCh})
+
+	<-fake.subscribed
+	// While the agent restarts, web stops and the batch allocation starts without their events being replayed.
+	fake.setAlloc("alloc-web", strings.Replace(allocs["alloc-web"], `"ClientStatus": "running"`, `"ClientStatus": "complete"`, 1))
+	fake.setAlloc("alloc-done", strings.Replace(allocs["alloc-done"], `"ClientStatus": "complete"`, `"ClientStatus": "running"`, 1))
+	fake.events <- allocEvent("alloc-game", nomadTestNode, "AllocationUpdated")
+	fake.events <- nomadCloseStream
+
+	select {
+	case m := <-deleteCh:
+		assert.Equal(t, types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web.web[0]", ContainerID: "alloc-web"}, m)
+	case <-time.After(time.Second):
+		t.Fatal("allocation stopped while disconnected was not withdrawn")
+	}
+	select {
+	case m := <-addCh:
+		assert.Equal(t, types.PortMapping{ExternalPort: 9000, InternalPort: 9000, Protocol: "TCP", Name: "batch.run[0]", ContainerID: "alloc-done"}, m)
+	case <-time.After(time.Second):
+		t.Fatal("allocation started while disconnected was not announced")
+	}
+
+	<-fake.subscribed
+	assert.Equal(t, []string{"", "11"}, fake.subscriptions(), "events after the last index are replayed")
+}
@@ -0,0 +1,90 @@
+package providers
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/types"
+)
+
+// RuntimeSource is the source of the mappings added while Gangplank runs, e.g. through the management API.
+const RuntimeSource = "runtime"
+
+// RuntimeMapping is a mapping added while Gangplank runs.
+type RuntimeMapping struct {
+	types.PortMapping
+	// ExpiresAt is when the mapping is removed again. Zero keeps it until it is removed.
+	ExpiresAt time.Time
+}
+
+// RuntimePortProvider serves the mappings added while Gangplank runs, one per external port and protocol. They are
+// kept in memory only.
+type RuntimePortProvider struct {
+	mu       sync.Mutex
+	mappings map[string]RuntimeMapping
+	now      func() time.Time
+}
+
+func NewRuntimePortProvider() *RuntimePortProvider {
+	return &RuntimePortProvider{mappings: map[string]RuntimeMapping{}, now: time.Now}
+}
+
+func (p *RuntimePortProvider) GetPortMappings() ([]types.PortMapping, error) {
+	mappings := p.Mappings()
+	ports := make([]types.PortMapping, 0, len(mappings))
+	for _, m := range mappings {
+		ports = append(ports, m.PortMapping)
+	}
+	return ports, nil
+}
+
+// Mappings returns the runtime mappings ordered by their key.
+func (p *RuntimePortProvider) Mappings() []RuntimeMapping {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	mappings := make([]RuntimeMapping, 0, len(p.mappings))
+	for _, m := range p.mappings {
+		mappings = append(mappings, m)
+	}
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].Key() < mappings[j].Key() })
+	return mappings
+}
+
+// Add adds a mapping, returning the mapping it replaced for the same external port and protocol, if any.
+func (p *RuntimePortProvider) Add(m types.PortMapping, expiresAt time.Time) (types.PortMapping, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old, ok := p.mappings[m.Key()]
+	p.mappings[m.Key()] = RuntimeMapping{PortMapping: m, ExpiresAt: expiresAt}
+	return old.PortMapping, ok
+}
+
+// Remove removes the mapping with the given key.
+func (p *RuntimePortProvider) Remove(key string) (types.PortMapping, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m, ok := p.mappings[key]
+	delete(p.mappings, key)
+	return m.PortMapping, ok
+}
+
+// Expire removes the mappings that expired and returns them.
+func (p *RuntimePortProvider) Expire() []types.PortMapping {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	var expired []types.PortMapping
+	for key, m := range p.mappings {
+		if !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt) {
+			expired = append(expired, m.PortMapping)
+			delete(p.mappings, key)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].Key() < expired[j].Key() })
+	return expired
+}
@@ -0,0 +1,42 @@
+package providers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuntimePortProvider(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	provider := NewRuntimePortProvider()
+	provider.now = func() time.Time { return now }
+
+	web := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web"}
+	api := types.PortMapping{ExternalPort: 8080, InternalPort: 8000, Protocol: "TCP", Name: "api"}
+	game := types.PortMapping{ExternalPort: 25565, InternalPort: 25565, Protocol: "UDP", Name: "game"}
+
+	_, replaced := provider.Add(web, time.Time{})
+	assert.False(t, replaced)
+	old, replaced := provider.Add(api, now.Add(time.Hour))
+	assert.True(t, replaced)
+	assert.Equal(t, web, old)
+	provider.Add(game, now.Add(time.Minute))
+
+	ports, err := provider.GetPortMappings()
+	assert.NoError(t, err)
+	assert.Equal(t, []types.PortMapping{game, api}, ports)
+	assert.Equal(t, now.Add(time.Hour), provider.Mappings()[1].ExpiresAt)
+
+	assert.Empty(t, provider.Expire())
+	now = now.Add(time.Minute)
+	assert.Equal(t, []types.PortMapping{game}, provider.Expire())
+
+	removed, ok := provider.Remove(api.Key())
+	assert.True(t, ok)
+	assert.Equal(t, api, removed)
+	_, ok = provider.Remove(api.Key())
+	assert.False(t, ok)
+	assert.Empty(t, provider.Mappings())
+}
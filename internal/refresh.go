@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/metrics"
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/IonBazan/gangplank/internal/upnp"
+)
+
+// minRefreshWait keeps the scheduler from spinning when mappings are due in quick succession.
+const minRefreshWait = time.Second
+
+// leaseTolerance allows for the time a gateway takes to report a lease that it started counting down.
+const leaseTolerance = 5 * time.Second
+
+// Default renewal settings: mappings are renewed halfway through their lease, up to 10% earlier so that mappings
+// forwarded together do not all hit the router at once.
+const (
+	DefaultRenewFraction = 0.5
+	DefaultRenewJitter   = 0.1
+)
+
+// RefreshOptions configure how often mappings are renewed.
+type RefreshOptions struct {
+	// Interval is how often the providers are polled for new mappings. Mappings with a permanent lease are renewed
+	// at this interval too.
+	Interval time.Duration
+	// RenewFraction is the part of its lease after which a mapping is renewed.
+	RenewFraction float64
+	// Jitter moves each renewal earlier by up to this part of the renewal period.
+	Jitter float64
+}
+
+func (o RefreshOptions) Validate() error {
+	if o.Interval <= 0 {
+		return fmt.Errorf("refresh interval must be positive, got %s", o.Interval)
+	}
+	if o.RenewFraction <= 0 || o.RenewFraction > 1 {
+		return fmt.Errorf("renew fraction must be greater than 0 and at most 1, got %g", o.RenewFraction)
+	}
+	if o.Jitter < 0 || o.Jitter >= 1 {
+		return fmt.Errorf("renew jitter must be at least 0 and less than 1, got %g", o.Jitter)
+	}
+	return nil
+}
+
+// RefreshScheduler decides when each mapping has to be forwarded again. Every mapping is renewed once the configured
+// fraction of the lease granted by the router has passed, and mappings with a permanent lease every refresh interval.
+type RefreshScheduler struct {
+	options   RefreshOptions
+	forwarded map[string]forwardedMapping
+	now       func() time.Time
+	random    func() float64
+}
+
+// forwardedMapping is the mapping last forwarded for an external port and when it has to be renewed.
+type forwardedMapping struct {
+	mapping types.PortMapping
+	renewAt time.Time
+}
+
+func NewRefreshScheduler(options RefreshOptions) *RefreshScheduler {
+	return &RefreshScheduler{
+		options:   options,
+		forwarded: map[string]forwardedMapping{},
+		now:       time.Now,
+		random:    rand.Float64,
+	}
+}
+
+// Due returns the mappings that were never forwarded, replace another mapping of the same external port or are due
+// for renewal. Mappings that are no longer reported are forgotten.
+func (s *RefreshScheduler) Due(ports []types.PortMapping) []types.PortMapping {
+	now := s.now()
+	current := map[string]bool{}
+	var due []types.PortMapping
+	for _, m := range ports {
+		key := m.Key()
+		current[key] = true
+		last, ok := s.forwarded[key]
+		if !ok || last.mapping != m || !now.Before(last.renewAt) {
+			due = append(due, m)
+		}
+	}
+	for key := range s.forwarded {
+		if !current[key] {
+			delete(s.forwarded, key)
+		}
+	}
+	return due
+}
+
+// MarkForwarded records that the mapping was successfully forwarded with the given lease, zero meaning permanent.
+func (s *RefreshScheduler) MarkForwarded(m types.PortMapping, lease time.Duration) {
+	period := s.options.Interval
+	if lease > 0 {
+		period = time.Duration(float64(lease) * s.options.RenewFraction)
+	}
+	period -= time.Duration(float64(period) * s.options.Jitter * s.random())
+	s.forwarded[m.Key()] = forwardedMapping{mapping: m, renewAt: s.now().Add(period)}
+}
+
+// Forwarded reports whether the mapping was forwarded before, so that forwarding it again renews it.
+func (s *RefreshScheduler) Forwarded(m types.PortMapping) bool {
+	last, ok := s.forwarded[m.Key()]
+	return ok && last.mapping == m
+}
+
+// Reset makes every forwarded mapping due again.
+func (s *RefreshScheduler) Reset() {
+	for key, last := range s.forwarded {
+		last.renewAt = time.Time{}
+		s.forwarded[key] = last
+	}
+}
+
+// Wait returns how long to sleep until the next mapping is due, at most one refresh interval so that mappings
+// reported by event providers in the meantime are picked up.
+func (s *RefreshScheduler) Wait(ports []types.PortMapping) time.Duration {
+	now := s.now()
+	wait := s.options.Interval
+	for _, m := range ports {
+		last, ok := s.forwarded[m.Key()]
+		if !ok {
+			continue
+		}
+		wait = min(wait, last.renewAt.Sub(now))
+	}
+	return max(wait, minRefreshWait)
+}
+
+// RefreshPorts forwards the initial mappings and keeps renewing every mapping before its lease expires, or right away
+// when RequestRefresh is called. Only the winning claim of each external port is forwarded.
+func (g *Gangplank) RefreshPorts(ctx context.Context, options RefreshOptions, initialPorts []types.PortMapping) {
+	scheduler := NewRefreshScheduler(options)
+	ports := g.claims.Sync(initialPorts)
+	polled := true
+
+	for {
+		due := scheduler.Due(ports)
+		if len(due) > 0 {
+			log.Printf("Refreshing %d port mappings", len(due))
+		}
+		renewed := true
+		for _, m := range due {
+			// Mappings forwarded for the first time are counted as added by the client.
+			renewal := scheduler.Forwarded(m)
+			lease, err := g.renew(m, !renewal)
+			if renewal {
+				metrics.ObserveOperation(metrics.OperationRefresh, err)
+			}
+			if err != nil {
+				renewed = false
+				continue
+			}
+			scheduler.MarkForwarded(m, lease)
+		}
+		if polled && renewed {
+			metrics.LastRefresh.SetToCurrentTime()
+		}
+
+		timer := time.NewTimer(scheduler.Wait(ports))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-g.refreshRequests:
+			timer.Stop()
+			log.Printf("Refresh requested, renewing all port mappings")
+			scheduler.Reset()
+		}
+
+		log.Printf("Updating port mappings...")
+		// A failing provider contributes the mappings it reported last, so the others are still picked up.
+		next, err := g.GetPortMappings()
+		polled = err == nil
+		ports = g.claims.Sync(next)
+	}
+}
+
+// RequestRefresh asks RefreshPorts to poll the providers and renew every mapping right away. It returns false if a
+// refresh is already pending.
+func (g *Gangplank) RequestRefresh() bool {
+	select {
+	case g.refreshRequests <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// renew forwards a mapping and checks that the gateway took it. It returns the lease the gateway granted. Only first
+// forwards are counted as added mappings.
+func (g *Gangplank) renew(m types.PortMapping, first bool) (time.Duration, error) {
+	if g.upnpClient == nil {
+		log.Println("UPnP client is not initialized, skipping port forwarding.")
+		return 0, nil
+	}
+	forward := g.upnpClient.RenewPorts
+	if first {
+		forward = g.upnpClient.ForwardPorts
+	}
+	if err := forward([]types.PortMapping{m}); err != nil {
+		return 0, err
+	}
+
+	requested := m.TTL
+	if requested == 0 {
+		requested = g.upnpClient.LeaseDuration()
+	}
+	lease, err := g.upnpClient.VerifyMapping(m)
+	switch {
+	case errors.Is(err, upnp.ErrNotVerifiable):
+		return requested, nil
+	case errors.Is(err, upnp.ErrMappingMissing), errors.Is(err, upnp.ErrMappingModified):
+		log.Printf("Port mapping %d/%s for %s did not take: %v", m.ExternalPort, m.Protocol, m.Name, err)
+		return 0, err
+	case err != nil:
+		// The gateway took the mapping, it could only not be looked up.
+		log.Printf("Failed to verify port mapping %d/%s for %s: %v", m.ExternalPort, m.Protocol, m.Name, err)
+		return requested, nil
+	case lease == 0 && requested > 0:
+		log.Printf("Gateway granted port mapping %d/%s for %s a permanent lease instead of %s", m.ExternalPort, m.Protocol, m.Name, requested)
+	case lease < requested-leaseTolerance:
+		log.Printf("Gateway granted port mapping %d/%s for %s a lease of %s instead of %s", m.ExternalPort, m.Protocol, m.Name, lease, requested)
+	}
+	return lease, nil
+}
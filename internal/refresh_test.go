@@ -0,0 +1,268 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/metrics"
+	"github.com/IonBazan/gangplank/internal/providers"
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/IonBazan/gangplank/internal/upnp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshScheduler(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	scheduler := NewRefreshScheduler(RefreshOptions{Interval: 15 * time.Minute, RenewFraction: DefaultRenewFraction})
+	scheduler.now = func() time.Time { return now }
+	scheduler.random = func() float64 { return 0 }
+
+	web := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web"}
+	game := types.PortMapping{ExternalPort: 25565, InternalPort: 25565, Protocol: "TCP", Name: "minecraft", TTL: 10 * time.Minute}
+	short := types.PortMapping{ExternalPort: 53, InternalPort: 53, Protocol: "UDP", Name: "dns", TTL: time.Second}
+	ports := []types.PortMapping{web, game}
+
+	// New mappings are due immediately.
+	assert.Equal(t, ports, scheduler.Due(ports))
+	scheduler.MarkForwarded(web, 0)
+	scheduler.MarkForwarded(game, game.TTL)
+	assert.Empty(t, scheduler.Due(ports))
+	assert.Equal(t, 5*time.Minute, scheduler.Wait(ports), "mapping is renewed halfway through its lease")
+
+	now = now.Add(5 * time.Minute)
+	assert.Equal(t, []types.PortMapping{game}, scheduler.Due(ports))
+	scheduler.MarkForwarded(game, game.TTL)
+	assert.Equal(t, 5*time.Minute, scheduler.Wait(ports))
+
+	now = now.Add(5 * time.Minute)
+	assert.Equal(t, []types.PortMapping{game}, scheduler.Due(ports))
+	scheduler.MarkForwarded(game, game.TTL)
+
+	now = now.Add(5 * time.Minute)
+	assert.Equal(t, ports, scheduler.Due(ports), "mapping with a permanent lease is renewed every refresh interval")
+
+	// Very short leases do not make the scheduler spin.
+	scheduler.MarkForwarded(short, short.TTL)
+	assert.Equal(t, minRefreshWait, scheduler.Wait([]types.PortMapping{short}))
+
+	// Mappings that are gone are forgotten, so they are forwarded right away if they come back.
+	assert.Empty(t, scheduler.Due([]types.PortMapping{short}))
+	assert.Equal(t, []types.PortMapping{web}, scheduler.Due([]types.PortMapping{web}))
+	scheduler.MarkForwarded(web, 0)
+
+	// A mapping that takes over the external port of another one is forwarded right away.
+	override := types.PortMapping{ExternalPort: 8080, InternalPort: 8000, Protocol: "TCP", Name: "override"}
+	assert.Equal(t, []types.PortMapping{override}, scheduler.Due([]types.PortMapping{override}))
+	scheduler.MarkForwarded(override, 0)
+	assert.Empty(t, scheduler.Due([]types.PortMapping{override}))
+
+	assert.True(t, scheduler.Forwarded(override))
+	assert.False(t, scheduler.Forwarded(web), "replaced mapping was not forwarded")
+
+	scheduler.Reset()
+	assert.Equal(t, []types.PortMapping{override}, scheduler.Due([]types.PortMapping{override}), "reset makes every mapping due")
+	assert.True(t, scheduler.Forwarded(override), "reset mappings are renewed")
+}
+
+func TestGangplank_RefreshPortsMetrics(t *testing.T) {
+	operations := func(operation string) float64 {
+		return testutil.ToFloat64(metrics.Operations.WithLabelValues(operation, metrics.ResultSuccess))
+	}
+	added := operations(metrics.OperationAdd)
+	refreshed := operations(metrics.OperationRefresh)
+	web := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web"}
+	db := types.PortMapping{ExternalPort: 5432, InternalPort: 5432, Protocol: "TCP", Name: "db"}
+	provider := &MockPortProvider{Ports: []types.PortMapping{web}}
+	g := NewGangplank(nil, upnp.NewClientWithConnection(&upnp.DummyConnection{}, "192.168.1.100", upnp.DefaultLeaseDuration), Options{})
+	g.PortProviders = []providers.PortProvider{provider}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.RefreshPorts(ctx, RefreshOptions{Interval: time.Hour, RenewFraction: DefaultRenewFraction}, []types.PortMapping{web})
+	}()
+
+	assert.Eventually(t, func() bool { return operations(metrics.OperationAdd) == added+1 }, time.Second, 10*time.Millisecond, "first forward is counted as added")
+	assert.Equal(t, refreshed, operations(metrics.OperationRefresh))
+
+	// The requested refresh renews web and forwards db for the first time.
+	provider.Ports = []types.PortMapping{web, db}
+	assert.True(t, g.RequestRefresh())
+	assert.Eventually(t, func() bool { return operations(metrics.OperationRefresh) == refreshed+1 }, time.Second, 10*time.Millisecond, "renewal is counted as refreshed")
+	assert.Eventually(t, func() bool { return operations(metrics.OperationAdd) == added+2 }, time.Second, 10*time.Millisecond, "new mapping is counted as added")
+
+	cancel()
+	<-done
+	assert.Equal(t, added+2, operations(metrics.OperationAdd))
+	assert.Equal(t, refreshed+1, operations(metrics.OperationRefresh))
+}
+
+func TestGangplank_RequestRefresh(t *testing.T) {
+	g := NewGangplank(nil, nil, Options{})
+	assert.True(t, g.RequestRefresh())
+	assert.False(t, g.RequestRefresh(), "a pending refresh is not requested twice")
+	<-g.refreshRequests
+	assert.True(t, g.RequestRefresh())
+
+	assert.False(t, (&Gangplank{}).RequestRefresh(), "nothing to wake up")
+}
+
+func TestRefreshScheduler_FractionAndJitter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	scheduler := NewRefreshScheduler(RefreshOptions{Interval: 15 * time.Minute, RenewFraction: 0.8, Jitter: 0.25})
+	scheduler.now = func() time.Time { return now }
+	web := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web"}
+	ports := []types.PortMapping{web}
+
+	scheduler.random = func() float64 { return 0 }
+	scheduler.MarkForwarded(web, time.Hour)
+	assert.Equal(t, 15*time.Minute, scheduler.Wait(ports), "providers are polled every refresh interval")
+	now = now.Add(47 * time.Minute)
+	assert.Empty(t, scheduler.Due(ports))
+	now = now.Add(time.Minute)
+	assert.Equal(t, ports, scheduler.Due(ports), "mapping is renewed after 80% of its lease")
+
+	scheduler.random = func() float64 { return 1 }
+	scheduler.MarkForwarded(web, time.Hour)
+	now = now.Add(36 * time.Minute)
+	assert.Equal(t, ports, scheduler.Due(ports), "jitter moves the renewal up to 25% earlier")
+}
+
+func TestRefreshOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name        string
+		options     RefreshOptions
+		errContains string
+	}{
+		{
+			name:    "Defaults",
+			options: RefreshOptions{Interval: 15 * time.Minute, RenewFraction: DefaultRenewFraction, Jitter: DefaultRenewJitter},
+		},
+		{
+			name:        "No interval",
+			options:     RefreshOptions{RenewFraction: DefaultRenewFraction},
+			errContains: "refresh interval must be positive",
+		},
+		{
+			name:        "Fraction above the lease",
+			options:     RefreshOptions{Interval: time.Minute, RenewFraction: 1.5},
+			errContains: "renew fraction must be greater than 0 and at most 1",
+		},
+		{
+			name:        "Jitter of a whole period",
+			options:     RefreshOptions{Interval: time.Minute, RenewFraction: 0.8, Jitter: 1},
+			errContains: "renew jitter must be at least 0 and less than 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.options.Validate()
+			if tt.errContains == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errContains)
+			}
+		})
+	}
+}
+
+// leaseConnection reports every forwarded mapping with a fixed lease, or none when lease is negative.
+type leaseConnection struct {
+	upnp.DummyConnection
+	lease int
+}
+
+func (c *leaseConnection) GetSpecificPortMappingEntry(NewRemoteHost string, NewExternalPort uint16, NewProtocol string) (uint16, string, bool, string, uint32, error) {
+	if c.lease < 0 {
+		return 0, "", false, "", 0, upnp.NewUPnPError(714, "NoSuchEntryInArray")
+	}
+	for _, m := range c.Forwarded {
+		if m.ExternalPort == int(NewExternalPort) && m.Protocol == NewProtocol {
+			return uint16(m.InternalPort), "192.168.1.100", true, m.Name, uint32(c.lease), nil
+		}
+	}
+	return 0, "", false, "", 0, upnp.NewUPnPError(714, "NoSuchEntryInArray")
+}
+
+// faultConnection answers every lookup with the same UPnP error.
+type faultConnection struct {
+	upnp.DummyConnection
+	code int
+}
+
+func (c *faultConnection) GetSpecificPortMappingEntry(NewRemoteHost string, NewExternalPort uint16, NewProtocol string) (uint16, string, bool, string, uint32, error) {
+	return 0, "", false, "", 0, upnp.NewUPnPError(c.code, "ActionNotAuthorized")
+}
+
+func TestGangplank_Renew(t *testing.T) {
+	web := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web"}
+	game := types.PortMapping{ExternalPort: 25565, InternalPort: 25565, Protocol: "TCP", Name: "minecraft", TTL: 2 * time.Hour}
+
+	tests := []struct {
+		name       string
+		connection upnp.UPnPConnection
+		mapping    types.PortMapping
+		wantLease  time.Duration
+		wantErr    bool
+	}{
+		{
+			name:       "Gateway without lookups gets the requested lease",
+			connection: &upnp.DummyConnection{},
+			mapping:    game,
+			wantLease:  2 * time.Hour,
+		},
+		{
+			name:       "Lease granted by the gateway",
+			connection: &leaseConnection{lease: 600},
+			mapping:    web,
+			wantLease:  10 * time.Minute,
+		},
+		{
+			name:       "Permanent lease",
+			connection: &leaseConnection{lease: 0},
+			mapping:    game,
+			wantLease:  0,
+		},
+		{
+			name:       "Mapping missing after renewal",
+			connection: &leaseConnection{lease: -1},
+			mapping:    web,
+			wantErr:    true,
+		},
+		{
+			name:       "Lookup rejected by the gateway",
+			connection: &faultConnection{code: 606},
+			mapping:    game,
+			wantLease:  2 * time.Hour,
+		},
+		{
+			name:       "Forwarding fails",
+			connection: &upnp.DummyConnection{ForwardErr: errors.New("ConflictInMappingEntry")},
+			mapping:    web,
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &Gangplank{upnpClient: upnp.NewClientWithConnection(tt.connection, "192.168.1.100", upnp.DefaultLeaseDuration)}
+			added := testutil.ToFloat64(metrics.Operations.WithLabelValues(metrics.OperationAdd, metrics.ResultSuccess))
+			failed := testutil.ToFloat64(metrics.Operations.WithLabelValues(metrics.OperationAdd, metrics.ResultError))
+
+			lease, err := g.renew(tt.mapping, false)
+			assert.Equal(t, added, testutil.ToFloat64(metrics.Operations.WithLabelValues(metrics.OperationAdd, metrics.ResultSuccess)), "renewals are not counted as added")
+			assert.Equal(t, failed, testutil.ToFloat64(metrics.Operations.WithLabelValues(metrics.OperationAdd, metrics.ResultError)))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantLease, lease)
+		})
+	}
+}
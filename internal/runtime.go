@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/providers"
+	"github.com/IonBazan/gangplank/internal/types"
+)
+
+// errNoRuntimeMappings is returned when Gangplank was not created with NewGangplank.
+var errNoRuntimeMappings = errors.New("runtime port mappings are not enabled")
+
+// AddRuntimeMappings adds mappings that no provider declares, e.g. through the management API, and forwards the ones
+// that win their port. They rank like static mappings and replace the runtime mappings of the same ports. A zero
+// expiry keeps them until they are removed.
+func (g *Gangplank) AddRuntimeMappings(mappings []types.PortMapping, expiresAt time.Time) error {
+	if g.runtimeProvider == nil {
+		return errNoRuntimeMappings
+	}
+
+	var forward []types.PortMapping
+	for _, m := range mappings {
+		m.Source = providers.RuntimeSource
+		var next types.PortMapping
+		handover := false
+		if old, ok := g.runtimeProvider.Add(m, expiresAt); ok && old != m {
+			next, _, handover = g.claims.Release(old)
+		}
+		switch {
+		case g.claims.Claim(m):
+			forward = append(forward, m)
+		case handover:
+			forward = append(forward, next)
+		}
+	}
+
+	return g.ForwardPorts(forward)
+}
+
+// RemoveRuntimeMapping removes the runtime mapping of the external port and protocol of m and deletes it from the
+// gateway, or hands its port over to the next source claiming it. It reports whether there was such a mapping.
+func (g *Gangplank) RemoveRuntimeMapping(m types.PortMapping) (bool, error) {
+	if g.runtimeProvider == nil {
+		return false, nil
+	}
+
+	removed, ok := g.runtimeProvider.Remove(m.Key())
+	if !ok {
+		return false, nil
+	}
+	return true, g.release(removed, true)
+}
+
+// RuntimeMappings returns the runtime mappings ordered by their key.
+func (g *Gangplank) RuntimeMappings() []providers.RuntimeMapping {
+	if g.runtimeProvider == nil {
+		return nil
+	}
+	return g.runtimeProvider.Mappings()
+}
+
+// ExpireRuntimeMappings removes the runtime mappings whose expiry passed, checking at the given interval until the
+// context is done.
+func (g *Gangplank) ExpireRuntimeMappings(ctx context.Context, interval time.Duration) {
+	if g.runtimeProvider == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, m := range g.runtimeProvider.Expire() {
+			log.Printf("Runtime port mapping %d/%s for %s expired", m.ExternalPort, m.Protocol, m.Name)
+			g.release(m, true)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/providers"
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/IonBazan/gangplank/internal/upnp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGangplank_RuntimeMappings(t *testing.T) {
+	connection := &upnp.DummyConnection{}
+	g := NewGangplank(nil, upnp.NewClientWithConnection(connection, "192.168.1.100", upnp.DefaultLeaseDuration), Options{})
+
+	web := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web", ContainerID: "web1234567890"}
+	override := types.PortMapping{ExternalPort: 8080, InternalPort: 8000, Protocol: "TCP", Name: "maintenance"}
+	game := types.PortMapping{ExternalPort: 25565, InternalPort: 25565, Protocol: "UDP", Name: "game"}
+	expiresAt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	require.True(t, g.claims.Claim(web))
+	require.NoError(t, g.ForwardPorts([]types.PortMapping{web}))
+
+	require.NoError(t, g.AddRuntimeMappings([]types.PortMapping{override, game}, expiresAt))
+	require.Len(t, connection.Forwarded, 3)
+	assert.Equal(t, 8000, connection.Forwarded[1].InternalPort, "runtime mapping takes the port over from the container")
+
+	override.Source = providers.RuntimeSource
+	game.Source = providers.RuntimeSource
+	assert.Equal(t, []MappingStatus{
+		{PortMapping: game, Forwarded: true, ExpiresAt: expiresAt},
+		{PortMapping: override, Forwarded: true, ExpiresAt: expiresAt},
+	}, g.Mappings())
+
+	removed, err := g.RemoveRuntimeMapping(types.PortMapping{ExternalPort: 8080, Protocol: "tcp"})
+	require.NoError(t, err)
+	assert.True(t, removed)
+	require.Len(t, connection.Forwarded, 4)
+	assert.Equal(t, 80, connection.Forwarded[3].InternalPort, "port is handed back to the container")
+	assert.Empty(t, connection.Deleted)
+
+	removed, err = g.RemoveRuntimeMapping(override)
+	assert.NoError(t, err)
+	assert.False(t, removed, "container mappings cannot be removed")
+
+	removed, err = g.RemoveRuntimeMapping(game)
+	require.NoError(t, err)
+	assert.True(t, removed)
+	require.Len(t, connection.Deleted, 1)
+	assert.Equal(t, uint16(25565), connection.Deleted[0].ExtPort)
+
+	assert.Equal(t, []MappingStatus{{PortMapping: web, Forwarded: true}}, g.Mappings())
+
+	assert.ErrorIs(t, (&Gangplank{}).AddRuntimeMappings([]types.PortMapping{game}, time.Time{}), errNoRuntimeMappings)
+}
+
+func TestGangplank_ExpireRuntimeMappings(t *testing.T) {
+	g := NewGangplank(nil, upnp.NewDummyClient(upnp.DefaultLeaseDuration), Options{})
+	game := types.PortMapping{ExternalPort: 25565, InternalPort: 25565, Protocol: "UDP", Name: "game"}
+	dns := types.PortMapping{ExternalPort: 53, InternalPort: 53, Protocol: "UDP", Name: "dns"}
+
+	require.NoError(t, g.AddRuntimeMappings([]types.PortMapping{game}, time.Now()))
+	require.NoError(t, g.AddRuntimeMappings([]types.PortMapping{dns}, time.Time{}))
+	require.Len(t, g.Mappings(), 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go g.ExpireRuntimeMappings(ctx, 10*time.Millisecond)
+
+	assert.Eventually(t, func() bool { return len(g.Mappings()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "dns", g.RuntimeMappings()[0].Name, "mappings without an expiry are kept")
+}
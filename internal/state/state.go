@@ -0,0 +1,216 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/types"
+)
+
+// SchemaVersion is the version of the state file written by this build. Files written by newer builds are rejected
+// rather than silently dropping what they record.
+const SchemaVersion = 1
+
+// FileName is the name of the state file inside the data directory.
+const FileName = "state.json"
+
+// Entry records a mapping created on a gateway.
+type Entry struct {
+	Gateway          string `json:"gateway"`
+	ExternalPort     int    `json:"externalPort"`
+	AutoExternalPort bool   `json:"autoExternalPort,omitempty"`
+	// AssignedPort is the external port the gateway picked for a mapping with an automatic external port.
+	AssignedPort   int       `json:"assignedPort,omitempty"`
+	InternalPort   int       `json:"internalPort"`
+	InternalClient string    `json:"internalClient"`
+	Protocol       string    `json:"protocol"`
+	RemoteHost     string    `json:"remoteHost,omitempty"`
+	Name           string    `json:"name,omitempty"`
+	Source         string    `json:"source,omitempty"`
+	ContainerID    string    `json:"containerId,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+	RefreshedAt    time.Time `json:"refreshedAt"`
+}
+
+// Mapping returns the recorded mapping, with enough detail to renew or delete it.
+func (e Entry) Mapping() types.PortMapping {
+	return types.PortMapping{
+		ExternalPort:     e.ExternalPort,
+		AutoExternalPort: e.AutoExternalPort,
+		InternalPort:     e.InternalPort,
+		Protocol:         e.Protocol,
+		RemoteHost:       e.RemoteHost,
+		Name:             e.Name,
+		Source:           e.Source,
+		ContainerID:      e.ContainerID,
+	}
+}
+
+func (e Entry) key() string {
+	return e.Gateway + " " + e.Mapping().Key()
+}
+
+type stateFile struct {
+	Version  int     `json:"version"`
+	Mappings []Entry `json:"mappings"`
+}
+
+// Store keeps the mappings created by Gangplank in a JSON file, so that they can be told apart from other router
+// entries after a restart. The file is read before every change, so that several processes (e.g. the daemon and the
+// add command) do not overwrite each other's entries, and replaced atomically.
+type Store struct {
+	path string
+	mu   sync.Mutex
+	now  func() time.Time
+}
+
+// Open creates the data directory if needed and checks that its state file can be read.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	s := &Store{path: filepath.Join(dir, FileName), now: time.Now}
+	if _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Path returns the location of the state file.
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Entries returns the mappings recorded for a gateway, ordered by external port and protocol.
+func (s *Store) Entries(gateway string) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	var result []Entry
+	for _, e := range entries {
+		if e.Gateway == gateway {
+			result = append(result, e)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].key() < result[j].key() })
+	return result, nil
+}
+
+// RecordMapping records that a mapping was forwarded, keeping the creation time of an entry that is refreshed.
+func (s *Store) RecordMapping(gateway string, m types.PortMapping, assignedPort int, internalClient string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.load()
+	if err != nil {
+		return err
+	}
+	now := s.now()
+	entry := Entry{
+		Gateway:          gateway,
+		ExternalPort:     m.ExternalPort,
+		AutoExternalPort: m.AutoExternalPort,
+		InternalPort:     m.InternalPort,
+		InternalClient:   internalClient,
+		Protocol:         m.Protocol,
+		RemoteHost:       m.RemoteHost,
+		Name:             m.Name,
+		Source:           m.Source,
+		ContainerID:      m.ContainerID,
+		CreatedAt:        now,
+		RefreshedAt:      now,
+	}
+	if m.AutoExternalPort {
+		entry.AssignedPort = assignedPort
+	}
+	if old, ok := entries[entry.key()]; ok {
+		entry.CreatedAt = old.CreatedAt
+	}
+	entries[entry.key()] = entry
+	return s.save(entries)
+}
+
+// ForgetMapping removes the entry of a mapping that was deleted from a gateway.
+func (s *Store) ForgetMapping(gateway string, m types.PortMapping) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.load()
+	if err != nil {
+		return err
+	}
+	key := gateway + " " + m.Key()
+	if _, ok := entries[key]; !ok {
+		return nil
+	}
+	delete(entries, key)
+	return s.save(entries)
+}
+
+func (s *Store) load() (map[string]Entry, error) {
+	entries := map[string]Entry{}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var file stateFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", s.path, err)
+	}
+	if file.Version > SchemaVersion {
+		return nil, fmt.Errorf("state file %s uses schema version %d, this version of Gangplank supports up to %d", s.path, file.Version, SchemaVersion)
+	}
+	for _, e := range file.Mappings {
+		entries[e.key()] = e
+	}
+	return entries, nil
+}
+
+// save writes the entries to a temporary file and renames it over the state file, so that a crash never leaves a
+// truncated file behind.
+func (s *Store) save(entries map[string]Entry) error {
+	file := stateFile{Version: SchemaVersion, Mappings: make([]Entry, 0, len(entries))}
+	for _, e := range entries {
+		file.Mappings = append(file.Mappings, e)
+	}
+	sort.Slice(file.Mappings, func(i, j int) bool { return file.Mappings[i].key() < file.Mappings[j].key() })
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), FileName+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
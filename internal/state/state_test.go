@@ -0,0 +1,91 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testGateway = "http://192.168.1.1:49000/igd.xml"
+
+func TestStore_RecordAndForget(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	store, err := Open(dir)
+	require.NoError(t, err)
+
+	created := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return created }
+
+	web := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web", ContainerID: "web1234567890"}
+	game := types.PortMapping{ExternalPort: 25565, InternalPort: 25565, Protocol: "UDP", Name: "game", AutoExternalPort: true}
+	static := types.PortMapping{ExternalPort: 443, InternalPort: 443, Protocol: "TCP", Name: "https", Source: "config.yaml"}
+
+	require.NoError(t, store.RecordMapping(testGateway, web, 0, "192.168.1.100"))
+	require.NoError(t, store.RecordMapping(testGateway, game, 25566, "192.168.1.100"))
+	require.NoError(t, store.RecordMapping("http://10.0.0.1/igd.xml", static, 0, "10.0.0.2"))
+
+	refreshed := created.Add(time.Hour)
+	store.now = func() time.Time { return refreshed }
+	require.NoError(t, store.RecordMapping(testGateway, web, 0, "192.168.1.100"))
+
+	// A new store reads what the previous one wrote.
+	reopened, err := Open(dir)
+	require.NoError(t, err)
+	entries, err := reopened.Entries(testGateway)
+	require.NoError(t, err)
+	assert.Equal(t, []Entry{
+		{
+			Gateway: testGateway, ExternalPort: 25565, AutoExternalPort: true, AssignedPort: 25566, InternalPort: 25565,
+			InternalClient: "192.168.1.100", Protocol: "UDP", Name: "game", CreatedAt: created, RefreshedAt: created,
+		},
+		{
+			Gateway: testGateway, ExternalPort: 8080, InternalPort: 80, InternalClient: "192.168.1.100", Protocol: "TCP",
+			Name: "web", ContainerID: "web1234567890", CreatedAt: created, RefreshedAt: refreshed,
+		},
+	}, entries)
+	assert.Equal(t, game, entries[0].Mapping())
+
+	require.NoError(t, reopened.ForgetMapping(testGateway, web))
+	require.NoError(t, reopened.ForgetMapping(testGateway, static), "unknown mappings are ignored")
+	entries, err = store.Entries(testGateway)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1, "temporary files are removed")
+}
+
+func TestOpen_Errors(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		errContains string
+	}{
+		{
+			name:        "Invalid JSON",
+			content:     "{",
+			errContains: "failed to parse state file",
+		},
+		{
+			name:        "Newer schema",
+			content:     `{"version": 2, "mappings": []}`,
+			errContains: "uses schema version 2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(dir, FileName), []byte(tt.content), 0o644))
+
+			_, err := Open(dir)
+			assert.ErrorContains(t, err, tt.errContains)
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Port entries are used by the gangplank.forward labels, the add/delete commands and string items in the ports
+// list of the config file. Their grammar (ABNF, whitespace around separators is ignored) is:
+//
+//	label    = entry *( "," entry )
+//	entry    = target *( ";" option )
+//	target   = "published" / ports                   ; "published" is only valid in labels
+//	ports    = range [ ":" [ range ] ] [ "/" protocol ]
+//	         / ":" range [ "/" protocol ]
+//	range    = port [ "-" port ]
+//	protocol = "tcp" / "udp" / "both" / "tcp+udp"    ; case-insensitive
+//	option   = key "=" value
+//	key      = "name" / "ttl" / "description" / "remote-host" / "ext" / "enabled" / "priority"
+//	value    = *( %x20-2B / %x2D-3A / %x3C-7E )      ; anything but "," and ";"
+//
+// The options set the corresponding PortMapping fields. "ttl" is a Go duration such as "2h", "enabled" a boolean,
+// "priority" an integer and "ext" either an external port, which moves the external side of the mapping (or range) to
+// that port, or "auto" to let the router pick a free external port.
+//
+// For example: "443:443/tcp;name=https;ttl=2h, 25565/udp;ext=auto".
+
+const (
+	OptionName        = "name"
+	OptionTTL         = "ttl"
+	OptionDescription = "description"
+	OptionRemoteHost  = "remote-host"
+	OptionExternal    = "ext"
+	OptionEnabled     = "enabled"
+	OptionPriority    = "priority"
+)
+
+var knownOptions = []string{OptionName, OptionTTL, OptionDescription, OptionRemoteHost, OptionExternal, OptionEnabled, OptionPriority}
+
+// MappingOption is a single "<key>=<value>" option of a port entry.
+type MappingOption struct {
+	Key   string
+	Value string
+}
+
+// MappingOptions are the options of a port entry, in the order they were given.
+type MappingOptions []MappingOption
+
+// ParsePortEntry splits a port entry into its target (ports or "published") and its options.
+func ParsePortEntry(entry string) (string, MappingOptions, error) {
+	parts := strings.Split(entry, ";")
+	target := strings.TrimSpace(parts[0])
+
+	var options MappingOptions
+	seen := map[string]bool{}
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return "", nil, fmt.Errorf("Invalid option %q: expected <key>=<value>", part)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !isKnownOption(key) {
+			return "", nil, fmt.Errorf("Unknown option %q: expected one of %s", key, strings.Join(knownOptions, ", "))
+		}
+		if seen[key] {
+			return "", nil, fmt.Errorf("Option %q is set more than once", key)
+		}
+		seen[key] = true
+		options = append(options, MappingOption{Key: key, Value: strings.TrimSpace(value)})
+	}
+
+	return target, options, nil
+}
+
+func isKnownOption(key string) bool {
+	for _, known := range knownOptions {
+		if key == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Has reports whether the option with the given key was set.
+func (o MappingOptions) Has(key string) bool {
+	for _, option := range o {
+		if option.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply sets the mapping fields selected by the options.
+func (o MappingOptions) Apply(m *PortMapping) error {
+	for _, option := range o {
+		switch option.Key {
+		case OptionName:
+			m.Name = option.Value
+		case OptionDescription:
+			m.Description = option.Value
+		case OptionRemoteHost:
+			m.RemoteHost = option.Value
+		case OptionTTL:
+			ttl, err := time.ParseDuration(option.Value)
+			if err != nil {
+				return fmt.Errorf("Invalid ttl %q: %v", option.Value, err)
+			}
+			m.TTL = ttl
+		case OptionEnabled:
+			enabled, err := strconv.ParseBool(option.Value)
+			if err != nil {
+				return fmt.Errorf("Invalid enabled value %q: expected true or false", option.Value)
+			}
+			m.Enabled = &enabled
+		case OptionPriority:
+			priority, err := strconv.Atoi(option.Value)
+			if err != nil {
+				return fmt.Errorf("Invalid priority %q: expected an integer", option.Value)
+			}
+			m.Priority = priority
+		case OptionExternal:
+			if strings.EqualFold(option.Value, "auto") {
+				m.AutoExternalPort = true
+				continue
+			}
+			port, err := strconv.Atoi(option.Value)
+			if err != nil {
+				return fmt.Errorf("Invalid ext value %q: expected a port or auto", option.Value)
+			}
+			if m.ExternalPortEnd != 0 {
+				m.ExternalPortEnd += port - m.ExternalPort
+			}
+			m.ExternalPort = port
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePortMapping_Options(t *testing.T) {
+	disabled := false
+	tests := []struct {
+		name        string
+		input       string
+		wantMapping PortMapping
+		errContains string
+	}{
+		{
+			name:  "Name and TTL",
+			input: "443:443/tcp;name=https;ttl=2h",
+			wantMapping: PortMapping{
+				ExternalPort: 443, InternalPort: 443, Protocol: "TCP", Name: "https", TTL: 2 * time.Hour,
+			},
+		},
+		{
+			name:  "Whitespace, description, remote host and enabled",
+			input: " 8443:443 ; description=Admin panel ; remote-host=203.0.113.10 ; enabled=false ",
+			wantMapping: PortMapping{
+				ExternalPort: 8443, InternalPort: 443, Protocol: "TCP", Description: "Admin panel", RemoteHost: "203.0.113.10", Enabled: &disabled,
+			},
+		},
+		{
+			name:  "Priority",
+			input: "443/tcp;priority=10",
+			wantMapping: PortMapping{
+				ExternalPort: 443, InternalPort: 443, Protocol: "TCP", Priority: 10,
+			},
+		},
+		{
+			name:  "Automatic external port",
+			input: "25565/udp;ext=auto",
+			wantMapping: PortMapping{
+				ExternalPort: 25565, InternalPort: 25565, Protocol: "UDP", AutoExternalPort: true,
+			},
+		},
+		{
+			name:  "External port moves a range",
+			input: "27015-27030/udp;ext=37015",
+			wantMapping: PortMapping{
+				ExternalPort: 37015, ExternalPortEnd: 37030, InternalPort: 27015, InternalPortEnd: 27030, Protocol: "UDP",
+			},
+		},
+		{
+			name:        "Unknown option",
+			input:       "443;color=blue",
+			errContains: `Unknown option "color"`,
+		},
+		{
+			name:        "Option without value",
+			input:       "443;name",
+			errContains: `Invalid option "name"`,
+		},
+		{
+			name:        "Repeated option",
+			input:       "443;name=a;name=b",
+			errContains: `Option "name" is set more than once`,
+		},
+		{
+			name:        "Invalid TTL",
+			input:       "443;ttl=forever",
+			errContains: `Invalid ttl "forever"`,
+		},
+		{
+			name:        "Invalid enabled",
+			input:       "443;enabled=maybe",
+			errContains: `Invalid enabled value "maybe"`,
+		},
+		{
+			name:        "Invalid priority",
+			input:       "443;priority=high",
+			errContains: `Invalid priority "high"`,
+		},
+		{
+			name:        "Invalid external port",
+			input:       "443;ext=70000",
+			errContains: "External port must be a number between 1 and 65535",
+		},
+		{
+			name:        "Automatic external port with a range",
+			input:       "27015-27030/udp;ext=auto",
+			errContains: "Automatic external ports cannot be used with port ranges",
+		},
+		{
+			name:        "Invalid remote host",
+			input:       "443;remote-host=office",
+			errContains: "Remote host must be an IP address",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotMapping, err := ParsePortMapping(tt.input)
+			if tt.errContains != "" {
+				assert.ErrorContains(t, err, tt.errContains)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantMapping, gotMapping)
+			}
+		})
+	}
+}
+
+func TestParsePortEntry(t *testing.T) {
+	target, options, err := ParsePortEntry("published; TTL=1h ;name=web")
+	assert.NoError(t, err)
+	assert.Equal(t, "published", target)
+	assert.Equal(t, MappingOptions{{Key: OptionTTL, Value: "1h"}, {Key: OptionName, Value: "web"}}, options)
+	assert.True(t, options.Has(OptionName))
+	assert.False(t, options.Has(OptionExternal))
+}
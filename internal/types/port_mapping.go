@@ -4,16 +4,43 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// ProtocolBoth forwards a mapping for both TCP and UDP. "TCP+UDP" is accepted as an alias.
+const ProtocolBoth = "BOTH"
+
+// MaxPortRangeSize caps how many individual mappings a single port range may expand to.
+const MaxPortRangeSize = 1000
+
 // PortMapping represents a single port mapping configuration.
+// A port range is described by ExternalPortEnd (and optionally InternalPortEnd) and is expanded with Expand.
 type PortMapping struct {
-	ExternalPort int    `mapstructure:"externalPort" yaml:"externalPort"`
-	InternalPort int    `mapstructure:"internalPort" yaml:"internalPort"`
-	Protocol     string `mapstructure:"protocol" yaml:"protocol"`
-	Name         string `mapstructure:"name" yaml:"name"`
+	ExternalPort    int    `mapstructure:"externalPort" yaml:"externalPort"`
+	InternalPort    int    `mapstructure:"internalPort" yaml:"internalPort"`
+	Protocol        string `mapstructure:"protocol" yaml:"protocol"`
+	Name            string `mapstructure:"name" yaml:"name"`
+	ExternalPortEnd int    `mapstructure:"externalPortEnd" yaml:"externalPortEnd,omitempty"`
+	InternalPortEnd int    `mapstructure:"internalPortEnd" yaml:"internalPortEnd,omitempty"`
+	// RemoteHost restricts the mapping to connections from a single remote IP address. Empty allows any host.
+	RemoteHost string `mapstructure:"remoteHost" yaml:"remoteHost,omitempty"`
+	// TTL overrides the lease duration requested from the router. Zero uses the global lease duration.
+	TTL time.Duration `mapstructure:"ttl" yaml:"ttl,omitempty"`
+	// Description overrides the description shown in the router. Empty uses "Gangplank UPnP: <name>".
+	Description string `mapstructure:"description" yaml:"description,omitempty"`
+	// Enabled can be set to false to keep a mapping in the config without forwarding it. Nil means enabled.
+	Enabled *bool `mapstructure:"enabled" yaml:"enabled,omitempty"`
+	// AutoExternalPort lets the router pick a free external port, using ExternalPort as a hint.
+	AutoExternalPort bool `mapstructure:"autoExternalPort" yaml:"autoExternalPort,omitempty"`
+	// Priority decides which mapping is forwarded when several sources claim the same external port. Higher wins.
+	Priority int `mapstructure:"priority" yaml:"priority,omitempty"`
+	// Source identifies where the mapping was declared, e.g. the config file it was read from.
+	Source string `mapstructure:"-" yaml:"-"`
+	// ContainerID identifies the container (or task or allocation) the mapping was read from, if any.
+	ContainerID string `mapstructure:"-" yaml:"-"`
 }
 
 func (p PortMapping) Validate() error {
@@ -24,17 +51,150 @@ func (p PortMapping) Validate() error {
 		return fmt.Errorf("Internal port must be a number between 1 and 65535, got %d", p.InternalPort)
 	}
 	protocol := strings.ToUpper(p.Protocol)
-	if protocol != "TCP" && protocol != "UDP" {
-		return fmt.Errorf("Protocol must be 'TCP' or 'UDP', got %s", p.Protocol)
+	if protocol != "TCP" && protocol != "UDP" && !p.IsBothProtocols() {
+		return fmt.Errorf("Protocol must be 'TCP' or 'UDP' (or 'BOTH' for both of them), got %s", p.Protocol)
+	}
+
+	if p.TTL < 0 {
+		return fmt.Errorf("TTL must not be negative, got %s", p.TTL)
+	}
+	if p.RemoteHost != "" && net.ParseIP(p.RemoteHost) == nil {
+		return fmt.Errorf("Remote host must be an IP address, got %s", p.RemoteHost)
+	}
+
+	if p.AutoExternalPort && p.IsRange() {
+		return fmt.Errorf("Automatic external ports cannot be used with port ranges")
+	}
+
+	return p.validateRange()
+}
+
+// Key identifies the router entry of a single-port mapping. Routers key mappings by remote host, external port and
+// protocol, so the same port may be mapped once per remote host.
+func (p PortMapping) Key() string {
+	key := fmt.Sprintf("%d/%s", p.ExternalPort, strings.ToUpper(p.Protocol))
+	if p.RemoteHost != "" {
+		key += " from " + p.RemoteHost
+	}
+	return key
+}
+
+func (p PortMapping) validateRange() error {
+	if p.ExternalPortEnd == 0 && p.InternalPortEnd == 0 {
+		return nil
+	}
+
+	externalEnd := p.ExternalPortEnd
+	if externalEnd == 0 {
+		externalEnd = p.ExternalPort
+	}
+	if externalEnd < p.ExternalPort || externalEnd > 65535 {
+		return fmt.Errorf("External port range %d-%d is invalid", p.ExternalPort, externalEnd)
+	}
+	size := externalEnd - p.ExternalPort + 1
+	if size > MaxPortRangeSize {
+		return fmt.Errorf("Port range %d-%d is too large: at most %d ports are allowed", p.ExternalPort, externalEnd, MaxPortRangeSize)
+	}
+
+	internalEnd := p.InternalPort + size - 1
+	if p.InternalPortEnd != 0 && p.InternalPortEnd != internalEnd {
+		return fmt.Errorf("Internal port range %d-%d must be the same size as external port range %d-%d", p.InternalPort, p.InternalPortEnd, p.ExternalPort, externalEnd)
+	}
+	if internalEnd > 65535 {
+		return fmt.Errorf("Internal port range %d-%d is invalid", p.InternalPort, internalEnd)
 	}
 
 	return nil
 }
 
-// ParsePortMapping parses a string in the format "<external>:<internal>/<protocol>", "<external>:<internal>", or "<port>".
-// If no protocol is provided, it defaults to TCP.
-// If a single port is provided, it is used for both external and internal ports.
+// IsBothProtocols reports whether the mapping should be forwarded for both TCP and UDP.
+func (p PortMapping) IsBothProtocols() bool {
+	protocol := strings.ToUpper(p.Protocol)
+	return protocol == ProtocolBoth || protocol == "TCP+UDP"
+}
+
+// IsEnabled reports whether the mapping should be forwarded.
+func (p PortMapping) IsEnabled() bool {
+	return p.Enabled == nil || *p.Enabled
+}
+
+// IsRange reports whether the mapping covers more than a single port.
+func (p PortMapping) IsRange() bool {
+	return p.ExternalPortEnd > p.ExternalPort || p.InternalPortEnd > p.InternalPort
+}
+
+// Expand validates the mapping and turns a port range into individual single-port mappings.
+// A mapping for both protocols is expanded into a TCP and a UDP mapping for every port.
+// Disabled mappings expand to nothing, so every expanded mapping is enabled.
+func (p PortMapping) Expand() ([]PortMapping, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	if !p.IsEnabled() {
+		return []PortMapping{}, nil
+	}
+
+	externalEnd := max(p.ExternalPortEnd, p.ExternalPort)
+	single := p
+	single.ExternalPortEnd = 0
+	single.InternalPortEnd = 0
+	single.Enabled = nil
+
+	protocols := []string{p.Protocol}
+	if p.IsBothProtocols() {
+		protocols = []string{"TCP", "UDP"}
+	}
+
+	mappings := make([]PortMapping, 0, (externalEnd-p.ExternalPort+1)*len(protocols))
+	for offset := 0; p.ExternalPort+offset <= externalEnd; offset++ {
+		single.ExternalPort = p.ExternalPort + offset
+		single.InternalPort = p.InternalPort + offset
+		for _, protocol := range protocols {
+			single.Protocol = protocol
+			mappings = append(mappings, single)
+		}
+	}
+	return mappings, nil
+}
+
+// ExpandPortMappings expands every mapping in the list, see PortMapping.Expand.
+func ExpandPortMappings(mappings []PortMapping) ([]PortMapping, error) {
+	expanded := make([]PortMapping, 0, len(mappings))
+	for _, m := range mappings {
+		single, err := m.Expand()
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, single...)
+	}
+	return expanded, nil
+}
+
+// ParsePortMapping parses a port entry like "<external>:<internal>/<protocol>;<key>=<value>", see ParsePortEntry for
+// the full grammar and the supported options.
 func ParsePortMapping(mappingStr string) (PortMapping, error) {
+	target, options, err := ParsePortEntry(mappingStr)
+	if err != nil {
+		return PortMapping{}, logError(err.Error())
+	}
+
+	mapping, err := parsePorts(target)
+	if err != nil {
+		return mapping, err
+	}
+	if err := options.Apply(&mapping); err != nil {
+		return mapping, logError(err.Error())
+	}
+
+	return mapping, mapping.Validate()
+}
+
+// parsePorts parses a string in the format "<external>:<internal>/<protocol>", "<external>:<internal>", or "<port>".
+// If no protocol is provided, it defaults to TCP. "both" (or "tcp+udp") selects both TCP and UDP.
+// If a single port is provided, it is used for both external and internal ports.
+// Each port can also be a range like "27015-27030". An internal range must match the size of the external range, and
+// a single internal port with an external range starts an internal range of the same size.
+func parsePorts(mappingStr string) (PortMapping, error) {
 	var mapping PortMapping
 
 	parts := strings.Split(mappingStr, "/")
@@ -44,26 +204,29 @@ func ParsePortMapping(mappingStr string) (PortMapping, error) {
 	} else if len(parts) != 1 {
 		return mapping, logError("Invalid format: expected <external>:<internal>[/<protocol>] or <port>")
 	}
+	if protocol == "TCP+UDP" {
+		protocol = ProtocolBoth
+	}
 	mapping.Protocol = protocol
 
-	// Parse the port part (e.g., "8080:80", "8080", ":80", "80:")
+	// Parse the port part (e.g., "8080:80", "8080", ":80", "80:", "27015-27030")
 	portPart := parts[0]
 	ports := strings.Split(portPart, ":")
-	var extPort, intPort int
+	var extPort, extPortEnd, intPort, intPortEnd int
 
 	switch len(ports) {
 	case 1:
-		// Single port provided (e.g., "8080")
+		// Single port or range provided (e.g., "8080", "27015-27030")
 		portStr := ports[0]
 		if portStr == "" {
 			return mapping, logError("Invalid port format: port cannot be empty")
 		}
-		port, err := strconv.Atoi(portStr)
+		port, portEnd, err := ParsePortRange(portStr)
 		if err != nil || port <= 0 || port > 65535 {
 			return mapping, logError("Invalid port: must be a number between 1 and 65535")
 		}
-		extPort = port
-		intPort = port
+		extPort, extPortEnd = port, portEnd
+		intPort, intPortEnd = port, portEnd
 	case 2:
 		// External and/or internal ports provided (e.g., "8080:80", ":80", "80:")
 		extPortStr, intPortStr := ports[0], ports[1]
@@ -72,19 +235,24 @@ func ParsePortMapping(mappingStr string) (PortMapping, error) {
 			return mapping, logError("Invalid port format: both external and internal ports cannot be empty")
 		}
 
+		var err error
 		if extPortStr != "" {
-			extPort, _ = strconv.Atoi(extPortStr)
+			if extPort, extPortEnd, err = ParsePortRange(extPortStr); err != nil {
+				return mapping, logError(fmt.Sprintf("Invalid port %q: External port must be a number between 1 and 65535", extPortStr))
+			}
 		}
 
 		if intPortStr != "" {
-			intPort, _ = strconv.Atoi(intPortStr)
+			if intPort, intPortEnd, err = ParsePortRange(intPortStr); err != nil {
+				return mapping, logError(fmt.Sprintf("Invalid port %q: Internal port must be a number between 1 and 65535", intPortStr))
+			}
 		}
 
 		if extPortStr == "" {
-			extPort = intPort
+			extPort, extPortEnd = intPort, intPortEnd
 		}
 		if intPortStr == "" {
-			intPort = extPort
+			intPort, intPortEnd = extPort, extPortEnd
 		}
 	default:
 		return mapping, logError("Invalid port format: expected <external>:<internal> or <port>")
@@ -92,6 +260,8 @@ func ParsePortMapping(mappingStr string) (PortMapping, error) {
 
 	mapping.ExternalPort = extPort
 	mapping.InternalPort = intPort
+	mapping.ExternalPortEnd = extPortEnd
+	mapping.InternalPortEnd = intPortEnd
 
 	err := mapping.Validate()
 
@@ -102,6 +272,36 @@ func ParsePortMapping(mappingStr string) (PortMapping, error) {
 	return mapping, nil
 }
 
+// ParsePortMappings parses a mapping like ParsePortMapping and expands port ranges into individual mappings.
+func ParsePortMappings(mappingStr string) ([]PortMapping, error) {
+	mapping, err := ParsePortMapping(mappingStr)
+	if err != nil {
+		return nil, err
+	}
+
+	return mapping.Expand()
+}
+
+// ParsePortRange parses "<port>" or "<start>-<end>". The end is 0 for a single port.
+func ParsePortRange(s string) (int, int, error) {
+	startStr, endStr, isRange := strings.Cut(s, "-")
+	start, err := strconv.Atoi(startStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		return start, 0, nil
+	}
+	end, err := strconv.Atoi(endStr)
+	if err != nil {
+		return start, 0, err
+	}
+	if end == start {
+		end = 0
+	}
+	return start, end, nil
+}
+
 func logError(msg string) error {
 	log.Printf("Error parsing port mapping: %s", msg)
 	return errors.New(msg)
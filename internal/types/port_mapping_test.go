@@ -123,6 +123,91 @@ func TestParsePortMapping(t *testing.T) {
 			wantErr:     true,
 			errContains: "Internal port must be a number between 1 and 65535",
 		},
+		{
+			name:  "Valid port range",
+			input: "27015-27030/udp",
+			wantMapping: PortMapping{
+				ExternalPort:    27015,
+				ExternalPortEnd: 27030,
+				InternalPort:    27015,
+				InternalPortEnd: 27030,
+				Protocol:        "UDP",
+			},
+			wantErr: false,
+		},
+		{
+			name:  "Valid external range with internal start port",
+			input: "10000-10100:20000/udp",
+			wantMapping: PortMapping{
+				ExternalPort:    10000,
+				ExternalPortEnd: 10100,
+				InternalPort:    20000,
+				Protocol:        "UDP",
+			},
+			wantErr: false,
+		},
+		{
+			name:  "Both protocols",
+			input: "53/both",
+			wantMapping: PortMapping{
+				ExternalPort: 53,
+				InternalPort: 53,
+				Protocol:     "BOTH",
+			},
+			wantErr: false,
+		},
+		{
+			name:  "Both protocols alias",
+			input: "5353:53/tcp+udp",
+			wantMapping: PortMapping{
+				ExternalPort: 5353,
+				InternalPort: 53,
+				Protocol:     "BOTH",
+			},
+			wantErr: false,
+		},
+		{
+			name:        "Mismatched range sizes",
+			input:       "10000-10100:10000-10050/udp",
+			wantMapping: PortMapping{},
+			wantErr:     true,
+			errContains: "must be the same size",
+		},
+		{
+			name:        "Reversed range",
+			input:       "27030-27015",
+			wantMapping: PortMapping{},
+			wantErr:     true,
+			errContains: "External port range 27030-27015 is invalid",
+		},
+		{
+			name:        "Range too large",
+			input:       "10000-20000/udp",
+			wantMapping: PortMapping{},
+			wantErr:     true,
+			errContains: "too large",
+		},
+		{
+			name:        "Internal range out of bounds",
+			input:       "1000-1010:65530/tcp",
+			wantMapping: PortMapping{},
+			wantErr:     true,
+			errContains: "Internal port range 65530-65540 is invalid",
+		},
+		{
+			name:        "Malformed external range",
+			input:       "8000-80x0:80",
+			wantMapping: PortMapping{},
+			wantErr:     true,
+			errContains: `Invalid port "8000-80x0"`,
+		},
+		{
+			name:        "Malformed internal range",
+			input:       "8000-8010:80-8x",
+			wantMapping: PortMapping{},
+			wantErr:     true,
+			errContains: `Invalid port "80-8x"`,
+		},
 		{
 			name:        "Empty string",
 			input:       "",
@@ -153,3 +238,95 @@ func TestParsePortMapping(t *testing.T) {
 		})
 	}
 }
+
+func TestParsePortMappings(t *testing.T) {
+	tests := []struct {
+		name         string
+		input        string
+		wantMappings []PortMapping
+		wantErr      bool
+	}{
+		{
+			name:  "Single port",
+			input: "8080:80",
+			wantMappings: []PortMapping{
+				{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP"},
+			},
+		},
+		{
+			name:  "Range with matching internal range",
+			input: "10000-10002:20000-20002/udp",
+			wantMappings: []PortMapping{
+				{ExternalPort: 10000, InternalPort: 20000, Protocol: "UDP"},
+				{ExternalPort: 10001, InternalPort: 20001, Protocol: "UDP"},
+				{ExternalPort: 10002, InternalPort: 20002, Protocol: "UDP"},
+			},
+		},
+		{
+			name:  "Range with a single port",
+			input: "27015-27015/udp",
+			wantMappings: []PortMapping{
+				{ExternalPort: 27015, InternalPort: 27015, Protocol: "UDP"},
+			},
+		},
+		{
+			name:  "Range with both protocols",
+			input: "27015-27016/both",
+			wantMappings: []PortMapping{
+				{ExternalPort: 27015, InternalPort: 27015, Protocol: "TCP"},
+				{ExternalPort: 27015, InternalPort: 27015, Protocol: "UDP"},
+				{ExternalPort: 27016, InternalPort: 27016, Protocol: "TCP"},
+				{ExternalPort: 27016, InternalPort: 27016, Protocol: "UDP"},
+			},
+		},
+		{
+			name:    "Invalid range",
+			input:   "27015-abc",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotMappings, err := ParsePortMappings(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Nil(t, gotMappings)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantMappings, gotMappings)
+			}
+		})
+	}
+}
+
+func TestPortMapping_Expand(t *testing.T) {
+	mapping := PortMapping{ExternalPort: 5000, ExternalPortEnd: 5001, InternalPort: 6000, Protocol: "TCP", Name: "app", Source: "config.yaml"}
+
+	gotMappings, err := mapping.Expand()
+	assert.NoError(t, err)
+	assert.Equal(t, []PortMapping{
+		{ExternalPort: 5000, InternalPort: 6000, Protocol: "TCP", Name: "app", Source: "config.yaml"},
+		{ExternalPort: 5001, InternalPort: 6001, Protocol: "TCP", Name: "app", Source: "config.yaml"},
+	}, gotMappings)
+
+	mapping.ExternalPortEnd = 5000 + MaxPortRangeSize
+	_, err = mapping.Expand()
+	assert.ErrorContains(t, err, "too large")
+
+	enabled := false
+	mapping.ExternalPortEnd = 0
+	mapping.Enabled = &enabled
+	gotMappings, err = mapping.Expand()
+	assert.NoError(t, err)
+	assert.Empty(t, gotMappings)
+}
+
+func TestPortMapping_Validate_RemoteHost(t *testing.T) {
+	mapping := PortMapping{ExternalPort: 8443, InternalPort: 443, Protocol: "TCP", RemoteHost: "203.0.113.10"}
+	assert.NoError(t, mapping.Validate())
+	assert.Equal(t, "8443/TCP from 203.0.113.10", mapping.Key())
+
+	mapping.RemoteHost = "office.example.com"
+	assert.ErrorContains(t, mapping.Validate(), "Remote host must be an IP address")
+}
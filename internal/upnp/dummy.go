@@ -2,6 +2,7 @@ package upnp
 
 import (
 	"context"
+	"fmt"
 	"log"
 
 	"github.com/IonBazan/gangplank/internal/types"
@@ -46,6 +47,7 @@ func (c *DummyConnection) AddPortMapping(
 		InternalPort: int(NewInternalPort),
 		Protocol:     NewProtocol,
 		Name:         NewPortMappingDescription,
+		RemoteHost:   NewRemoteHost,
 	})
 	return nil
 }
@@ -82,6 +84,11 @@ func (c *DummyConnection) GetGenericPortMappingEntryCtx(
 }
 
 func NewSpecifiedArrayIndexInvalidError() error {
+	return NewUPnPError(714, "SpecifiedArrayIndexInvalid")
+}
+
+// NewUPnPError builds the SOAP fault a gateway returns for the given UPnP error.
+func NewUPnPError(code int, description string) error {
 	return &soap.SOAPFaultError{
 		FaultCode:   "s:Client",
 		FaultString: "UPnPError",
@@ -96,10 +103,10 @@ func NewSpecifiedArrayIndexInvalidError() error {
 				Errorcode        int    `xml:"errorCode"`
 				ErrorDescription string `xml:"errorDescription"`
 			}{
-				Errorcode:        714,
-				ErrorDescription: "SpecifiedArrayIndexInvalid",
+				Errorcode:        code,
+				ErrorDescription: description,
 			},
-			Raw: []byte(`<UPnPError><errorCode>714</errorCode><errorDescription>SpecifiedArrayIndexInvalid</errorDescription></UPnPError>`),
+			Raw: []byte(fmt.Sprintf("<UPnPError><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError>", code, description)),
 		},
 	}
 }
@@ -2,13 +2,20 @@ package upnp
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/huin/goupnp"
 	"github.com/huin/goupnp/soap"
 	"log"
 	"net"
 	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/IonBazan/gangplank/internal/metrics"
 	"github.com/IonBazan/gangplank/internal/types"
 	"github.com/huin/goupnp/dcps/internetgateway1"
 	"github.com/huin/goupnp/dcps/internetgateway2"
@@ -17,6 +24,19 @@ import (
 const DefaultLeaseDuration = 60 * time.Minute
 const defaultDescription = "Gangplank UPnP"
 
+// UPnP error codes returned by routers that cannot restrict mappings to a remote host or external port.
+const (
+	errRemoteHostOnlySupportsWildcard   = 726
+	errExternalPortOnlySupportsWildcard = 727
+)
+
+// UPnP error codes returned for port mapping lookups.
+const (
+	errInvalidAction                = 401
+	errOptionalActionNotImplemented = 602
+	errNoSuchEntryInArray           = 714
+)
+
 type UPnPConnection interface {
 	AddPortMapping(
 		NewRemoteHost string,
@@ -46,21 +66,73 @@ type UPnPConnection interface {
 	) (NewRemoteHost string, NewExternalPort uint16, NewProtocol string, NewInternalPort uint16, NewInternalClient string, NewEnabled bool, NewPortMappingDescription string, NewLeaseDuration uint32, err error)
 }
 
+// anyPortMapper is implemented by IGD2 connections, which can pick a free external port themselves.
+type anyPortMapper interface {
+	AddAnyPortMapping(
+		NewRemoteHost string,
+		NewExternalPort uint16,
+		NewProtocol string,
+		NewInternalPort uint16,
+		NewInternalClient string,
+		NewEnabled bool,
+		NewPortMappingDescription string,
+		NewLeaseDuration uint32,
+	) (NewReservedPort uint16, err error)
+}
+
+// specificEntryGetter is implemented by connections that can look up the gateway entry of a single port.
+type specificEntryGetter interface {
+	GetSpecificPortMappingEntry(
+		NewRemoteHost string,
+		NewExternalPort uint16,
+		NewProtocol string,
+	) (NewInternalPort uint16, NewInternalClient string, NewEnabled bool, NewPortMappingDescription string, NewLeaseDuration uint32, err error)
+}
+
+// Errors returned by VerifyMapping.
+var (
+	// ErrNotVerifiable is returned when the gateway connection cannot look up single entries.
+	ErrNotVerifiable = errors.New("gateway cannot look up single port mappings")
+	// ErrMappingMissing is returned when the gateway has no entry for the mapping.
+	ErrMappingMissing = errors.New("missing on the gateway")
+	// ErrMappingModified is returned when the gateway entry does not forward to this host or is disabled.
+	ErrMappingModified = errors.New("changed on the gateway")
+)
+
 type PortMappingEntry struct {
-	ExternalPort  int
-	InternalPort  int
-	Protocol      string
-	InternalIP    string
-	Description   string
-	LeaseDuration uint32
-	Enabled       bool
+	ExternalPort  int    `json:"externalPort"`
+	InternalPort  int    `json:"internalPort"`
+	Protocol      string `json:"protocol"`
+	InternalIP    string `json:"internalIP"`
+	Description   string `json:"description"`
+	LeaseDuration uint32 `json:"leaseDuration"`
+	Enabled       bool   `json:"enabled"`
+}
+
+// Forwards reports whether the router entry forwards the external port and protocol of a mapping.
+func (e PortMappingEntry) Forwards(m types.PortMapping) bool {
+	return e.ExternalPort == m.ExternalPort && strings.EqualFold(e.Protocol, m.Protocol)
+}
+
+// MappingRecorder is told about the mappings a client creates and deletes, e.g. to keep track of them across restarts.
+type MappingRecorder interface {
+	RecordMapping(gateway string, m types.PortMapping, assignedPort int, internalClient string) error
+	ForgetMapping(gateway string, m types.PortMapping) error
 }
 
 // Client wraps the UPnP client and local IP for port forwarding.
 type Client struct {
 	uPnPConnection UPnPConnection
 	LocalIP        string
-	duration       time.Duration
+	duration       atomic.Int64
+	gateway        string
+	recorder       MappingRecorder
+
+	mu sync.Mutex
+	// reservedPorts holds the external ports the router picked for mappings with an automatic external port.
+	reservedPorts map[string]uint16
+	// created holds the mappings forwarded by this client that were not deleted since.
+	created map[string]types.PortMapping
 }
 
 func NewClient(localIPOverride, gatewayOverride string, duration time.Duration) (*Client, error) {
@@ -90,20 +162,88 @@ func NewClient(localIPOverride, gatewayOverride string, duration time.Duration)
 }
 
 func NewClientWithConnection(connection UPnPConnection, localIP string, duration time.Duration) *Client {
-	return &Client{
+	c := &Client{
 		uPnPConnection: connection,
 		LocalIP:        localIP,
-		duration:       duration,
+		gateway:        gatewayLocation(connection),
+	}
+	c.SetLeaseDuration(duration)
+
+	return c
+}
+
+// gatewayLocation identifies the gateway of a connection by its device description URL.
+func gatewayLocation(connection UPnPConnection) string {
+	if sc, ok := connection.(interface{ GetServiceClient() *goupnp.ServiceClient }); ok {
+		if client := sc.GetServiceClient(); client != nil && client.Location != nil {
+			return client.Location.String()
+		}
+	}
+	return ""
+}
+
+// Gateway returns the device description URL of the gateway, or an empty string if it is unknown.
+func (u *Client) Gateway() string {
+	return u.gateway
+}
+
+// SetRecorder makes the client report the mappings it creates and deletes to a recorder.
+func (u *Client) SetRecorder(recorder MappingRecorder) {
+	u.recorder = recorder
+}
+
+// Adopt takes over mappings created on the gateway by a previous run, so that they are deleted on cleanup and
+// mappings with an automatic external port keep the port the gateway assigned to them.
+func (u *Client) Adopt(m types.PortMapping, assignedPort int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.created == nil {
+		u.created = map[string]types.PortMapping{}
+	}
+	if _, ok := u.created[m.Key()]; !ok {
+		u.created[m.Key()] = m
+	}
+	if m.AutoExternalPort && assignedPort > 0 {
+		if u.reservedPorts == nil {
+			u.reservedPorts = map[string]uint16{}
+		}
+		if _, ok := u.reservedPorts[m.Key()]; !ok {
+			u.reservedPorts[m.Key()] = uint16(assignedPort)
+		}
 	}
 }
 
+// SetLeaseDuration changes the lease duration used for mappings added from now on.
+func (u *Client) SetLeaseDuration(duration time.Duration) {
+	u.duration.Store(int64(duration))
+}
+
+// LeaseDuration returns the lease duration requested for new mappings.
+func (u *Client) LeaseDuration() time.Duration {
+	return time.Duration(u.duration.Load())
+}
+
 func NewDummyClient(duration time.Duration) *Client {
 	return NewClientWithConnection(&DummyConnection{}, "192.168.1.100", duration)
 }
 
 func (u *Client) ForwardPorts(mappings []types.PortMapping) error {
+	return u.forwardPorts(mappings, true)
+}
+
+// RenewPorts forwards mappings again to extend their lease. Unlike ForwardPorts, it does not count them as added, as
+// renewals are counted as refreshes by the caller.
+func (u *Client) RenewPorts(mappings []types.PortMapping) error {
+	return u.forwardPorts(mappings, false)
+}
+
+func (u *Client) forwardPorts(mappings []types.PortMapping, countAdded bool) error {
 	for _, m := range mappings {
 		err := u.addPortMapping(m)
+		if countAdded {
+			metrics.ObserveOperation(metrics.OperationAdd, err)
+		}
 		if err != nil {
 			log.Printf("Failed to forward port %d/%s for %s: %v", m.ExternalPort, m.Protocol, m.Name, err)
 
@@ -111,29 +251,283 @@ func (u *Client) ForwardPorts(mappings []types.PortMapping) error {
 		} else {
 			log.Printf("Successfully forwarded port %d/%s for %s", m.ExternalPort, m.Protocol, m.Name)
 		}
+		u.mu.Lock()
+		if u.created == nil {
+			u.created = map[string]types.PortMapping{}
+		}
+		u.created[m.Key()] = m
+		u.mu.Unlock()
+		if u.recorder != nil {
+			assigned, _ := u.ReservedPort(m)
+			if err := u.recorder.RecordMapping(u.gateway, m, assigned, u.LocalIP); err != nil {
+				log.Printf("Failed to record port mapping %d/%s for %s: %v", m.ExternalPort, m.Protocol, m.Name, err)
+			}
+		}
 	}
 	return nil
 }
 
-func (u *Client) addPortMapping(m types.PortMapping) error {
-	description := defaultDescription
+// ExternalIP asks the gateway for its external IP address, which also tells whether the gateway can be reached.
+func (u *Client) ExternalIP() (string, error) {
+	start := time.Now()
+	ip, err := u.uPnPConnection.GetExternalIPAddress()
+	observe("GetExternalIPAddress", start, err)
+	if err == nil {
+		metrics.SetExternalIP(ip)
+	}
+	return ip, err
+}
+
+// Created returns the mappings forwarded by this client that were not deleted since, ordered by their key.
+func (u *Client) Created() []types.PortMapping {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	created := make([]types.PortMapping, 0, len(u.created))
+	for _, m := range u.created {
+		created = append(created, m)
+	}
+	sort.Slice(created, func(i, j int) bool { return created[i].Key() < created[j].Key() })
+	return created
+}
+
+// Description returns the description shown by the router for a mapping: its own description, or one derived from its
+// name.
+func Description(m types.PortMapping) string {
+	if m.Description != "" {
+		return m.Description
+	}
 	if m.Name != "" {
-		description = fmt.Sprintf("%s: %s", defaultDescription, m.Name)
+		return fmt.Sprintf("%s: %s", defaultDescription, m.Name)
+	}
+	return defaultDescription
+}
+
+func (u *Client) addPortMapping(m types.PortMapping) error {
+	description := Description(m)
+	leaseDuration := u.LeaseDuration()
+	if m.TTL > 0 {
+		leaseDuration = m.TTL
 	}
-	return u.uPnPConnection.AddPortMapping(
-		"",
+	if m.AutoExternalPort {
+		if mapper, ok := u.uPnPConnection.(anyPortMapper); ok {
+			return u.addAnyPortMapping(mapper, m, description, leaseDuration)
+		}
+		log.Printf("Gateway cannot pick external ports, using external port %d for %s", m.ExternalPort, m.Name)
+	}
+	start := time.Now()
+	err := u.uPnPConnection.AddPortMapping(
+		m.RemoteHost,
 		uint16(m.ExternalPort),
 		m.Protocol,
 		uint16(m.InternalPort),
 		u.LocalIP,
 		true,
 		description,
-		uint32(u.duration.Seconds()),
+		uint32(leaseDuration.Seconds()),
 	)
+	observe("AddPortMapping", start, err)
+	return wrapWildcardError(err, m)
+}
+
+// forget drops a deleted mapping from the created ones and from the recorder.
+func (u *Client) forget(m types.PortMapping) {
+	u.mu.Lock()
+	delete(u.created, m.Key())
+	u.mu.Unlock()
+	if u.recorder != nil {
+		if err := u.recorder.ForgetMapping(u.gateway, m); err != nil {
+			log.Printf("Failed to forget port mapping %d/%s for %s: %v", m.ExternalPort, m.Protocol, m.Name, err)
+		}
+	}
+}
+
+// addAnyPortMapping lets the router pick the external port. The previously reserved port is requested again on
+// refresh, so the mapping keeps its port as long as it is free.
+func (u *Client) addAnyPortMapping(mapper anyPortMapper, m types.PortMapping, description string, leaseDuration time.Duration) error {
+	key := m.Key()
+	u.mu.Lock()
+	requested, ok := u.reservedPorts[key]
+	u.mu.Unlock()
+	if !ok {
+		requested = uint16(m.ExternalPort)
+	}
+
+	start := time.Now()
+	reserved, err := mapper.AddAnyPortMapping(
+		m.RemoteHost,
+		requested,
+		m.Protocol,
+		uint16(m.InternalPort),
+		u.LocalIP,
+		true,
+		description,
+		uint32(leaseDuration.Seconds()),
+	)
+	observe("AddAnyPortMapping", start, err)
+	if err != nil {
+		return wrapWildcardError(err, m)
+	}
+
+	u.mu.Lock()
+	if u.reservedPorts == nil {
+		u.reservedPorts = map[string]uint16{}
+	}
+	u.reservedPorts[key] = reserved
+	u.mu.Unlock()
+	if reserved != requested {
+		log.Printf("Gateway assigned external port %d/%s for %s", reserved, m.Protocol, m.Name)
+	}
+	return nil
+}
+
+// ReservedPort returns the external port the gateway picked for a mapping with an automatic external port.
+func (u *Client) ReservedPort(m types.PortMapping) (int, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	port, ok := u.reservedPorts[m.Key()]
+	return int(port), ok
+}
+
+// DeleteMapping deletes the router entry of a mapping, including its remote host restriction.
+func (u *Client) DeleteMapping(m types.PortMapping) error {
+	externalPort := m.ExternalPort
+	if m.AutoExternalPort {
+		if reserved, ok := u.ReservedPort(m); ok {
+			externalPort = reserved
+		}
+	}
+	start := time.Now()
+	err := u.uPnPConnection.DeletePortMapping(m.RemoteHost, uint16(externalPort), m.Protocol)
+	observe("DeletePortMapping", start, err)
+	metrics.ObserveOperation(metrics.OperationDelete, err)
+	if err == nil {
+		if m.AutoExternalPort {
+			u.mu.Lock()
+			delete(u.reservedPorts, m.Key())
+			u.mu.Unlock()
+		}
+		u.forget(m)
+	}
+	return wrapWildcardError(err, m)
+}
+
+// VerifyMapping looks up the gateway entry of a mapping and checks that it forwards to this host. It returns the lease
+// duration the gateway reports for the entry, which is zero for permanent entries.
+func (u *Client) VerifyMapping(m types.PortMapping) (time.Duration, error) {
+	getter, ok := u.uPnPConnection.(specificEntryGetter)
+	if !ok {
+		return 0, ErrNotVerifiable
+	}
+	externalPort := u.externalPort(m)
+
+	start := time.Now()
+	internalPort, internalClient, enabled, _, leaseDuration, err := getter.GetSpecificPortMappingEntry(m.RemoteHost, uint16(externalPort), m.Protocol)
+	observe("GetSpecificPortMappingEntry", start, err)
+	var fault *soap.SOAPFaultError
+	if errors.As(err, &fault) {
+		switch fault.Detail.UPnPError.Errorcode {
+		case errNoSuchEntryInArray:
+			return 0, fmt.Errorf("port mapping %d/%s is %w: %v", externalPort, m.Protocol, ErrMappingMissing, err)
+		case errInvalidAction, errOptionalActionNotImplemented:
+			return 0, fmt.Errorf("%w: %v", ErrNotVerifiable, err)
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up port mapping %d/%s: %w", externalPort, m.Protocol, err)
+	}
+	if err := u.checkEntry(m, externalPort, int(internalPort), internalClient, enabled); err != nil {
+		return 0, err
+	}
+	return time.Duration(leaseDuration) * time.Second, nil
+}
+
+// VerifyMappings checks the gateway entries of several mappings, looking each of them up if the gateway supports it
+// and listing all of its entries otherwise. It returns the result for each mapping, wrapping ErrMappingMissing or
+// ErrMappingModified for the entries that drifted, or an error if the gateway could not be queried.
+func (u *Client) VerifyMappings(mappings []types.PortMapping) ([]error, error) {
+	results := make([]error, len(mappings))
+	for i, m := range mappings {
+		_, err := u.VerifyMapping(m)
+		if errors.Is(err, ErrNotVerifiable) {
+			return u.verifyListedMappings(mappings)
+		}
+		if err != nil && !errors.Is(err, ErrMappingMissing) && !errors.Is(err, ErrMappingModified) {
+			return nil, err
+		}
+		results[i] = err
+	}
+	return results, nil
+}
+
+// verifyListedMappings checks the gateway entries of several mappings by listing all of the gateway entries.
+func (u *Client) verifyListedMappings(mappings []types.PortMapping) ([]error, error) {
+	entries, err := u.ListPortMappings()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]error, len(mappings))
+	for i, m := range mappings {
+		externalPort := u.externalPort(m)
+		results[i] = fmt.Errorf("port mapping %d/%s is %w", externalPort, m.Protocol, ErrMappingMissing)
+		for _, e := range entries {
+			if e.ExternalPort == externalPort && strings.EqualFold(e.Protocol, m.Protocol) {
+				results[i] = u.checkEntry(m, externalPort, e.InternalPort, e.InternalIP, e.Enabled)
+				break
+			}
+		}
+	}
+	return results, nil
+}
+
+// externalPort returns the external port of a mapping on the gateway, i.e. the port the gateway assigned to a mapping
+// with an automatic external port.
+func (u *Client) externalPort(m types.PortMapping) int {
+	if m.AutoExternalPort {
+		if reserved, ok := u.ReservedPort(m); ok {
+			return reserved
+		}
+	}
+	return m.ExternalPort
 }
 
-func (u *Client) DeletePortMapping(externalPort int, protocol string) error {
-	return u.uPnPConnection.DeletePortMapping("", uint16(externalPort), protocol)
+// checkEntry checks that a gateway entry forwards a mapping to this host.
+func (u *Client) checkEntry(m types.PortMapping, externalPort, internalPort int, internalClient string, enabled bool) error {
+	if internalClient != u.LocalIP || internalPort != m.InternalPort {
+		return fmt.Errorf("port mapping %d/%s was %w: it forwards to %s:%d instead of %s:%d", externalPort, m.Protocol, ErrMappingModified, internalClient, internalPort, u.LocalIP, m.InternalPort)
+	}
+	if !enabled {
+		return fmt.Errorf("port mapping %d/%s was %w: it is disabled", externalPort, m.Protocol, ErrMappingModified)
+	}
+	return nil
+}
+
+// observe records how long the gateway took to answer a UPnP action and whether it answered at all. A SOAP fault is an
+// answer, e.g. for a lookup of a missing entry.
+func observe(action string, start time.Time, err error) {
+	metrics.SOAPDuration.WithLabelValues(action).Observe(time.Since(start).Seconds())
+	var fault *soap.SOAPFaultError
+	if err == nil || errors.As(err, &fault) {
+		metrics.GatewayUp.Set(1)
+	} else {
+		metrics.GatewayUp.Set(0)
+	}
+}
+
+// wrapWildcardError explains the errors routers return when they only support wildcard remote hosts or external ports.
+func wrapWildcardError(err error, m types.PortMapping) error {
+	var fault *soap.SOAPFaultError
+	if !errors.As(err, &fault) {
+		return err
+	}
+
+	switch fault.Detail.UPnPError.Errorcode {
+	case errRemoteHostOnlySupportsWildcard:
+		return fmt.Errorf("router does not support restricting port %d/%s to remote host %s, remove remoteHost from the mapping: %w", m.ExternalPort, m.Protocol, m.RemoteHost, err)
+	case errExternalPortOnlySupportsWildcard:
+		return fmt.Errorf("router does not support forwarding a specific external port %d/%s: %w", m.ExternalPort, m.Protocol, err)
+	}
+	return err
 }
 
 // ListPortMappings retrieves all active UPnP port mappings.
@@ -145,7 +539,9 @@ func (c *Client) ListPortMappings() ([]PortMappingEntry, error) {
 	defer cancel()
 
 	for {
+		start := time.Now()
 		_, externalPort, protocol, internalPort, internalClient, enabled, description, leaseDuration, err := c.uPnPConnection.GetGenericPortMappingEntryCtx(ctx, index)
+		observe("GetGenericPortMappingEntry", start, err)
 		if err != nil {
 			if serr, ok := err.(*soap.SOAPFaultError); ok && serr.Detail.UPnPError.ErrorDescription == "SpecifiedArrayIndexInvalid" {
 				break
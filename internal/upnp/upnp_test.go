@@ -2,9 +2,13 @@ package upnp
 
 import (
 	"errors"
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/IonBazan/gangplank/internal/metrics"
 	"github.com/IonBazan/gangplank/internal/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -89,7 +93,7 @@ func TestClient_ForwardPorts(t *testing.T) {
 	}
 }
 
-func TestClient_DeletePortMapping(t *testing.T) {
+func TestClient_DeleteMapping(t *testing.T) {
 	tests := []struct {
 		name      string
 		extPort   int
@@ -138,7 +142,7 @@ func TestClient_DeletePortMapping(t *testing.T) {
 				LocalIP:        "192.168.1.100",
 			}
 
-			err := client.DeletePortMapping(tt.extPort, tt.protocol)
+			err := client.DeleteMapping(types.PortMapping{ExternalPort: tt.extPort, Protocol: tt.protocol})
 			if tt.wantErr {
 				assert.Error(t, err)
 				assert.Equal(t, tt.deleteErr, err)
@@ -150,6 +154,312 @@ func TestClient_DeletePortMapping(t *testing.T) {
 	}
 }
 
+// recordingConnection records the details DummyConnection does not keep.
+type recordingConnection struct {
+	DummyConnection
+	deletedRemoteHosts []string
+	leaseDurations     []uint32
+}
+
+func (c *recordingConnection) AddPortMapping(NewRemoteHost string, NewExternalPort uint16, NewProtocol string, NewInternalPort uint16, NewInternalClient string, NewEnabled bool, NewPortMappingDescription string, NewLeaseDuration uint32) error {
+	c.leaseDurations = append(c.leaseDurations, NewLeaseDuration)
+	return c.DummyConnection.AddPortMapping(NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort, NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+}
+
+func (c *recordingConnection) DeletePortMapping(NewRemoteHost string, NewExternalPort uint16, NewProtocol string) error {
+	c.deletedRemoteHosts = append(c.deletedRemoteHosts, NewRemoteHost)
+	return c.DummyConnection.DeletePortMapping(NewRemoteHost, NewExternalPort, NewProtocol)
+}
+
+func TestClient_RemoteHost(t *testing.T) {
+	mock := &recordingConnection{}
+	client := NewClientWithConnection(mock, "192.168.1.100", DefaultLeaseDuration)
+	mapping := types.PortMapping{ExternalPort: 8443, InternalPort: 443, Protocol: "TCP", Name: "admin", RemoteHost: "203.0.113.10"}
+
+	assert.NoError(t, client.ForwardPorts([]types.PortMapping{mapping}))
+	assert.Equal(t, []types.PortMapping{
+		{ExternalPort: 8443, InternalPort: 443, Protocol: "TCP", Name: "Gangplank UPnP: admin", RemoteHost: "203.0.113.10"},
+	}, mock.Forwarded)
+
+	assert.NoError(t, client.DeleteMapping(mapping))
+	assert.Equal(t, []string{"203.0.113.10"}, mock.deletedRemoteHosts)
+}
+
+func TestClient_MappingOverrides(t *testing.T) {
+	mock := &recordingConnection{}
+	client := NewClientWithConnection(mock, "192.168.1.100", DefaultLeaseDuration)
+
+	assert.NoError(t, client.ForwardPorts([]types.PortMapping{
+		{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web"},
+		{ExternalPort: 25565, InternalPort: 25565, Protocol: "TCP", Name: "minecraft", TTL: 2 * time.Hour, Description: "Minecraft for friends"},
+	}))
+	assert.Equal(t, []uint32{3600, 7200}, mock.leaseDurations)
+	assert.Equal(t, []types.PortMapping{
+		{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "Gangplank UPnP: web"},
+		{ExternalPort: 25565, InternalPort: 25565, Protocol: "TCP", Name: "Minecraft for friends"},
+	}, mock.Forwarded)
+}
+
+func TestClient_Created(t *testing.T) {
+	client := NewClientWithConnection(&DummyConnection{}, "192.168.1.100", DefaultLeaseDuration)
+	web := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web"}
+	admin := types.PortMapping{ExternalPort: 8443, InternalPort: 443, Protocol: "TCP", Name: "admin", RemoteHost: "203.0.113.10"}
+	dns := types.PortMapping{ExternalPort: 53, InternalPort: 53, Protocol: "UDP", Name: "dns"}
+
+	assert.Empty(t, client.Created())
+	assert.NoError(t, client.ForwardPorts([]types.PortMapping{web, admin, dns, web}))
+	assert.Equal(t, []types.PortMapping{dns, web, admin}, client.Created())
+
+	assert.NoError(t, client.DeleteMapping(admin))
+	assert.NoError(t, client.DeleteMapping(dns))
+	assert.Equal(t, []types.PortMapping{web}, client.Created())
+}
+
+// memoryRecorder keeps the recorded mappings by key.
+type memoryRecorder struct {
+	mappings map[string]types.PortMapping
+	assigned map[string]int
+}
+
+func (r *memoryRecorder) RecordMapping(gateway string, m types.PortMapping, assignedPort int, internalClient string) error {
+	r.mappings[gateway+" "+m.Key()] = m
+	r.assigned[gateway+" "+m.Key()] = assignedPort
+	return nil
+}
+
+func (r *memoryRecorder) ForgetMapping(gateway string, m types.PortMapping) error {
+	delete(r.mappings, gateway+" "+m.Key())
+	return nil
+}
+
+func TestClient_Recorder(t *testing.T) {
+	web := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web"}
+	game := types.PortMapping{ExternalPort: 25565, InternalPort: 25565, Protocol: "UDP", Name: "game", AutoExternalPort: true}
+
+	mock := &igd2Connection{taken: map[uint16]bool{25565: true}}
+	client := NewClientWithConnection(mock, "192.168.1.100", DefaultLeaseDuration)
+	recorder := &memoryRecorder{mappings: map[string]types.PortMapping{}, assigned: map[string]int{}}
+	client.SetRecorder(recorder)
+
+	assert.NoError(t, client.ForwardPorts([]types.PortMapping{web, game}))
+	assert.Equal(t, map[string]types.PortMapping{" 8080/TCP": web, " 25565/UDP": game}, recorder.mappings)
+	assert.Equal(t, 25566, recorder.assigned[" 25565/UDP"])
+
+	assert.NoError(t, client.DeleteMapping(web))
+	assert.Equal(t, map[string]types.PortMapping{" 25565/UDP": game}, recorder.mappings)
+
+	// A restarted client takes over the recorded mappings and the ports assigned to them.
+	restarted := NewClientWithConnection(mock, "192.168.1.100", DefaultLeaseDuration)
+	restarted.Adopt(game, 25566)
+	assert.Equal(t, []types.PortMapping{game}, restarted.Created())
+	reserved, ok := restarted.ReservedPort(game)
+	assert.True(t, ok)
+	assert.Equal(t, 25566, reserved)
+}
+
+// lookupConnection answers single port lookups from fixed gateway entries, keyed by external port and protocol.
+type lookupConnection struct {
+	DummyConnection
+	entries map[string]PortMappingEntry
+}
+
+func (c *lookupConnection) GetSpecificPortMappingEntry(NewRemoteHost string, NewExternalPort uint16, NewProtocol string) (uint16, string, bool, string, uint32, error) {
+	entry, ok := c.entries[fmt.Sprintf("%d/%s", NewExternalPort, NewProtocol)]
+	if !ok {
+		return 0, "", false, "", 0, NewUPnPError(714, "NoSuchEntryInArray")
+	}
+	return uint16(entry.InternalPort), entry.InternalIP, entry.Enabled, entry.Description, entry.LeaseDuration, nil
+}
+
+// unreachableConnection fails every lookup without an answer from the gateway.
+type unreachableConnection struct {
+	DummyConnection
+}
+
+func (c *unreachableConnection) GetSpecificPortMappingEntry(NewRemoteHost string, NewExternalPort uint16, NewProtocol string) (uint16, string, bool, string, uint32, error) {
+	return 0, "", false, "", 0, errors.New("connection refused")
+}
+
+// faultConnection answers every lookup with the same UPnP error.
+type faultConnection struct {
+	DummyConnection
+	code int
+}
+
+func (c *faultConnection) GetSpecificPortMappingEntry(NewRemoteHost string, NewExternalPort uint16, NewProtocol string) (uint16, string, bool, string, uint32, error) {
+	return 0, "", false, "", 0, NewUPnPError(c.code, "UPnPError")
+}
+
+func TestClient_VerifyMapping(t *testing.T) {
+	mock := &lookupConnection{entries: map[string]PortMappingEntry{
+		"8080/TCP":  {InternalPort: 80, InternalIP: "192.168.1.100", Enabled: true, LeaseDuration: 1800},
+		"8081/TCP":  {InternalPort: 80, InternalIP: "192.168.1.200", Enabled: true, LeaseDuration: 3600},
+		"8082/TCP":  {InternalPort: 80, InternalIP: "192.168.1.100", Enabled: false, LeaseDuration: 3600},
+		"25566/UDP": {InternalPort: 25565, InternalIP: "192.168.1.100", Enabled: true},
+	}}
+	client := NewClientWithConnection(mock, "192.168.1.100", DefaultLeaseDuration)
+
+	lease, err := client.VerifyMapping(types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP"})
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Minute, lease)
+
+	_, err = client.VerifyMapping(types.PortMapping{ExternalPort: 8081, InternalPort: 80, Protocol: "TCP"})
+	assert.ErrorIs(t, err, ErrMappingModified)
+	assert.ErrorContains(t, err, "forwards to 192.168.1.200:80 instead of 192.168.1.100:80")
+
+	_, err = client.VerifyMapping(types.PortMapping{ExternalPort: 8082, InternalPort: 80, Protocol: "TCP"})
+	assert.ErrorIs(t, err, ErrMappingModified)
+	assert.ErrorContains(t, err, "it is disabled")
+
+	_, err = client.VerifyMapping(types.PortMapping{ExternalPort: 9000, InternalPort: 80, Protocol: "TCP"})
+	assert.ErrorIs(t, err, ErrMappingMissing)
+	assert.ErrorContains(t, err, "port mapping 9000/TCP is missing on the gateway")
+
+	unreachable := NewClientWithConnection(&unreachableConnection{}, "192.168.1.100", DefaultLeaseDuration)
+	_, err = unreachable.VerifyMapping(types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP"})
+	assert.NotErrorIs(t, err, ErrMappingMissing, "lookups that fail are not reported as missing mappings")
+	assert.ErrorContains(t, err, "failed to look up port mapping 8080/TCP")
+
+	game := types.PortMapping{ExternalPort: 25565, InternalPort: 25565, Protocol: "UDP", AutoExternalPort: true}
+	client.Adopt(game, 25566)
+	lease, err = client.VerifyMapping(game)
+	assert.NoError(t, err, "the port assigned by the gateway is looked up")
+	assert.Zero(t, lease)
+
+	_, err = NewDummyClient(DefaultLeaseDuration).VerifyMapping(game)
+	assert.ErrorIs(t, err, ErrNotVerifiable)
+
+	for _, code := range []int{401, 602} {
+		_, err = NewClientWithConnection(&faultConnection{code: code}, "192.168.1.100", DefaultLeaseDuration).VerifyMapping(game)
+		assert.ErrorIs(t, err, ErrNotVerifiable, "error %d means lookups are not supported", code)
+	}
+	for _, code := range []int{501, 606} {
+		_, err = NewClientWithConnection(&faultConnection{code: code}, "192.168.1.100", DefaultLeaseDuration).VerifyMapping(game)
+		assert.ErrorContains(t, err, "failed to look up port mapping 25565/UDP")
+		assert.NotErrorIs(t, err, ErrMappingMissing, "error %d does not mean the mapping is gone", code)
+	}
+}
+
+func TestClient_VerifyMappings(t *testing.T) {
+	mappings := []types.PortMapping{
+		{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP"},
+		{ExternalPort: 8081, InternalPort: 80, Protocol: "TCP"},
+		{ExternalPort: 9000, InternalPort: 80, Protocol: "TCP"},
+	}
+
+	lookup := NewClientWithConnection(&lookupConnection{entries: map[string]PortMappingEntry{
+		"8080/TCP": {InternalPort: 80, InternalIP: "192.168.1.100", Enabled: true},
+		"8081/TCP": {InternalPort: 80, InternalIP: "192.168.1.100", Enabled: false},
+	}}, "192.168.1.100", DefaultLeaseDuration)
+	results, err := lookup.VerifyMappings(mappings)
+	assert.NoError(t, err)
+	assert.Len(t, results, 3)
+	assert.NoError(t, results[0])
+	assert.ErrorIs(t, results[1], ErrMappingModified)
+	assert.ErrorIs(t, results[2], ErrMappingMissing)
+
+	// The dummy connection cannot look up single entries, so its listing is used. It only lists 8080/TCP.
+	listing := NewClientWithConnection(&DummyConnection{}, "192.168.1.200", DefaultLeaseDuration)
+	results, err = listing.VerifyMappings(mappings)
+	assert.NoError(t, err)
+	assert.ErrorContains(t, results[0], "forwards to 192.168.1.100:80 instead of 192.168.1.200:80")
+	assert.ErrorIs(t, results[1], ErrMappingMissing)
+	assert.ErrorIs(t, results[2], ErrMappingMissing)
+
+	unreachable := NewClientWithConnection(&unreachableConnection{}, "192.168.1.100", DefaultLeaseDuration)
+	_, err = unreachable.VerifyMappings(mappings)
+	assert.ErrorContains(t, err, "connection refused")
+
+	// Gateways rejecting single lookups are checked from their listing.
+	unsupported := NewClientWithConnection(&faultConnection{code: 602}, "192.168.1.100", DefaultLeaseDuration)
+	results, err = unsupported.VerifyMappings(mappings)
+	assert.NoError(t, err)
+	assert.NoError(t, results[0])
+	assert.ErrorIs(t, results[1], ErrMappingMissing)
+
+	_, err = NewClientWithConnection(&faultConnection{code: 606}, "192.168.1.100", DefaultLeaseDuration).VerifyMappings(mappings)
+	assert.ErrorContains(t, err, "failed to look up port mapping 8080/TCP")
+}
+
+// igd2Connection picks external ports like an IGD2 gateway, moving to the next port when the requested one is taken.
+type igd2Connection struct {
+	recordingConnection
+	taken map[uint16]bool
+}
+
+func (c *igd2Connection) AddAnyPortMapping(NewRemoteHost string, NewExternalPort uint16, NewProtocol string, NewInternalPort uint16, NewInternalClient string, NewEnabled bool, NewPortMappingDescription string, NewLeaseDuration uint32) (uint16, error) {
+	port := NewExternalPort
+	for c.taken[port] {
+		port++
+	}
+	return port, c.AddPortMapping(NewRemoteHost, port, NewProtocol, NewInternalPort, NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+}
+
+func TestClient_AutoExternalPort(t *testing.T) {
+	mapping := types.PortMapping{ExternalPort: 25565, InternalPort: 25565, Protocol: "UDP", Name: "game", AutoExternalPort: true}
+
+	mock := &igd2Connection{taken: map[uint16]bool{25565: true}}
+	client := NewClientWithConnection(mock, "192.168.1.100", DefaultLeaseDuration)
+	assert.NoError(t, client.ForwardPorts([]types.PortMapping{mapping}))
+	reserved, ok := client.ReservedPort(mapping)
+	assert.True(t, ok)
+	assert.Equal(t, 25566, reserved)
+
+	// The reserved port is requested again on refresh.
+	mock.taken = nil
+	assert.NoError(t, client.ForwardPorts([]types.PortMapping{mapping}))
+	assert.Equal(t, []int{25566, 25566}, []int{mock.Forwarded[0].ExternalPort, mock.Forwarded[1].ExternalPort})
+
+	assert.NoError(t, client.DeleteMapping(mapping))
+	assert.Equal(t, uint16(25566), mock.Deleted[0].ExtPort)
+	_, ok = client.ReservedPort(mapping)
+	assert.False(t, ok)
+
+	// IGD1 gateways get the requested port.
+	igd1 := &DummyConnection{}
+	client = NewClientWithConnection(igd1, "192.168.1.100", DefaultLeaseDuration)
+	assert.NoError(t, client.ForwardPorts([]types.PortMapping{mapping}))
+	assert.Equal(t, 25565, igd1.Forwarded[0].ExternalPort)
+}
+
+func TestClient_WildcardErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		upnpErr     error
+		errContains string
+	}{
+		{
+			name:        "Remote host only supports wildcard",
+			upnpErr:     NewUPnPError(726, "RemoteHostOnlySupportsWildcard"),
+			errContains: "router does not support restricting port 8443/TCP to remote host 203.0.113.10",
+		},
+		{
+			name:        "External port only supports wildcard",
+			upnpErr:     NewUPnPError(727, "ExternalPortOnlySupportsWildcard"),
+			errContains: "router does not support forwarding a specific external port 8443/TCP",
+		},
+		{
+			name:        "Other errors are returned as is",
+			upnpErr:     NewUPnPError(718, "ConflictInMappingEntry"),
+			errContains: "UPnPError",
+		},
+	}
+
+	mapping := types.PortMapping{ExternalPort: 8443, InternalPort: 443, Protocol: "TCP", RemoteHost: "203.0.113.10"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewClientWithConnection(&DummyConnection{ForwardErr: tt.upnpErr, DeleteErr: tt.upnpErr}, "192.168.1.100", DefaultLeaseDuration)
+
+			err := client.ForwardPorts([]types.PortMapping{mapping})
+			assert.ErrorContains(t, err, tt.errContains)
+			assert.ErrorIs(t, err, tt.upnpErr)
+
+			err = client.DeleteMapping(mapping)
+			assert.ErrorContains(t, err, tt.errContains)
+		})
+	}
+}
+
 func TestClient_ListPortMappings(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -193,3 +503,52 @@ func TestClient_ListPortMappings(t *testing.T) {
 		})
 	}
 }
+
+func TestDescription(t *testing.T) {
+	assert.Equal(t, "Gangplank UPnP", Description(types.PortMapping{}))
+	assert.Equal(t, "Gangplank UPnP: shop/web", Description(types.PortMapping{Name: "shop/web"}))
+	assert.Equal(t, "Web shop", Description(types.PortMapping{Name: "shop/web", Description: "Web shop"}))
+}
+
+func TestPortMappingEntry_Forwards(t *testing.T) {
+	entry := PortMappingEntry{ExternalPort: 8080, InternalPort: 32768, Protocol: "TCP"}
+
+	assert.True(t, entry.Forwards(types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "tcp"}))
+	assert.False(t, entry.Forwards(types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "UDP"}))
+	assert.False(t, entry.Forwards(types.PortMapping{ExternalPort: 8081, InternalPort: 80, Protocol: "TCP"}))
+}
+
+func TestClient_Metrics(t *testing.T) {
+	operations := func(operation, result string) float64 {
+		return testutil.ToFloat64(metrics.Operations.WithLabelValues(operation, result))
+	}
+	added := operations(metrics.OperationAdd, metrics.ResultSuccess)
+	failed := operations(metrics.OperationAdd, metrics.ResultError)
+	deleted := operations(metrics.OperationDelete, metrics.ResultSuccess)
+	web := types.PortMapping{ExternalPort: 8080, InternalPort: 80, Protocol: "TCP", Name: "web"}
+
+	connection := &DummyConnection{}
+	client := NewClientWithConnection(connection, "192.168.1.100", DefaultLeaseDuration)
+	assert.NoError(t, client.ForwardPorts([]types.PortMapping{web}))
+	assert.NoError(t, client.RenewPorts([]types.PortMapping{web}), "renewals are not counted as added")
+	assert.NoError(t, client.DeleteMapping(web))
+	connection.ForwardErr = errors.New("ConflictInMappingEntry")
+	assert.Error(t, client.ForwardPorts([]types.PortMapping{web}))
+
+	assert.Equal(t, added+1, operations(metrics.OperationAdd, metrics.ResultSuccess))
+	assert.Equal(t, failed+1, operations(metrics.OperationAdd, metrics.ResultError))
+	assert.Equal(t, deleted+1, operations(metrics.OperationDelete, metrics.ResultSuccess))
+	assert.Positive(t, testutil.CollectAndCount(metrics.SOAPDuration, "gangplank_upnp_request_duration_seconds"))
+
+	unreachable := NewClientWithConnection(&unreachableConnection{}, "192.168.1.100", DefaultLeaseDuration)
+	_, err := unreachable.VerifyMapping(web)
+	assert.Error(t, err)
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.GatewayUp), "gateway did not answer")
+
+	_, err = client.VerifyMapping(web)
+	assert.ErrorIs(t, err, ErrNotVerifiable)
+	ip, err := client.ExternalIP()
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.1", ip)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.GatewayUp))
+}